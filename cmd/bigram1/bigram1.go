@@ -5,14 +5,25 @@ import (
 	"fmt"
 	"github.com/neurlang/classifier/hash"
 	"github.com/neurlang/classifier/parallel"
+	"github.com/neurlang/gospeak/codec"
 	"io/ioutil"
 	"os"
+	"strings"
 	"sync"
 )
 
+// frameKey formats a token frame as space separated integers.
+func frameKey(frame []uint32) string {
+	var key []string
+	for _, token := range frame {
+		key = append(key, fmt.Sprint(token))
+	}
+	return strings.Join(key, " ")
+}
+
 func main() {
-	if len(os.Args) != 5 {
-		fmt.Println("Usage: go run bigram_generator.go <input.json> <input2.json> <output.json> <output2.json>")
+	if len(os.Args) != 5 && len(os.Args) != 6 {
+		fmt.Println("Usage: go run bigram_generator.go <input.json> <input2.json> <output.json> <output2.json> [centroids]")
 		return
 	}
 
@@ -21,6 +32,16 @@ func main() {
 	outputFile := os.Args[3]
 	outputFile2 := os.Args[4]
 
+	// Token frame size follows the codebook band count
+	var bands = 8
+	if len(os.Args) == 6 {
+		layout, err := codec.LoadLayout(os.Args[5])
+		if err != nil {
+			panic(err)
+		}
+		bands = layout.Bands()
+	}
+
 	// Read the JSON file
 	content, err := ioutil.ReadFile(inputFile)
 	if err != nil {
@@ -65,14 +86,14 @@ func main() {
 		delete(data, k)
 	}
 
-	var hashdata = make(map[[8]uint32]struct{})
+	var hashdata = make(map[string][]uint32)
 	for _, v := range data {
-		for i := 0; i < len(v); i += 8 {
-			hashdata[[8]uint32{v[i], v[i+1], v[i+2], v[i+3], v[i+4], v[i+5], v[i+6], v[i+7]}] = struct{}{}
+		for i := 0; i+bands <= len(v); i += bands {
+			hashdata[frameKey(v[i:i+bands])] = v[i : i+bands]
 		}
 	}
-	var framedata [][8]uint32
-	for v := range hashdata {
+	var framedata [][]uint32
+	for _, v := range hashdata {
 		framedata = append(framedata, v)
 	}
 
@@ -91,7 +112,7 @@ func main() {
 				return true
 			}
 			var h = i
-			for k := 0; k < 8; k++ {
+			for k := 0; k < bands; k++ {
 				h = hash.Hash(h, framedata[j][k], (1<<32)-1)
 			}
 			usedLock.Lock()
@@ -115,14 +136,14 @@ func main() {
 	})
 /*
 	{
-		var used = make(map[uint32][8]uint32)
+		var used = make(map[uint32][]uint32)
 		for _, val := range framedata {
 			var h = sol
-			for k := 0; k < 8; k++ {
+			for k := 0; k < bands; k++ {
 				h = hash.Hash(h, val[k], (1<<32)-1)
 			}
 			if old, ok := used[h]; ok {
-				if old != val {
+				if frameKey(old) != frameKey(val) {
 					panic("hash conflict")
 				}
 			}
@@ -134,9 +155,9 @@ func main() {
 	var odata = make(map[string][]uint32)
 	for j, v := range data {
 		var buffer []uint32
-		for i := 0; i < len(v); i += 8 {
+		for i := 0; i+bands <= len(v); i += bands {
 			var h = sol
-			for k := 0; k < 8; k++ {
+			for k := 0; k < bands; k++ {
 				h = hash.Hash(h, v[i+k], (1<<32)-1)
 			}
 			buffer = append(buffer, h)
@@ -172,11 +193,8 @@ func main() {
 
 	for k, v := range data {
 		var keys []string
-		for i := 0; i < len(v); i += 8 {
-			var key = fmt.Sprintf("%d %d %d %d %d %d %d %d",
-				v[i+0], v[i+1], v[i+2], v[i+3],
-				v[i+4], v[i+5], v[i+6], v[i+7])
-			keys = append(keys, key)
+		for i := 0; i+bands <= len(v); i += bands {
+			keys = append(keys, frameKey(v[i:i+bands]))
 		}
 
 		// put initial letter bigram
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/neurlang/gospeak/codec"
+)
+
+// handleBench benchmarks the indexed nearest codeword search against the
+// linear scan and verifies that both produce the same tokens.
+func handleBench() {
+	cmd := flag.NewFlagSet("bench", flag.ExitOnError)
+	inputFile := cmd.String("i", "", "Input WAV/FLAC file or folder")
+	centroidsFile := cmd.String("v", "", "Centroids file path (JSON or binary)")
+	rounds := cmd.Int("n", 3, "Number of benchmark rounds")
+	threads := cmd.Int("threads", 1, "Number of frames encoded in parallel")
+
+	cmd.Parse(os.Args[2:])
+
+	if *inputFile == "" || *centroidsFile == "" {
+		fmt.Println("Input file and centroids file are required")
+		cmd.PrintDefaults()
+		os.Exit(1)
+	}
+
+	cb, err := codec.LoadCodebook(*centroidsFile)
+	if err != nil {
+		panic(err)
+	}
+
+	// Analyse the audio once, only the codeword search is measured
+	var spectrograms [][][3]float64
+	var frames int
+	for _, file := range audioFiles(*inputFile) {
+		audio, sampleRate, err := codec.LoadAudio(file)
+		if err != nil {
+			fmt.Println(err.Error())
+			continue
+		}
+		audio, err = codec.ToNative(audio, sampleRate, &cb.Layout)
+		if err != nil {
+			fmt.Println(file, err.Error())
+			continue
+		}
+		melFrames, err := cb.Phase().ToPhase(audio)
+		if err != nil {
+			panic(err)
+		}
+		spectrograms = append(spectrograms, melFrames)
+		frames += len(melFrames) / cb.NumFreqs
+	}
+	if frames == 0 {
+		fmt.Println("No frames to encode")
+		os.Exit(1)
+	}
+
+	linear := codec.NewEncoder(cb)
+	linear.Threads = *threads
+	linear.Linear = true
+	indexed := codec.NewEncoder(cb)
+	indexed.Threads = *threads
+
+	run := func(enc *codec.Encoder) (tokens [][]uint32, best time.Duration) {
+		for round := 0; round < *rounds; round++ {
+			start := time.Now()
+			tokens = tokens[:0]
+			for _, melFrames := range spectrograms {
+				t, err := enc.EncodeFrames(melFrames)
+				if err != nil {
+					panic(err)
+				}
+				tokens = append(tokens, t)
+			}
+			if elapsed := time.Since(start); round == 0 || elapsed < best {
+				best = elapsed
+			}
+		}
+		return
+	}
+
+	linearTokens, linearTime := run(linear)
+	indexedTokens, indexedTime := run(indexed)
+
+	var mismatches int
+	for i := range linearTokens {
+		for j := range linearTokens[i] {
+			if linearTokens[i][j] != indexedTokens[i][j] {
+				mismatches++
+			}
+		}
+	}
+
+	fmt.Printf("Frames: %d, bands: %d, codewords: %d\n", frames, cb.Bands(), cb.Size(0))
+	fmt.Printf("Linear scan: %v (%v/frame)\n", linearTime, linearTime/time.Duration(frames))
+	fmt.Printf("Indexed:     %v (%v/frame)\n", indexedTime, indexedTime/time.Duration(frames))
+	fmt.Printf("Speedup:     %.2fx\n", float64(linearTime)/float64(indexedTime))
+	fmt.Printf("Mismatching tokens: %d\n", mismatches)
+	if mismatches != 0 {
+		os.Exit(1)
+	}
+}
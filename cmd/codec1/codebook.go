@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/neurlang/gospeak/codec"
+)
+
+// bandUsage are the usage statistics of the codewords of a band.
+type bandUsage struct {
+	// Size is the number of codewords
+	Size int
+	// Used is the number of codewords used at least once
+	Used int
+	// Entropy is the entropy of the tokens in bits
+	Entropy float64
+	// Perplexity is the number of equally likely codewords of the same entropy
+	Perplexity float64
+	// Kept is the number of codewords of the compacted codebook
+	Kept int `json:",omitempty"`
+	// Counts is the usage histogram, the number of tokens of every codeword
+	Counts []int
+}
+
+type usageReport struct {
+	Files  int
+	Frames int
+	Bands  []bandUsage
+}
+
+// remapTable maps the tokens of a codebook to the tokens of its compacted codebook.
+type remapTable struct {
+	// From and To are the hashes of the original and the compacted codebook
+	From, To string
+	// Bands is the number of tokens of a token frame
+	Bands int
+	// Remap is indexed by band and original codeword, the tokens of the
+	// bands missing from a partial codebook stay
+	Remap [][]uint32
+}
+
+// handleCodebook encodes audio files, reports the codeword usage and optionally compacts the codebook.
+func handleCodebook() {
+	start := time.Now()
+	cmd := flag.NewFlagSet("codebook", flag.ExitOnError)
+	inputFile := cmd.String("i", "", "Input WAV/FLAC file or folder")
+	centroidsFile := cmd.String("v", "", "Centroids file path (JSON or binary)")
+	reportFile := cmd.String("report", "", "Output JSON usage report path (if not provided, writes a summary to console)")
+	outputFile := cmd.String("o", "", "Output compacted centroids file path")
+	format := cmd.String("f", "", "Output format: json, f16 or f32 (default json for .json output, f16 otherwise)")
+	remapFile := cmd.String("remap", "", "Output remap table path (default the output path with the extension .remap.json)")
+	minCount := cmd.Int("min-count", 1, "Prune the codewords used fewer times than this")
+	merge := cmd.Float64("merge", 0, "Merge the codewords nearer to a more used codeword than this many dB of its energy (negative, 0 disables)")
+
+	cmd.Parse(os.Args[2:])
+
+	if *inputFile == "" || *centroidsFile == "" {
+		fmt.Println("Input file and centroids file are required")
+		cmd.PrintDefaults()
+		os.Exit(1)
+	}
+
+	cb, err := codec.LoadCodebook(*centroidsFile)
+	if err != nil {
+		panic(err)
+	}
+	enc := codec.NewEncoder(cb)
+
+	var report = usageReport{Bands: make([]bandUsage, len(cb.Centroids))}
+	for rang := range report.Bands {
+		report.Bands[rang].Size = cb.Size(rang)
+		report.Bands[rang].Counts = make([]int, cb.Size(rang))
+	}
+	var files = audioFiles(*inputFile)
+	for i, file := range files {
+		progressbar(i, len(files), uint64(i), uint64(len(files)))
+		tokens, err := enc.EncodeFile(file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, file, err.Error())
+			continue
+		}
+		report.count(tokens, cb.Bands())
+	}
+	progressbar(len(files), len(files), uint64(len(files)), uint64(len(files)))
+	fmt.Println()
+	for rang := range report.Bands {
+		report.Bands[rang].measure()
+	}
+
+	if *outputFile != "" {
+		var table = remapTable{From: hashString(cb), Bands: cb.Bands(), Remap: make([][]uint32, len(cb.Centroids))}
+		var centroids = make([][][]float64, len(cb.Centroids))
+		var exemplars [][][][]float64
+		if cb.Exemplars != nil {
+			exemplars = make([][][][]float64, len(cb.Exemplars))
+		}
+		for rang, band := range cb.Centroids {
+			var kept []int
+			kept, table.Remap[rang] = compact(band, report.Bands[rang].Counts, *minCount, *merge)
+			report.Bands[rang].Kept = len(kept)
+			for _, codeword := range kept {
+				centroids[rang] = append(centroids[rang], band[codeword])
+				if rang < len(exemplars) && len(cb.Exemplars[rang]) != 0 {
+					exemplars[rang] = append(exemplars[rang], cb.Exemplars[rang][codeword])
+				}
+			}
+		}
+		// the compacted bands take the widths of their codewords
+		layout := cb.Layout
+		layout.BandBits = nil
+		compacted, err := codec.NewCodebookLayout(layout, centroids)
+		if err != nil {
+			panic(err)
+		}
+		if err := compacted.SetExemplars(exemplars); err != nil {
+			panic(err)
+		}
+		compacted.Seed, compacted.Corpus = cb.Seed, cb.Corpus
+		// the residual stages do not depend on the base codeword IDs
+		if err := compacted.SetResiduals(cb.Residuals); err != nil {
+			panic(err)
+		}
+		if err := writeCodebook(compacted, *outputFile, *format); err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		table.To = hashString(compacted)
+		if *remapFile == "" {
+			*remapFile = strings.TrimSuffix(*outputFile, filepath.Ext(*outputFile)) + ".remap.json"
+		}
+		data, err := json.Marshal(table)
+		if err != nil {
+			panic(err)
+		}
+		data = bytes.ReplaceAll(data, []byte(`],`), []byte("],\n"))
+		if err := os.WriteFile(*remapFile, data, 0644); err != nil {
+			panic(fmt.Sprintf("Error writing remap table: %v", err))
+		}
+	}
+
+	if *reportFile != "" {
+		data, err := json.MarshalIndent(report, "", " ")
+		if err != nil {
+			panic(err)
+		}
+		if err := os.WriteFile(*reportFile, data, 0644); err != nil {
+			panic(fmt.Sprintf("Error writing report file: %v", err))
+		}
+	}
+	fmt.Printf("Files: %d, frames: %d\n", report.Files, report.Frames)
+	for rang, band := range report.Bands {
+		fmt.Printf("Band %d: %d codewords, %d used, entropy %.2f bits, perplexity %.1f", rang, band.Size, band.Used, band.Entropy, band.Perplexity)
+		if *outputFile != "" {
+			fmt.Printf(", %d kept", band.Kept)
+		}
+		fmt.Println()
+	}
+	fmt.Printf("Codebook completed in %v\n", time.Since(start))
+}
+
+// count adds the tokens of a file to the usage histograms. The bands without
+// codewords are skipped, the encoder leaves their tokens 0.
+func (r *usageReport) count(tokens []uint32, bands int) {
+	for i, token := range tokens {
+		if rang := i % bands; rang < len(r.Bands) && int(token) < len(r.Bands[rang].Counts) {
+			r.Bands[rang].Counts[token]++
+		}
+	}
+	r.Files++
+	r.Frames += len(tokens) / bands
+}
+
+// measure computes the statistics of the usage histogram.
+func (b *bandUsage) measure() {
+	var total int
+	for _, n := range b.Counts {
+		total += n
+	}
+	b.Used, b.Entropy = 0, 0
+	for _, n := range b.Counts {
+		if n == 0 {
+			continue
+		}
+		b.Used++
+		p := float64(n) / float64(total)
+		b.Entropy -= p * math.Log2(p)
+	}
+	b.Perplexity = math.Exp2(b.Entropy)
+}
+
+func hashString(cb *codec.Codebook) string {
+	hash := cb.Hash()
+	return hex.EncodeToString(hash[:])
+}
+
+// codewordKey returns the magnitude coordinates of a flat codeword of phase triples.
+func codewordKey(centroid []float64) []float64 {
+	var frames = make([][3]float64, len(centroid)/3)
+	for i := range frames {
+		frames[i] = [3]float64{centroid[3*i], centroid[3*i+1], centroid[3*i+2]}
+	}
+	return codec.BandKey(frames)
+}
+
+// compact chooses the codewords of a band to keep and maps every codeword to
+// a kept one. Going from the most used codeword, every codeword absorbs the
+// codewords nearer to it than merge dB of its energy, then the codewords
+// absorbing fewer than minCount tokens are pruned. Absorbed codewords map to
+// the codeword absorbing them if it is kept, the other dropped codewords to
+// their nearest kept codeword. The kept codewords keep their order.
+func compact(band [][]float64, counts []int, minCount int, merge float64) (kept []int, remap []uint32) {
+	var keys = make([][]float64, len(band))
+	var norms = make([]float64, len(band))
+	var order, byNorm []int
+	for codeword, centroid := range band {
+		if len(centroid) == 0 {
+			continue
+		}
+		keys[codeword] = codewordKey(centroid)
+		norms[codeword] = codec.Norm(keys[codeword])
+		order = append(order, codeword)
+		byNorm = append(byNorm, codeword)
+	}
+	sort.SliceStable(order, func(i, j int) bool { return counts[order[i]] > counts[order[j]] })
+	sort.SliceStable(byNorm, func(i, j int) bool { return norms[byNorm[i]] < norms[byNorm[j]] })
+	var position = make([]int, len(band))
+	for i, codeword := range byNorm {
+		position[codeword] = i
+	}
+
+	var owner = make([]int, len(band))
+	for codeword := range owner {
+		owner[codeword] = -1
+	}
+	var totals = append([]int(nil), counts...)
+	for _, codeword := range order {
+		if owner[codeword] >= 0 {
+			continue
+		}
+		owner[codeword] = codeword
+		if merge >= 0 {
+			continue
+		}
+		radius := norms[codeword] * norms[codeword] * math.Pow(10, merge/10)
+		absorb := func(i int) bool {
+			other := byNorm[i]
+			if codec.LowerBound(norms[other], norms[codeword]) > radius {
+				return false
+			}
+			if owner[other] < 0 && codec.PartialDistance(keys[codeword], keys[other], radius) <= radius {
+				owner[other] = codeword
+				totals[codeword] += counts[other]
+			}
+			return true
+		}
+		for i := position[codeword] + 1; i < len(byNorm) && absorb(i); i++ {
+		}
+		for i := position[codeword] - 1; i >= 0 && absorb(i); i-- {
+		}
+	}
+
+	var index = make([]int, len(band))
+	for codeword := range band {
+		index[codeword] = -1
+		if owner[codeword] == codeword && totals[codeword] >= minCount {
+			index[codeword] = len(kept)
+			kept = append(kept, codeword)
+		}
+	}
+	if len(kept) == 0 && len(order) > 0 {
+		// keep the most used codeword at least
+		index[order[0]] = 0
+		kept = append(kept, order[0])
+	}
+
+	var keptKeys = make([][]float64, len(kept))
+	for i, codeword := range kept {
+		keptKeys[i] = keys[codeword]
+	}
+	var nearest = codec.NewIndex(keptKeys)
+	remap = make([]uint32, len(band))
+	for codeword := range band {
+		switch {
+		case index[codeword] >= 0:
+			remap[codeword] = uint32(index[codeword])
+		case owner[codeword] >= 0 && index[owner[codeword]] >= 0:
+			remap[codeword] = uint32(index[owner[codeword]])
+		case keys[codeword] != nil:
+			i, _ := nearest.Nearest(keys[codeword])
+			remap[codeword] = uint32(i)
+		}
+	}
+	return kept, remap
+}
+
+// handleRemap migrates token files to a compacted codebook using its remap table.
+func handleRemap() {
+	start := time.Now()
+	cmd := flag.NewFlagSet("remap", flag.ExitOnError)
+	inputFile := cmd.String("i", "", "Input JSON or .gsc file path")
+	outputFile := cmd.String("o", "", "Output JSON or .gsc file path")
+	remapFile := cmd.String("m", "", "Remap table path, written by the codebook command")
+	fromFile := cmd.String("v", "", "Original centroids file path (required for .gsc input)")
+	toFile := cmd.String("n", "", "Compacted centroids file path (required for .gsc output)")
+
+	cmd.Parse(os.Args[2:])
+
+	if *inputFile == "" || *outputFile == "" || *remapFile == "" {
+		fmt.Println("Input file, output file and remap table are required")
+		cmd.PrintDefaults()
+		os.Exit(1)
+	}
+	data, err := os.ReadFile(*remapFile)
+	if err != nil {
+		panic(fmt.Sprintf("Error reading remap table: %v", err))
+	}
+	var table remapTable
+	if err := json.Unmarshal(data, &table); err != nil || table.Bands < len(table.Remap) || table.Bands == 0 {
+		panic(fmt.Sprintf("Error parsing remap table: %v", err))
+	}
+	if data, err = os.ReadFile(*inputFile); err != nil {
+		panic(fmt.Sprintf("Error reading input file: %v", err))
+	}
+
+	// load a codebook and check it is the one of the remap table
+	load := func(centroidsFile, hash string) *codec.Codebook {
+		if centroidsFile == "" {
+			fmt.Println("Centroids file is required for .gsc files")
+			os.Exit(1)
+		}
+		cb, err := codec.LoadCodebook(centroidsFile)
+		if err != nil {
+			panic(err)
+		}
+		if hashString(cb) != hash {
+			fmt.Println(centroidsFile, "is not the codebook of the remap table")
+			os.Exit(1)
+		}
+		return cb
+	}
+
+	var output []byte
+	if codec.IsGSC(data) {
+		header, err := codec.ReadGSCHeader(bytes.NewReader(data))
+		if err != nil {
+			panic(err)
+		}
+		tokens, err := load(*fromFile, table.From).ReadGSC(bytes.NewReader(data))
+		if err != nil {
+			panic(fmt.Sprintf("Error parsing bitstream: %v", err))
+		}
+		if err := table.apply(tokens); err != nil {
+			panic(err)
+		}
+		if !strings.HasSuffix(*outputFile, ".gsc") {
+			output, _ = json.Marshal(tokens)
+		} else {
+			var buf bytes.Buffer
+			if err := load(*toFile, table.To).WriteGSC(&buf, tokens, header.Flags&codec.GSCRangeCoded != 0); err != nil {
+				panic(err)
+			}
+			output = buf.Bytes()
+		}
+	} else {
+		// a token file, or the token files of a folder by file name
+		var tokens []uint32
+		var folder map[string][]uint32
+		if json.Unmarshal(data, &tokens) == nil {
+			if err := table.apply(tokens); err != nil {
+				panic(err)
+			}
+			output, _ = json.Marshal(tokens)
+		} else if err := json.Unmarshal(data, &folder); err == nil {
+			if strings.HasSuffix(*outputFile, ".gsc") {
+				fmt.Println("The token files of a folder can only be written as JSON")
+				os.Exit(1)
+			}
+			for _, tokens := range folder {
+				if err := table.apply(tokens); err != nil {
+					panic(err)
+				}
+			}
+			output, _ = json.MarshalIndent(folder, "", " ")
+		} else {
+			panic(fmt.Sprintf("Error parsing JSON: %v", err))
+		}
+		if strings.HasSuffix(*outputFile, ".gsc") {
+			var buf bytes.Buffer
+			if err := load(*toFile, table.To).WriteGSC(&buf, tokens, false); err != nil {
+				panic(err)
+			}
+			output = buf.Bytes()
+		}
+	}
+	if err := os.WriteFile(*outputFile, output, 0644); err != nil {
+		panic(fmt.Sprintf("Error writing output file: %v", err))
+	}
+	fmt.Printf("Remapping completed in %v\n", time.Since(start))
+}
+
+// apply remaps token frames in place.
+func (t *remapTable) apply(tokens []uint32) error {
+	for i, token := range tokens {
+		rang := i % t.Bands
+		if rang >= len(t.Remap) {
+			continue
+		}
+		if int(token) >= len(t.Remap[rang]) {
+			return fmt.Errorf("%w: band %d token %d", codec.ErrTokenRange, rang, token)
+		}
+		tokens[i] = t.Remap[rang][token]
+	}
+	return nil
+}
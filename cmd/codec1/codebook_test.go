@@ -0,0 +1,59 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/neurlang/gospeak/codec"
+)
+
+// TestCodebookEmptyBand reports and compacts a codebook whose middle band has
+// no codewords, which the encoder leaves without tokens.
+func TestCodebookEmptyBand(t *testing.T) {
+	layout, err := codec.LayoutFor(48000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := layout.SetBands("3"); err != nil {
+		t.Fatal(err)
+	}
+	rng := rand.New(rand.NewSource(18))
+	var centroids = make([][][]float64, layout.Bands())
+	for _, rang := range []int{0, 2} {
+		for idx := 0; idx < 4; idx++ {
+			var codeword = make([]float64, 3*(layout.Ranges[rang+1]-layout.Ranges[rang]))
+			for i := range codeword {
+				codeword[i] = rng.NormFloat64() - 10
+			}
+			centroids[rang] = append(centroids[rang], codeword)
+		}
+	}
+	cb, err := codec.NewCodebookLayout(layout, centroids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tokens []uint32
+	for i := 0; i < 10*cb.Bands(); i++ {
+		tokens = append(tokens, uint32(rng.Intn(4)))
+	}
+
+	var report = usageReport{Bands: make([]bandUsage, len(cb.Centroids))}
+	for rang := range report.Bands {
+		report.Bands[rang].Size = cb.Size(rang)
+		report.Bands[rang].Counts = make([]int, cb.Size(rang))
+	}
+	report.count(tokens, cb.Bands())
+	if report.Frames != 10 {
+		t.Errorf("%d frames, want 10", report.Frames)
+	}
+	for rang := range report.Bands {
+		report.Bands[rang].measure()
+		kept, remap := compact(cb.Centroids[rang], report.Bands[rang].Counts, 1, 0)
+		if rang == 1 && (report.Bands[rang].Used != 0 || len(kept) != 0 || len(remap) != 0) {
+			t.Errorf("empty band: %d used, %d kept, %d remapped", report.Bands[rang].Used, len(kept), len(remap))
+		}
+		if rang != 1 && report.Bands[rang].Used == 0 {
+			t.Errorf("band %d unused", rang)
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"time"
+
+	"github.com/neurlang/gospeak/codec"
+	"github.com/r9y9/gossp/stft"
+)
+
+const (
+	// evalMels is the number of mel filters of the mel cepstral distortion
+	evalMels = 40
+	// evalCeps is the number of cepstral coefficients compared, c0 excluded
+	evalCeps = 24
+)
+
+// evalMetrics are the objective quality metrics of a roundtrip.
+type evalMetrics struct {
+	// Frames is the number of spectrogram frames
+	Frames int
+	// Gain is the level of the decoded audio relative to the original in dB,
+	// it is compensated before the other metrics are measured
+	Gain float64
+	// SNR is the signal to noise ratio of the decoded waveform in dB
+	SNR float64
+	// LSD is the log-spectral distance in dB within the codec bandwidth
+	LSD float64
+	// MCD is the mel-cepstral distortion in dB within the codec bandwidth
+	MCD float64
+	// BandError is the quantisation error of each band in dB, the distance of
+	// the codeword keys relative to the energy of the band keys
+	BandError []float64
+}
+
+type evalFile struct {
+	File string
+	evalMetrics
+}
+
+type evalSummary struct {
+	Files int
+	// Bitrate is the bits per second of the packed base tokens
+	Bitrate float64
+	evalMetrics
+}
+
+type evalReport struct {
+	Files   []evalFile
+	Summary evalSummary
+}
+
+// handleEval encodes and decodes audio files and measures the quality of the roundtrip.
+func handleEval() {
+	start := time.Now()
+	cmd := flag.NewFlagSet("eval", flag.ExitOnError)
+	inputFile := cmd.String("i", "", "Input WAV/FLAC file or folder")
+	centroidsFile := cmd.String("v", "", "Centroids file path (JSON or binary)")
+	outputFile := cmd.String("o", "", "Output JSON report path (if not provided, writes to console)")
+	stages := cmd.Int("stages", 1, "Quantisation stages decoded, the residual stages of the codebook refine the base tokens")
+
+	cmd.Parse(os.Args[2:])
+
+	if *inputFile == "" || *centroidsFile == "" {
+		fmt.Println("Input file and centroids file are required")
+		cmd.PrintDefaults()
+		os.Exit(1)
+	}
+
+	cb, err := codec.LoadCodebook(*centroidsFile)
+	if err != nil {
+		panic(err)
+	}
+	if *stages < 1 || *stages > cb.Stages() {
+		fmt.Printf("The codebook has %d stages\n", cb.Stages())
+		os.Exit(1)
+	}
+	ev := newEvaluator(cb)
+	ev.stages = *stages
+
+	var report evalReport
+	var files = audioFiles(*inputFile)
+	for i, file := range files {
+		if *outputFile != "" {
+			progressbar(i, len(files), uint64(i), uint64(len(files)))
+		}
+		metrics, err := ev.evaluate(file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, file, err.Error())
+			continue
+		}
+		report.Files = append(report.Files, evalFile{File: file, evalMetrics: *metrics})
+	}
+	report.Summary = summarize(report.Files, cb.Bands())
+	report.Summary.Bitrate = cb.Bitrate()
+
+	data, err := json.MarshalIndent(report, "", " ")
+	if err != nil {
+		panic(err)
+	}
+	if *outputFile == "" {
+		fmt.Println(string(data))
+		return
+	}
+	if err := os.WriteFile(*outputFile, data, 0644); err != nil {
+		panic(fmt.Sprintf("Error writing output file: %v", err))
+	}
+	progressbar(len(files), len(files), uint64(len(files)), uint64(len(files)))
+	fmt.Println()
+	s := report.Summary
+	fmt.Printf("Files: %d, frames: %d, bitrate: %g bits/s\n", s.Files, s.Frames, s.Bitrate)
+	fmt.Printf("Gain: %.2f dB, SNR: %.2f dB, LSD: %.2f dB, MCD: %.2f dB\n", s.Gain, s.SNR, s.LSD, s.MCD)
+	fmt.Printf("Band error (dB): %.2f\n", s.BandError)
+	fmt.Printf("Evaluation completed in %v\n", time.Since(start))
+}
+
+// evaluator holds what is shared by the evaluation of every file.
+type evaluator struct {
+	cb   *codec.Codebook
+	enc  *codec.Encoder
+	dec  *codec.Decoder
+	stft *stft.STFT
+	mels [][]float64 // mel filter weights over the spectrum bins
+	// stages is the number of quantisation stages decoded
+	stages int
+}
+
+func newEvaluator(cb *codec.Codebook) *evaluator {
+	return &evaluator{
+		cb:     cb,
+		enc:    codec.NewEncoder(cb),
+		dec:    codec.NewDecoder(cb),
+		stft:   stft.New(cb.Window, cb.Resolut),
+		stages: 1,
+		mels:   melFilters(cb.NumFreqs, float64(cb.SampleRate)/float64(cb.Resolut), evalMels),
+	}
+}
+
+// evaluate encodes and decodes a file and compares the result with the original.
+func (ev *evaluator) evaluate(file string) (*evalMetrics, error) {
+	audio, sampleRate, err := codec.LoadAudio(file)
+	if err != nil {
+		return nil, err
+	}
+	audio, err = codec.ToNative(audio, sampleRate, &ev.cb.Layout)
+	if err != nil {
+		return nil, err
+	}
+	melFrames, err := ev.cb.Phase().ToPhase(audio)
+	if err != nil {
+		return nil, err
+	}
+	tokens, enhancement, err := ev.enc.EncodeFramesLayers(melFrames, ev.stages)
+	if err != nil {
+		return nil, err
+	}
+	decodedFrames, err := ev.dec.FramesLayers(tokens, enhancement)
+	if err != nil {
+		return nil, err
+	}
+
+	var metrics = &evalMetrics{
+		Frames:    len(decodedFrames) / ev.cb.NumFreqs,
+		BandError: ev.bandError(melFrames, decodedFrames),
+	}
+	// the audio of the same frames, measured above as synthesis overwrites them
+	decoded, err := ev.dec.Synthesize(decodedFrames)
+	if err != nil {
+		return nil, err
+	}
+
+	// waveform, with the least squares gain of the decoded audio compensated
+	n := len(audio)
+	if len(decoded) < n {
+		n = len(decoded)
+	}
+	var xy, yy float64
+	for i := 0; i < n; i++ {
+		xy += audio[i] * decoded[i]
+		yy += decoded[i] * decoded[i]
+	}
+	if xy > 0 && yy > 0 {
+		metrics.Gain = 20 * math.Log10(yy/xy)
+		for i := range decoded {
+			decoded[i] *= xy / yy
+		}
+	}
+	var signal, noise float64
+	for i := 0; i < n; i++ {
+		signal += audio[i] * audio[i]
+		noise += (audio[i] - decoded[i]) * (audio[i] - decoded[i])
+	}
+	metrics.SNR = decibels(signal, noise)
+
+	// spectra
+	if n < ev.cb.Resolut {
+		return metrics, nil
+	}
+	original := ev.stft.STFT(audio[:n])
+	roundtrip := ev.stft.STFT(decoded[:n])
+	for i := range original {
+		p, q := ev.power(original[i]), ev.power(roundtrip[i])
+		var lsd float64
+		for k := range p {
+			d := 10 * math.Log10(p[k]/q[k])
+			lsd += d * d
+		}
+		metrics.LSD += math.Sqrt(lsd / float64(len(p)))
+
+		c, d := ev.cepstrum(p), ev.cepstrum(q)
+		var mcd float64
+		for k := range c {
+			mcd += (c[k] - d[k]) * (c[k] - d[k])
+		}
+		metrics.MCD += 10 / math.Ln10 * math.Sqrt(2*mcd)
+	}
+	metrics.LSD /= float64(len(original))
+	metrics.MCD /= float64(len(original))
+	return metrics, nil
+}
+
+// bandError computes the quantisation error of the band keys in dB.
+func (ev *evaluator) bandError(original, decoded [][3]float64) []float64 {
+	var errs = make([]float64, ev.cb.Bands())
+	frames := len(decoded) / ev.cb.NumFreqs
+	if len(original)/ev.cb.NumFreqs < frames {
+		frames = len(original) / ev.cb.NumFreqs
+	}
+	for rang := range errs {
+		var signal, noise float64
+		for j := 0; j < frames; j++ {
+			lo, hi := j*ev.cb.NumFreqs+ev.cb.Ranges[rang], j*ev.cb.NumFreqs+ev.cb.Ranges[rang+1]
+			key, quantized := codec.BandKey(original[lo:hi]), codec.BandKey(decoded[lo:hi])
+			for k := range key {
+				signal += key[k] * key[k]
+				noise += (key[k] - quantized[k]) * (key[k] - quantized[k])
+			}
+		}
+		errs[rang] = -decibels(signal, noise)
+	}
+	return errs
+}
+
+// power returns the floored power spectrum of the codec bandwidth, bin 0 excluded.
+func (ev *evaluator) power(spectrum []complex128) []float64 {
+	var p = make([]float64, ev.cb.NumFreqs)
+	for k := range p {
+		v := spectrum[k+1]
+		p[k] = math.Max(real(v)*real(v)+imag(v)*imag(v), 1e-10)
+	}
+	return p
+}
+
+// cepstrum returns the mel cepstrum of the log amplitudes of a power spectrum, c0 excluded.
+func (ev *evaluator) cepstrum(p []float64) []float64 {
+	var logs = make([]float64, len(ev.mels))
+	for m, weights := range ev.mels {
+		var e float64
+		for k, w := range weights {
+			e += w * p[k]
+		}
+		logs[m] = 0.5 * math.Log(math.Max(e, 1e-10))
+	}
+	var c = make([]float64, evalCeps)
+	for d := range c {
+		for m, e := range logs {
+			c[d] += e * math.Cos(math.Pi*float64(d+1)*(float64(m)+0.5)/float64(len(logs)))
+		}
+		c[d] *= math.Sqrt(2 / float64(len(logs)))
+	}
+	return c
+}
+
+// melFilters creates triangular mel filters over bins of the given width in Hz, the first bin being binHz.
+func melFilters(bins int, binHz float64, filters int) [][]float64 {
+	mel := func(hz float64) float64 { return 2595 * math.Log10(1+hz/700) }
+	hz := func(mel float64) float64 { return 700 * (math.Pow(10, mel/2595) - 1) }
+	top := mel(float64(bins) * binHz)
+	var edges = make([]float64, filters+2)
+	for i := range edges {
+		edges[i] = hz(top * float64(i) / float64(filters+1))
+	}
+	var out = make([][]float64, filters)
+	for m := range out {
+		out[m] = make([]float64, bins)
+		lo, mid, hi := edges[m], edges[m+1], edges[m+2]
+		for k := range out[m] {
+			f := float64(k+1) * binHz
+			switch {
+			case f > lo && f <= mid:
+				out[m][k] = (f - lo) / (mid - lo)
+			case f > mid && f < hi:
+				out[m][k] = (hi - f) / (hi - mid)
+			}
+		}
+	}
+	return out
+}
+
+// decibels is the signal to noise ratio in dB, within +-200 dB, and 0 dB when
+// both are silent
+func decibels(signal, noise float64) float64 {
+	if signal == 0 && noise == 0 {
+		return 0
+	}
+	return 10 * math.Log10(math.Max(signal, 1e-20*noise)/math.Max(noise, 1e-20*signal))
+}
+
+// summarize averages the metrics of the files weighted by their frames.
+func summarize(files []evalFile, bands int) (s evalSummary) {
+	s.Files = len(files)
+	s.BandError = make([]float64, bands)
+	for _, f := range files {
+		w := float64(f.Frames)
+		s.Frames += f.Frames
+		s.Gain += w * f.Gain
+		s.SNR += w * f.SNR
+		s.LSD += w * f.LSD
+		s.MCD += w * f.MCD
+		for rang := range s.BandError {
+			s.BandError[rang] += w * f.BandError[rang]
+		}
+	}
+	if s.Frames == 0 {
+		return
+	}
+	w := float64(s.Frames)
+	s.Gain /= w
+	s.SNR /= w
+	s.LSD /= w
+	s.MCD /= w
+	for rang := range s.BandError {
+		s.BandError[rang] /= w
+	}
+	return
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/neurlang/gomel/phase"
+	"github.com/neurlang/gospeak/codec"
+)
+
+func TestDecibels(t *testing.T) {
+	for _, c := range []struct{ signal, noise, want float64 }{
+		{0, 0, 0},
+		{1, 1, 0},
+		{100, 1, 20},
+		{1, 0, 200},
+		{0, 1, -200},
+	} {
+		if got := decibels(c.signal, c.noise); !(math.Abs(got-c.want) < 1e-9) {
+			t.Errorf("decibels(%v, %v) = %v, want %v", c.signal, c.noise, got, c.want)
+		}
+	}
+}
+
+// TestEvalSilence evaluates a file of all zero samples with codewords decoding
+// to silence too, whose report must still marshal.
+func TestEvalSilence(t *testing.T) {
+	layout, err := codec.LayoutFor(48000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rng := rand.New(rand.NewSource(1))
+	var centroids = make([][][]float64, layout.Bands())
+	for rang := range centroids {
+		for idx := 0; idx < 4; idx++ {
+			var codeword = make([]float64, 3*(layout.Ranges[rang+1]-layout.Ranges[rang]))
+			for i := range codeword {
+				codeword[i] = rng.NormFloat64() - 2000
+			}
+			centroids[rang] = append(centroids[rang], codeword)
+		}
+	}
+	cb, err := codec.NewCodebookLayout(layout, centroids)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(t.TempDir(), "silence.wav")
+	if err := phase.SaveWav(file, make([]float64, layout.SampleRate), layout.SampleRate); err != nil {
+		t.Fatal(err)
+	}
+	metrics, err := newEvaluator(cb).evaluate(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files = []evalFile{{File: file, evalMetrics: *metrics}}
+	report := evalReport{Files: files, Summary: summarize(files, cb.Bands())}
+	if _, err := json.MarshalIndent(report, "", " "); err != nil {
+		t.Fatalf("%v: %+v", err, report)
+	}
+}
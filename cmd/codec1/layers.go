@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/neurlang/gospeak/codec"
+)
+
+// enhancementPath returns the default path of the enhancement layer of an
+// output path, .enh before its extension.
+func enhancementPath(outputFile string) string {
+	ext := filepath.Ext(outputFile)
+	if ext == "" {
+		ext = ".json"
+	}
+	return strings.TrimSuffix(outputFile, filepath.Ext(outputFile)) + ".enh" + ext
+}
+
+// writeEnhancement writes the tokens of the residual stages as a packed
+// enhancement bitstream, or as a JSON array of the tokens of every stage.
+func writeEnhancement(cb *codec.Codebook, outputFile string, enhancement [][]uint32, gsc, entropy bool) error {
+	f, err := os.Create(outputFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if gsc {
+		return cb.WriteGSCEnhancement(f, enhancement, entropy)
+	}
+	data, err := json.Marshal(enhancement)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	return err
+}
+
+// readEnhancement reads an enhancement layer written by writeEnhancement.
+func readEnhancement(cb *codec.Codebook, inputFile string) ([][]uint32, error) {
+	data, err := os.ReadFile(inputFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading enhancement layer: %v", err)
+	}
+	if codec.IsGSC(data) {
+		enhancement, err := cb.ReadGSCEnhancement(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing enhancement bitstream: %v", err)
+		}
+		return enhancement, nil
+	}
+	var enhancement [][]uint32
+	if err := json.Unmarshal(data, &enhancement); err != nil {
+		return nil, fmt.Errorf("Error parsing enhancement JSON: %v", err)
+	}
+	return enhancement, nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -9,6 +10,8 @@ import (
 	"path/filepath"
 	"strings"
 	"time"
+
+	"github.com/neurlang/gospeak/codec"
 )
 
 func emptySpace(space int) string {
@@ -46,6 +49,16 @@ func main() {
 		handleDecode()
 	case "encode":
 		handleEncode()
+	case "convert":
+		handleConvert()
+	case "bench":
+		handleBench()
+	case "eval":
+		handleEval()
+	case "codebook":
+		handleCodebook()
+	case "remap":
+		handleRemap()
 	case "-h", "help":
 		handleHelp()
 	default:
@@ -58,16 +71,24 @@ func handleHelp() {
 	fmt.Println("Available commands:")
 	fmt.Println("  decode - Decode JSON code to WAV audio")
 	fmt.Println("  encode - Encode WAV/FLAC file/folder to JSON code")
+	fmt.Println("  convert - Convert centroids between JSON and binary formats")
+	fmt.Println("  bench - Benchmark indexed codeword search against linear scan")
+	fmt.Println("  eval - Measure the roundtrip quality of a codec on WAV/FLAC file/folder")
+	fmt.Println("  codebook - Report the codeword usage on WAV/FLAC file/folder, prune and merge codewords")
+	fmt.Println("  remap - Migrate JSON or .gsc code to a compacted codebook")
 	os.Exit(1)
 }
 
 func handleDecode() {
 	start := time.Now()
 	cmd := flag.NewFlagSet("decode", flag.ExitOnError)
-	inputFile := cmd.String("i", "", "Input JSON file path")
+	inputFile := cmd.String("i", "", "Input JSON or .gsc file path, or - to stream token frames from stdin")
 	rawFile := cmd.String("r", "", "Raw JSON or comma separated sequence of integers")
-	outputFile := cmd.String("o", "", "Output WAV file path")
-	centroidsFile := cmd.String("v", "", "Centroids JSON file path")
+	outputFile := cmd.String("o", "", "Output WAV file path, or - to stream to stdout")
+	centroidsFile := cmd.String("v", "", "Centroids file path (JSON or binary)")
+	raw := cmd.String("raw", "", "Write raw PCM in format s16le or f32le instead of WAV")
+	rate := cmd.Int("rate", 0, "Resample the output audio to this sample rate (default codec native rate)")
+	enhancementFile := cmd.String("e", "", "Input enhancement layer path, JSON or .gsc, refining the tokens with the residual stages")
 
 	cmd.Parse(os.Args[2:])
 
@@ -77,15 +98,28 @@ func handleDecode() {
 		os.Exit(1)
 	}
 
+	// Load centroids
+	cb, err := codec.LoadCodebook(*centroidsFile)
+	if err != nil {
+		panic(err)
+	}
+
 	// Read input tokens
 	var tokens []uint64
-	if inputFile != nil && *inputFile != "" {
+	var tokens32 []uint32
+	if *inputFile == "-" {
+		// streamed below
+	} else if inputFile != nil && *inputFile != "" {
 		data, err := os.ReadFile(*inputFile)
 		if err != nil {
 			panic(fmt.Sprintf("Error reading input file: %v", err))
 		}
 
-		if err := json.Unmarshal(data, &tokens); err != nil {
+		if codec.IsGSC(data) {
+			if tokens32, err = cb.ReadGSC(bytes.NewReader(data)); err != nil {
+				panic(fmt.Sprintf("Error parsing bitstream: %v", err))
+			}
+		} else if err := json.Unmarshal(data, &tokens); err != nil {
 			panic(fmt.Sprintf("Error parsing JSON: %v", err))
 		}
 	} else {
@@ -97,31 +131,105 @@ func handleDecode() {
 		if err := json.Unmarshal([]byte("["+vector+"]"), &tokens); err != nil {
 			panic(fmt.Sprintf("Error parsing JSON: %v", err))
 		}
-		fmt.Println(tokens)
+		if *outputFile != "-" {
+			fmt.Println(tokens)
+		}
 	}
 
 	// Convert to uint32 slice
-	var tokens32 []uint32
 	for _, t := range tokens {
 		tokens32 = append(tokens32, uint32(t))
 	}
 
-	// Load centroids
-	var centroids struct{ Centroids [][][]float64 }
-	data, err := os.ReadFile(*centroidsFile)
-	if err != nil {
-		panic(fmt.Sprintf("Error reading centroids file: %v", err))
+	var enhancement [][]uint32
+	if *enhancementFile != "" {
+		if *inputFile == "-" {
+			fmt.Fprintln(os.Stderr, "The enhancement layer can't be decoded from stdin")
+			os.Exit(1)
+		}
+		if enhancement, err = readEnhancement(cb, *enhancementFile); err != nil {
+			panic(err)
+		}
 	}
 
-	if err := json.Unmarshal(data, &centroids); err != nil {
-		panic(fmt.Sprintf("Error parsing centroids JSON: %v", err))
+	if *rate == 0 {
+		*rate = cb.SampleRate
+	}
+	if *inputFile == "-" || *outputFile == "-" || *raw != "" || *rate != cb.SampleRate {
+		if err := decodeStream(cb, tokens32, enhancement, *inputFile == "-", *outputFile, *raw, *rate); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "Decoding completed in %v\n", time.Since(start))
+		return
 	}
 
 	// Generate audio
-	centroids_vocode(tokens32, centroids.Centroids, *outputFile)
+	if err := codec.NewDecoder(cb).DecodeFileLayers(tokens32, enhancement, *outputFile); err != nil {
+		panic(err)
+	}
 	fmt.Printf("Decoding completed in %v\n", time.Since(start))
 }
 
+func handleConvert() {
+	start := time.Now()
+	cmd := flag.NewFlagSet("convert", flag.ExitOnError)
+	inputFile := cmd.String("i", "", "Input centroids file path (JSON or binary)")
+	outputFile := cmd.String("o", "", "Output centroids file path")
+	format := cmd.String("f", "", "Output format: json, f16 or f32 (default json for .json output, f16 otherwise)")
+
+	cmd.Parse(os.Args[2:])
+
+	if *inputFile == "" || *outputFile == "" {
+		fmt.Println("Input file and output file are required")
+		cmd.PrintDefaults()
+		os.Exit(1)
+	}
+	cb, err := codec.LoadCodebook(*inputFile)
+	if err != nil {
+		panic(err)
+	}
+	if err := writeCodebook(cb, *outputFile, *format); err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+	fmt.Printf("Conversion completed in %v\n", time.Since(start))
+}
+
+// writeCodebook writes a codebook file in the format json, f16 or f32, or
+// for an empty format in JSON if the path ends with .json and f16 otherwise.
+func writeCodebook(cb *codec.Codebook, outputFile, format string) error {
+	if format == "" {
+		if strings.HasSuffix(outputFile, ".json") {
+			format = "json"
+		} else {
+			format = "f16"
+		}
+	}
+	if format != "json" && format != "f16" && format != "f32" {
+		return fmt.Errorf("Unknown format: %s", format)
+	}
+
+	f, err := os.Create(outputFile)
+	if err != nil {
+		return fmt.Errorf("Error creating output file: %v", err)
+	}
+	defer f.Close()
+
+	switch format {
+	case "json":
+		err = cb.WriteJSON(f)
+	case "f16":
+		err = cb.WriteBinary(f, codec.Float16)
+	case "f32":
+		err = cb.WriteBinary(f, codec.Float32)
+	}
+	if err != nil {
+		return fmt.Errorf("Error writing output file: %v", err)
+	}
+	return nil
+}
+
 func isDirectory(path string) (bool, error) {
 	fileInfo, err := os.Stat(path)
 	if err != nil {
@@ -130,11 +238,34 @@ func isDirectory(path string) (bool, error) {
 	return fileInfo.IsDir(), err
 }
 
+// audioFiles lists the WAV and FLAC files of a directory, or returns the path of a file.
+func audioFiles(path string) (files []string) {
+	if is, _ := isDirectory(path); !is {
+		return []string{path}
+	}
+	filepath.Walk(path, func(path string, info fs.FileInfo, err error) error {
+		var isFlac = strings.HasSuffix(path, ".flac")
+		var isWav = strings.HasSuffix(path, ".wav")
+		if !isFlac && !isWav {
+			return nil
+		}
+		files = append(files, path)
+		return nil
+	})
+	return
+}
+
 func handleEncode() {
 	cmd := flag.NewFlagSet("encode", flag.ExitOnError)
-	inputFile := cmd.String("i", "", "Input WAV file path")
-	outputFile := cmd.String("o", "", "Output JSON file path")
-	centroidsFile := cmd.String("v", "", "Centroids JSON file path")
+	inputFile := cmd.String("i", "", "Input WAV file path, or - to stream WAV or raw PCM from stdin")
+	outputFile := cmd.String("o", "", "Output JSON or .gsc file path (folder for a folder input in gsc format)")
+	centroidsFile := cmd.String("v", "", "Centroids file path (JSON or binary)")
+	rate := cmd.Int("rate", 0, "Sample rate of raw PCM input on stdin (default stdin is WAV)")
+	raw := cmd.String("raw", codec.S16LE, "Raw PCM input format: s16le or f32le")
+	format := cmd.String("format", "", "Output format: json or gsc (default gsc for .gsc output, json otherwise)")
+	entropy := cmd.Bool("entropy", false, "Range code the gsc output with adaptive per band statistics")
+	stages := cmd.Int("stages", 1, "Quantisation stages encoded, the tokens of the residual stages form the enhancement layer, 1 encodes the base layer only")
+	enhancementFile := cmd.String("e", "", "Output enhancement layer path (default the output path with .enh before the extension)")
 
 	cmd.Parse(os.Args[2:])
 
@@ -143,47 +274,130 @@ func handleEncode() {
 		cmd.PrintDefaults()
 		os.Exit(1)
 	}
+	if *format == "" {
+		if strings.HasSuffix(*outputFile, ".gsc") {
+			*format = "gsc"
+		} else {
+			*format = "json"
+		}
+	}
+	if *format != "json" && *format != "gsc" {
+		fmt.Printf("Unknown format: %s\n", *format)
+		os.Exit(1)
+	}
+	var gsc = *format == "gsc"
+
+	if *inputFile == "-" {
+		if *stages > 1 {
+			fmt.Fprintln(os.Stderr, "The enhancement layer can't be streamed")
+			os.Exit(1)
+		}
+		if err := encodeStream(*centroidsFile, *outputFile, *raw, uint32(*rate), gsc, *entropy); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	cb, err := codec.LoadCodebook(*centroidsFile)
+	if err != nil {
+		panic(err)
+	}
+	enc := codec.NewEncoder(cb)
+	if *stages < 1 || *stages > cb.Stages() {
+		fmt.Printf("The codebook has %d stages\n", cb.Stages())
+		os.Exit(1)
+	}
 
 	if is, _ := isDirectory(*inputFile); is {
+		if gsc && *outputFile == "" {
+			fmt.Println("Output folder is required for gsc format")
+			os.Exit(1)
+		}
 		fmt.Println("Scanning directory...")
-		var files []string
-		filepath.Walk(*inputFile, func(path string, info fs.FileInfo, err error) error {
-			var isFlac = strings.HasSuffix(path, ".flac")
-			var isWav = strings.HasSuffix(path, ".wav")
-			if !isFlac && !isWav {
-				return nil
-			}
-			files = append(files, path)
-			return nil
-		})
-		c := centroids_load(*centroidsFile)
+		var files = audioFiles(*inputFile)
 		var output = make(map[string]json.RawMessage)
+		var enhancements = make(map[string][][]uint32)
 		progressbar(0, len(files), 0, uint64(len(files)))
 		for i, file := range files {
 			// Process audio
-			jsonData, err := centroids_unvocode(file, c)
+			tokens, enhancement, err := enc.EncodeFileLayers(file, *stages)
 			if err != nil {
 				fmt.Println(err.Error())
 				continue
 			}
-			if *outputFile != "" {
-				output[filepath.Base(file)] = json.RawMessage(jsonData)
+			if gsc {
+				name := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file)) + ".gsc"
+				if err := writeGSC(cb, filepath.Join(*outputFile, name), tokens, *entropy); err != nil {
+					fmt.Println(err.Error())
+					continue
+				}
+				if len(enhancement) > 0 {
+					if err := writeEnhancement(cb, enhancementPath(filepath.Join(*outputFile, name)), enhancement, true, *entropy); err != nil {
+						fmt.Println(err.Error())
+						continue
+					}
+				}
 			} else {
-				fmt.Println(string(jsonData))
+				jsonData, _ := json.Marshal(tokens)
+				if *outputFile != "" {
+					output[filepath.Base(file)] = json.RawMessage(jsonData)
+					if len(enhancement) > 0 {
+						enhancements[filepath.Base(file)] = enhancement
+					}
+				} else {
+					fmt.Println(string(jsonData))
+					if len(enhancement) > 0 {
+						jsonData, _ = json.Marshal(enhancement)
+						fmt.Println(string(jsonData))
+					}
+				}
 			}
 			progressbar(i+1, len(files), uint64(i+1), uint64(len(files)))
 		}
-		if *outputFile != "" {
+		if *outputFile != "" && !gsc {
 			fatJson, err := json.MarshalIndent(output, "", " ")
 			if err != nil {
 				fmt.Println(err.Error())
 				return
 			}
 			os.WriteFile(*outputFile, fatJson, 0644)
+			if len(enhancements) > 0 {
+				if *enhancementFile == "" {
+					*enhancementFile = enhancementPath(*outputFile)
+				}
+				fatJson, _ = json.Marshal(enhancements)
+				os.WriteFile(*enhancementFile, fatJson, 0644)
+			}
 		}
 	} else {
 		// Process audio
-		jsonData, _ := centroids_unvocode(*inputFile, centroids_load(*centroidsFile))
+		tokens, enhancement, err := enc.EncodeFileLayers(*inputFile, *stages)
+		if err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		if len(enhancement) > 0 {
+			if *enhancementFile == "" && (*outputFile == "" || *outputFile == "-") {
+				fmt.Println("Enhancement layer path (-e) is required when writing to console")
+				os.Exit(1)
+			}
+			if *enhancementFile == "" {
+				*enhancementFile = enhancementPath(*outputFile)
+			}
+			if err := writeEnhancement(cb, *enhancementFile, enhancement, gsc, *entropy); err != nil {
+				fmt.Println(err.Error())
+				os.Exit(1)
+			}
+		}
+		if gsc {
+			if err := writeGSC(cb, *outputFile, tokens, *entropy); err != nil {
+				fmt.Println(err.Error())
+				os.Exit(1)
+			}
+			return
+		}
+		jsonData, _ := json.Marshal(tokens)
 
 		if *outputFile != "" {
 			os.WriteFile(*outputFile, jsonData, 0644)
@@ -192,3 +406,16 @@ func handleEncode() {
 		}
 	}
 }
+
+// writeGSC writes tokens as a packed token bitstream into a file, or to stdout if the path is empty.
+func writeGSC(cb *codec.Codebook, outputFile string, tokens []uint32, entropy bool) error {
+	if outputFile == "" || outputFile == "-" {
+		return cb.WriteGSC(os.Stdout, tokens, entropy)
+	}
+	f, err := os.Create(outputFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return cb.WriteGSC(f, tokens, entropy)
+}
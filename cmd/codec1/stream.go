@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+
+	"github.com/neurlang/gospeak/codec"
+)
+
+// encodeStream encodes stdin and writes one JSON line of band indices per
+// frame as soon as the frame is analysed. In gsc format the bitstream is
+// written once the input ends.
+func encodeStream(centroidsFile, outputFile, raw string, rate uint32, gsc, entropy bool) error {
+	cb, err := codec.LoadCodebook(centroidsFile)
+	if err != nil {
+		return err
+	}
+
+	var in *codec.SampleReader
+	if rate != 0 {
+		in, err = codec.NewRawReader(os.Stdin, raw, rate)
+	} else {
+		in, err = codec.NewWavReader(os.Stdin)
+	}
+	if err != nil {
+		return err
+	}
+
+	var out io.Writer = os.Stdout
+	if outputFile != "" {
+		f, err := os.Create(outputFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	w := bufio.NewWriter(out)
+
+	stream, err := codec.NewEncoder(cb).Stream(in.SampleRate)
+	if err != nil {
+		return err
+	}
+	var all []uint32
+	emit := func(tokens []uint32) error {
+		if gsc {
+			all = append(all, tokens...)
+			return nil
+		}
+		for i := 0; i+cb.Bands() <= len(tokens); i += cb.Bands() {
+			line, _ := json.Marshal(tokens[i : i+cb.Bands()])
+			w.Write(line)
+			w.WriteByte('\n')
+		}
+		return w.Flush()
+	}
+
+	var samples = make([]float64, cb.Window)
+	for {
+		n, err := in.Read(samples)
+		if n > 0 {
+			tokens, err := stream.Write(samples[:n])
+			if err != nil {
+				return err
+			}
+			if err := emit(tokens); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	tokens, err := stream.Close()
+	if err != nil {
+		return err
+	}
+	if err := emit(tokens); err != nil {
+		return err
+	}
+	if gsc {
+		if err := cb.WriteGSC(w, all, entropy); err != nil {
+			return err
+		}
+		return w.Flush()
+	}
+	return nil
+}
+
+// decodeStream decodes the tokens, followed by token frames read from stdin
+// if fromStdin is set, writing the audio at the sample rate as soon as it is
+// final. Tokens having an enhancement layer are decoded at once.
+func decodeStream(cb *codec.Codebook, tokens []uint32, enhancement [][]uint32, fromStdin bool, outputFile, raw string, rate int) error {
+	resample, err := codec.NewResampler(cb.SampleRate, rate)
+	if err != nil {
+		return err
+	}
+
+	var out io.Writer = os.Stdout
+	if outputFile != "-" {
+		f, err := os.Create(outputFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	var w *codec.SampleWriter
+	if raw != "" {
+		w, err = codec.NewRawWriter(out, raw)
+	} else {
+		w, err = codec.NewWavWriter(out, rate)
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(enhancement) > 0 {
+		samples, err := codec.NewDecoder(cb).DecodeLayers(tokens, enhancement)
+		if err != nil {
+			return err
+		}
+		w.Write(resample.Write(samples))
+		w.Write(resample.Flush())
+		return w.Close()
+	}
+
+	stream := codec.NewDecoder(cb).Stream()
+	write := func(tokens []uint32) error {
+		samples, err := stream.Write(tokens)
+		if err != nil {
+			return err
+		}
+		w.Write(resample.Write(samples))
+		return w.Flush()
+	}
+	if err := write(tokens); err != nil {
+		return err
+	}
+
+	if fromStdin {
+		// token frames are JSON arrays, e.g. the lines of a streaming encode
+		dec := json.NewDecoder(bufio.NewReader(os.Stdin))
+		for {
+			var frame []uint32
+			if err := dec.Decode(&frame); err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+			if err := write(frame); err != nil {
+				return err
+			}
+		}
+	}
+
+	samples, err := stream.Close()
+	if err != nil {
+		return err
+	}
+	w.Write(resample.Write(samples))
+	w.Write(resample.Flush())
+	return w.Close()
+}
@@ -5,6 +5,7 @@ import (
 	"flag"
 	"fmt"
 	"github.com/neurlang/classifier/hash"
+	"github.com/neurlang/gospeak/codec"
 	"io/ioutil"
 	"log"
 )
@@ -13,6 +14,7 @@ func main() {
 	// Parse command line flags
 	inputFile := flag.String("i", "", "Path to input.json")
 	sttFile := flag.String("s", "", "Path to stt.json")
+	centroidsFile := flag.String("v", "", "Path to centroids file (default 8 bands per token frame)")
 	flag.Parse()
 
 	if *inputFile == "" || *sttFile == "" {
@@ -31,8 +33,18 @@ func main() {
 		log.Fatal("hash not present")
 	}
 
+	// Token frame size follows the codebook band count
+	var bands = 8
+	if *centroidsFile != "" {
+		layout, err := codec.LoadLayout(*centroidsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		bands = layout.Bands()
+	}
+
 	// Parse input file and process
-	if err := processInput(*inputFile, reversedSTT, hash); err != nil {
+	if err := processInput(*inputFile, reversedSTT, hash, bands); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -67,7 +79,7 @@ func parseSTT(path string) (map[string][]uint32, map[uint32]map[string]struct{},
 	return sttMap, reversed, hash[0], nil
 }
 
-func processInput(path string, reversedSTT map[uint32]map[string]struct{}, hash uint32) error {
+func processInput(path string, reversedSTT map[uint32]map[string]struct{}, hash uint32, bands int) error {
 	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return fmt.Errorf("error reading input file: %v", err)
@@ -76,14 +88,14 @@ func processInput(path string, reversedSTT map[uint32]map[string]struct{}, hash
 	// Try to parse as single input first
 	var single []uint32
 	if err := json.Unmarshal(data, &single); err == nil {
-		return processSingle("", single, reversedSTT, hash)
+		return processSingle("", single, reversedSTT, hash, bands)
 	}
 
 	// Try to parse as multiple inputs
 	var multiple map[string][]uint32
 	if err := json.Unmarshal(data, &multiple); err == nil {
 		for f, nums := range multiple {
-			if err := processSingle(f+":", nums, reversedSTT, hash); err != nil {
+			if err := processSingle(f+":", nums, reversedSTT, hash, bands); err != nil {
 				return err
 			}
 		}
@@ -93,13 +105,13 @@ func processInput(path string, reversedSTT map[uint32]map[string]struct{}, hash
 	return fmt.Errorf("input JSON format not recognized")
 }
 
-func processSingle(file string, nums []uint32, reversedSTT map[uint32]map[string]struct{}, hsh uint32) error {
-	if len(nums)%8 != 0 {
-		return fmt.Errorf("input length %d is not a multiple of 8", len(nums))
+func processSingle(file string, nums []uint32, reversedSTT map[uint32]map[string]struct{}, hsh uint32, bands int) error {
+	if len(nums)%bands != 0 {
+		return fmt.Errorf("input length %d is not a multiple of %d", len(nums), bands)
 	}
 	fmt.Print(file)
-	for i := 0; i < len(nums); i += 8 {
-		group := nums[i : i+8]
+	for i := 0; i < len(nums); i += bands {
+		group := nums[i : i+bands]
 		var h = hsh
 		for _, n := range group {
 			h = hash.Hash(h, n, (1<<32)-1)
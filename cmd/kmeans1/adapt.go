@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/neurlang/clusters"
+	"github.com/neurlang/gospeak/codec"
+)
+
+// adaptMinFrames is the least number of novel frames per appended codeword,
+// fewer novel frames are not a region of their own.
+const adaptMinFrames = 8
+
+// adaptGain is the least improvement in dB of the distance of the exemplar
+// to the refined center for which an exemplar is replaced.
+const adaptGain = 1
+
+// adaptPath is the path of the adaptation report of --adapt.
+func adaptPath(dstDir string) string {
+	return filepath.Join(dstDir, "adapt.json")
+}
+
+// adaptedCodeword is a codeword replaced or appended by --adapt.
+type adaptedCodeword struct {
+	ID int
+	// Frames is the number of corpus frames of the codeword
+	Frames int
+	// Shift is the distance in dB of the new exemplar from the old one,
+	// relative to the energy of the old one, for replaced exemplars
+	Shift float64 `json:",omitempty"`
+}
+
+// bandAdaptation is the adaptation of the codewords of a band.
+type bandAdaptation struct {
+	Band int
+	// Codewords is the number of codewords of the band before adaptation
+	Codewords int
+	Frames    int
+	// Novel is the number of frames farther from their nearest codeword
+	// than the novelty threshold
+	Novel    int
+	Replaced []adaptedCodeword
+	Appended []adaptedCodeword
+	// Unused are the codewords no corpus frame falls in, kept unchanged
+	Unused []int
+}
+
+// adaptReport is the content of adapt.json.
+type adaptReport struct {
+	// Codebook is the adapted codebook
+	Codebook string
+	Novelty  float64
+	Bands    []bandAdaptation
+}
+
+// adapter adapts the bands of an existing codebook to a corpus, keeping the
+// meaning of its codeword IDs.
+type adapter struct {
+	base      *codec.Codebook
+	novelty   float64 // dB above the median distance of the band at which a frame is novel
+	codewords int     // maximum number of codewords appended per band
+	report    *adaptReport
+}
+
+// newAdapter loads the codebook to adapt and the report of an interrupted run of
+// the same codebook, keeping its bands below rang.
+func newAdapter(path, dstDir string, novelty float64, codewords, rang int) (*adapter, error) {
+	base, err := codec.LoadCodebook(path)
+	if err != nil {
+		return nil, err
+	}
+	a := &adapter{base: base, novelty: novelty, codewords: codewords}
+	var report adaptReport
+	if data, err := os.ReadFile(adaptPath(dstDir)); err == nil && json.Unmarshal(data, &report) == nil &&
+		report.Codebook == path && report.Novelty == novelty {
+		var bands []bandAdaptation
+		for _, band := range report.Bands {
+			if band.Band < rang {
+				bands = append(bands, band)
+			}
+		}
+		report.Bands = bands
+		a.report = &report
+	} else {
+		a.report = &adaptReport{Codebook: path, Novelty: novelty}
+	}
+	return a, nil
+}
+
+// adapts reports whether the band is one of the adapted codebook.
+func (a *adapter) adapts(rang int) bool {
+	return a != nil && rang < len(a.base.Centroids)
+}
+
+// keys returns the key of every codeword of a band of the adapted codebook.
+func (a *adapter) keys(rang int) []clusters.Coordinates {
+	var keys = make([]clusters.Coordinates, len(a.base.Centroids[rang]))
+	for codeword, centroid := range a.base.Centroids[rang] {
+		var frame = make([][3]float64, len(centroid)/3)
+		for i := range frame {
+			frame[i] = [3]float64{centroid[3*i], centroid[3*i+1], centroid[3*i+2]}
+		}
+		keys[codeword] = codec.BandKey(frame)
+	}
+	return keys
+}
+
+// codeword returns a codeword of a band of the adapted codebook as phase triples.
+func (a *adapter) codeword(rang, codeword int) []LPFloat {
+	var coords = make([]LPFloat, len(a.base.Centroids[rang][codeword]))
+	for i, v := range a.base.Centroids[rang][codeword] {
+		coords[i] = LPFloat{Value: v, Digits: 3}
+	}
+	return coords
+}
+
+// alternatives returns the alternative exemplars of a codeword of the adapted codebook.
+func (a *adapter) alternatives(rang, codeword int) [][]LPFloat {
+	var alternatives = [][]LPFloat{}
+	if rang >= len(a.base.Exemplars) || codeword >= len(a.base.Exemplars[rang]) {
+		return alternatives
+	}
+	for _, alternative := range a.base.Exemplars[rang][codeword] {
+		var coords = make([]LPFloat, len(alternative))
+		for i, v := range alternative {
+			coords[i] = LPFloat{Value: v, Digits: 3}
+		}
+		alternatives = append(alternatives, coords)
+	}
+	return alternatives
+}
+
+// threshold returns the squared distance beyond which a frame is novel, novelty
+// dB above the median squared distance of the frames to their nearest codeword.
+func (a *adapter) threshold(measured *distortions, held []bool) float64 {
+	median := measured.summary(held, false).P50
+	return median * math.Pow(10, a.novelty/10)
+}
+
+// append returns the number of codewords appended for the novel frames.
+func (a *adapter) append(novel int) int {
+	k := novel / adaptMinFrames
+	if k > a.codewords {
+		k = a.codewords
+	}
+	return k
+}
+
+// refine chooses the exemplar of every codeword of the band, given the
+// exemplars nearest to the targets: the mean of the frames of the old
+// codewords and the cluster center of the appended codewords. The old
+// codewords keep theirs unless a frame of the cluster is nearer to the mean
+// by adaptGain dB, the appended codewords take the frame nearest to their
+// cluster center. It returns the adaptation of the band.
+func (a *adapter) refine(rang int, targets []clusters.Coordinates, counts []int, nearest *exemplars,
+	coords [][]LPFloat, alternatives [][][]LPFloat) bandAdaptation {
+
+	var old = a.keys(rang)
+	var band = bandAdaptation{Band: rang, Codewords: len(old)}
+	for codeword := range targets {
+		band.Frames += counts[codeword]
+		if codeword >= len(old) {
+			band.Appended = append(band.Appended, adaptedCodeword{ID: codeword, Frames: counts[codeword]})
+			coords[codeword] = []LPFloat{}
+			if best := nearest.best[codeword]; len(best) > 0 {
+				coords[codeword] = best[0].coords
+			}
+			alternatives[codeword] = [][]LPFloat{}
+			continue
+		}
+		coords[codeword] = a.codeword(rang, codeword)
+		alternatives[codeword] = a.alternatives(rang, codeword)
+		if counts[codeword] == 0 {
+			band.Unused = append(band.Unused, codeword)
+			continue
+		}
+		best := nearest.best[codeword]
+		if len(best) == 0 {
+			continue
+		}
+		// the exemplars are compared as stored, an old exemplar found again in the corpus is kept
+		key := storedKey(best[0].coords)
+		before := codec.PartialDistance(old[codeword], targets[codeword], math.MaxFloat64)
+		after := codec.PartialDistance(key, targets[codeword], math.MaxFloat64)
+		if after*math.Pow(10, adaptGain/10.0) >= before {
+			continue
+		}
+		coords[codeword] = best[0].coords
+		alternatives[codeword] = [][]LPFloat{}
+		replaced := adaptedCodeword{ID: codeword, Frames: counts[codeword]}
+		shift := codec.PartialDistance(key, old[codeword], math.MaxFloat64)
+		if energy := codec.Norm(old[codeword]); shift > 0 && energy > 0 {
+			replaced.Shift = 10 * math.Log10(shift/(energy*energy))
+		}
+		band.Replaced = append(band.Replaced, replaced)
+	}
+	return band
+}
+
+// storedKey returns the key of phase triples rounded to the digits they are stored with.
+func storedKey(coords []LPFloat) []float64 {
+	var frame = make([][3]float64, len(coords)/3)
+	for i := range frame {
+		frame[i] = [3]float64{coords[3*i].stored(), coords[3*i+1].stored(), coords[3*i+2].stored()}
+	}
+	return codec.BandKey(frame)
+}
+
+// record prints the adaptation of a band and writes the report.
+func (a *adapter) record(band bandAdaptation, dstDir string) error {
+	list := func(codewords []adaptedCodeword) string {
+		var ids []string
+		for _, c := range codewords {
+			ids = append(ids, strconv.Itoa(c.ID))
+		}
+		return strings.Join(ids, ", ")
+	}
+	fmt.Println("Novel frames:", band.Novel, "of", band.Frames)
+	fmt.Println("Replaced exemplars:", len(band.Replaced), list(band.Replaced))
+	fmt.Println("Appended codewords:", len(band.Appended), list(band.Appended))
+	a.report.Bands = append(a.report.Bands, band)
+
+	return writeJSONFile(adaptPath(dstDir), a.report)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+
+	"github.com/neurlang/gospeak/codec"
+)
+
+// parseBandBits parses the comma separated token bit widths of --band-bits,
+// one per band.
+func parseBandBits(spec string, bands int) ([]int, error) {
+	var widths []int
+	for _, field := range strings.Split(spec, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || n < 1 || n > codec.MaxBandBits {
+			return nil, fmt.Errorf("invalid band bits %q, expected 1 ~ %d", field, codec.MaxBandBits)
+		}
+		widths = append(widths, n)
+	}
+	if len(widths) != bands {
+		return nil, fmt.Errorf("%d band bits given for %d bands", len(widths), bands)
+	}
+	return widths, nil
+}
+
+// allocateBits splits the bits of a frame at the bitrate among the bands,
+// every band a bit narrower than the band below it, so that the low bands
+// carrying the formants get the most codewords. The bits left over widen the
+// lowest bands.
+func allocateBits(bitrate, frameRate float64, bands int) ([]int, error) {
+	var budget = int(bitrate / frameRate)
+	if budget < bands {
+		return nil, fmt.Errorf("bitrate %g gives %d bits per frame, fewer than the %d bands", bitrate, budget, bands)
+	}
+	var sum = func(top int) (total int) {
+		for rang := 0; rang < bands; rang++ {
+			if top-rang > 1 {
+				total += top - rang
+			} else {
+				total++
+			}
+		}
+		return
+	}
+	var top = 1
+	for sum(top+1) <= budget {
+		top++
+	}
+	var widths = make([]int, bands)
+	var left = budget - sum(top)
+	for rang := range widths {
+		widths[rang] = 1
+		if top-rang > 1 {
+			widths[rang] = top - rang
+		}
+		if left > 0 {
+			widths[rang]++
+			left--
+		}
+		if widths[rang] > codec.MaxBandBits {
+			return nil, fmt.Errorf("bitrate %g needs %d bits in band %d, more than %d", bitrate, widths[rang], rang, codec.MaxBandBits)
+		}
+	}
+	return widths, nil
+}
+
+// bandSize returns the number of codewords of a band of the given token bit
+// width, leaving a token value free like the default sizes do.
+func bandSize(width int) int {
+	return 1<<width - 1
+}
+
+// bitrate returns the bits per second of the packed tokens of the bands of
+// a codebook.
+func bitrate(layout *codec.Layout, centroids [][][]LPFloat) float64 {
+	var frameBits int
+	for rang, band := range centroids {
+		var width int
+		if len(band) > 1 {
+			width = bits.Len(uint(len(band) - 1))
+		}
+		if rang < len(layout.BandBits) && layout.BandBits[rang] > width {
+			width = layout.BandBits[rang]
+		}
+		frameBits += width
+	}
+	return float64(frameBits) * layout.FrameRate()
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/neurlang/gomel/phase"
+	"github.com/neurlang/gospeak/codec"
+	"github.com/x448/float16"
+)
+
+// Feature cache file layout, all integers are little-endian:
+//
+//	magic      [4]byte  "GSPF"
+//	version    uint32
+//	sampleRate uint32
+//	numFreqs   uint32
+//	window     uint32
+//	resolut    uint32
+//	size       int64    size of the audio file
+//	mtime      int64    modification time of the audio file in nanoseconds
+//	frames     uint32
+//	payload    frames*numFreqs phase triples as float16
+//
+// A cache file is valid while the audio file keeps its size and modification
+// time and the spectrogram parameters do not change.
+const (
+	cacheMagic   = "GSPF"
+	cacheVersion = 1
+)
+
+// featureCache computes the phase spectrograms of the corpus files once and
+// keeps them on disk for the following passes.
+type featureCache struct {
+	dir    string // cache directory, empty disables the cache
+	layout *codec.Layout
+	m      *phase.Phase
+}
+
+func newFeatureCache(dir string, layout *codec.Layout) (*featureCache, error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &featureCache{dir: dir, layout: layout, m: layout.Phase()}, nil
+}
+
+// frames returns the phase spectrogram of an audio file at the codec native
+// sample rate, or nil if the file can't be loaded. Cached spectrograms are
+// rounded to float16, also when they are computed, so a run gives the same
+// result from a cold and a warm cache.
+func (c *featureCache) frames(fileName string) [][3]float64 {
+	if c.dir == "" {
+		audioSamples := loadSamples(fileName, c.layout)
+		if audioSamples == nil {
+			return nil
+		}
+		melFrames, err := c.m.ToPhase(audioSamples)
+		if err != nil {
+			panic(err)
+		}
+		return melFrames
+	}
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return nil
+	}
+	path := c.path(fileName)
+	if melFrames := c.read(path, info); melFrames != nil {
+		return melFrames
+	}
+
+	audioSamples := loadSamples(fileName, c.layout)
+	if audioSamples == nil {
+		return nil
+	}
+	melFrames, err := c.m.ToPhase(audioSamples)
+	if err != nil {
+		panic(err)
+	}
+	for i := range melFrames {
+		for l := range melFrames[i] {
+			melFrames[i][l] = float64(float16.Fromfloat32(float32(melFrames[i][l])).Float32())
+		}
+	}
+	if err := c.write(path, info, melFrames); err != nil {
+		println("Feature cache:", err.Error())
+	}
+	return melFrames
+}
+
+// path names the cache file of an audio file after the hash of its absolute path.
+func (c *featureCache) path(fileName string) string {
+	if abs, err := filepath.Abs(fileName); err == nil {
+		fileName = abs
+	}
+	sum := sha256.Sum256([]byte(fileName))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:16])+".gspf")
+}
+
+func (c *featureCache) header(info os.FileInfo, frames int) []byte {
+	var header = make([]byte, 4, 48)
+	copy(header, cacheMagic)
+	for _, v := range []uint32{cacheVersion, uint32(c.layout.SampleRate), uint32(c.layout.NumFreqs),
+		uint32(c.layout.Window), uint32(c.layout.Resolut)} {
+		header = binary.LittleEndian.AppendUint32(header, v)
+	}
+	header = binary.LittleEndian.AppendUint64(header, uint64(info.Size()))
+	header = binary.LittleEndian.AppendUint64(header, uint64(info.ModTime().UnixNano()))
+	return binary.LittleEndian.AppendUint32(header, uint32(frames))
+}
+
+// read loads a valid cache file, or returns nil.
+func (c *featureCache) read(path string, info os.FileInfo) [][3]float64 {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var header = make([]byte, 48)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil
+	}
+	frames := int(binary.LittleEndian.Uint32(header[44:]))
+	if string(header) != string(c.header(info, frames)) {
+		return nil
+	}
+	var payload = make([]byte, 2*3*frames*c.layout.NumFreqs)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil
+	}
+	var melFrames = make([][3]float64, frames*c.layout.NumFreqs)
+	for i := range melFrames {
+		for l := range melFrames[i] {
+			bits := binary.LittleEndian.Uint16(payload[2*(3*i+l):])
+			melFrames[i][l] = float64(float16.Frombits(bits).Float32())
+		}
+	}
+	return melFrames
+}
+
+// write stores a cache file, replacing it only once it is complete.
+func (c *featureCache) write(path string, info os.FileInfo, melFrames [][3]float64) error {
+	var data = c.header(info, len(melFrames)/c.layout.NumFreqs)
+	for i := range melFrames {
+		for l := range melFrames[i] {
+			data = binary.LittleEndian.AppendUint16(data, float16.Fromfloat32(float32(melFrames[i][l])).Bits())
+		}
+	}
+	return replaceFile(path, data)
+}
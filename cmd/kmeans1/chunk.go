@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/neurlang/classifier/parallel"
+	"github.com/neurlang/clusters"
+	"github.com/neurlang/gospeak/codec"
+	"github.com/neurlang/kmeans"
+)
+
+// chunkJob is the clustering of the frames of a band of a chunk of the corpus
+// files into centers for the master clustering. kmeans1 runs it itself, or
+// sends it to a worker of --workers, which gives the same centers.
+type chunkJob struct {
+	Layout codec.Layout
+	Band   int
+	Chunk  int
+	Seed   uint64
+	// SrcDir is the corpus directory, Paths are the files of the chunk relative to it
+	SrcDir string
+	Paths  []string
+	// Files are the indexes of the files of the chunk among the FileCount corpus files
+	Files     []int
+	FileCount int
+	// Speakers are the speakers of the corpus files, of SpeakerCount speakers
+	Speakers     []int
+	SpeakerCount int
+	// Limit is the number of frames kept by --max-mem, 0 keeps all
+	Limit int
+	// K is the number of centers, Kmeanz the number of frames a chunk is
+	// repeated up to when it has fewer
+	K      int
+	Kmeanz int
+	Algo   string
+
+	SilenceThreshold float64
+	TrimSilence      bool
+	// Cache is set when the spectrograms are cached, so rounded to float16
+	Cache bool
+}
+
+// chunkResult is the outcome of a chunkJob.
+type chunkResult struct {
+	Centers    [][]float64
+	Distortion float64
+	// Silence is the sample of the discarded silence, with a silence threshold
+	Silence [][]float64
+	// Offered is the number of speech frames loaded, Clustered of them clustered
+	Offered   int
+	Clustered int
+	// Discarded is the number of silent frames of the Total frames
+	Discarded uint64
+	Total     uint64
+}
+
+// path returns the path of a file of the chunk in the corpus directory.
+func (job *chunkJob) path(srcDir string, n int) string {
+	return filepath.Join(srcDir, filepath.FromSlash(job.Paths[n]))
+}
+
+// load loads the frames of the band of the chunk files from the corpus
+// directory, the speech frames balanced among the speakers and a sample of
+// the silence. loaded is called after every file.
+func (job *chunkJob) load(features *featureCache, srcDir string, threads int, loaded func()) (clusters.Observations, *chunkResult) {
+	var ranges = job.Layout.Ranges
+	var numFreqs = job.Layout.NumFreqs
+	var spk = &speakers{names: make([]string, job.SpeakerCount), of: job.Speakers}
+	var stageSeed = mix(job.Seed ^ uint64(job.Band)<<32 ^ uint64(job.Chunk))
+	var files_dataset = spk.sample(job.FileCount, job.Limit, stageSeed)
+	var files_silence = newReservoir(job.FileCount, silenceSample, ^stageSeed)
+	var dataset_discarded atomic.Uint64
+	var dataset_total atomic.Uint64
+
+	parallel.ForEach(len(job.Files), threads, func(n int) {
+		var i = job.Files[n]
+		var melFrames = features.frames(job.path(srcDir, n))
+
+		var discarded uint64
+		var speech, quiet clusters.Observations
+		var silent = silentFrames(melFrames, numFreqs, job.SilenceThreshold, job.TrimSilence)
+		for j := 0; j < len(melFrames); j += numFreqs {
+			var coords = clusters.Coordinates(verifyFloats(codec.BandKey(melFrames[j+ranges[job.Band] : j+ranges[job.Band+1]])))
+			if silent != nil && silent[j/numFreqs] {
+				quiet = append(quiet, coords)
+				discarded++
+				continue
+			}
+			speech = append(speech, coords)
+		}
+		spk.offer(files_dataset, i, speech)
+		files_silence.offer(i, quiet)
+		dataset_discarded.Add(discarded)
+		dataset_total.Add(uint64(len(melFrames)) / uint64(numFreqs))
+		loaded()
+	})
+	// every speaker contributes the same number of frames
+	var dataset, offered = spk.balance(files_dataset, stageSeed)
+	var result = &chunkResult{
+		Offered:   offered,
+		Clustered: len(dataset),
+		Discarded: dataset_discarded.Load(),
+		Total:     dataset_total.Load(),
+	}
+	if job.SilenceThreshold > 0 {
+		for _, observation := range files_silence.observations() {
+			result.Silence = append(result.Silence, observation.Coordinates())
+		}
+	}
+	return dataset, result
+}
+
+// cluster clusters the loaded frames into the centers of the result.
+func (job *chunkJob) cluster(dataset clusters.Observations, result *chunkResult, threads int, plotter kmeans.Plotter) error {
+	var rng = stageRand(job.Seed, job.Band, job.Chunk)
+
+	// a chunk of fewer frames than its share of the codebook yields a center per frame
+	var k = job.K
+	if k > job.Kmeanz && len(dataset) < k {
+		k = job.Kmeanz
+		if len(dataset) > k {
+			k = len(dataset)
+		}
+	}
+	if len(dataset) < job.Kmeanz {
+		ShuffleSlice(rng, dataset)
+		for i := 0; len(dataset) < job.Kmeanz; i++ {
+			dataset = append(dataset, dataset[i])
+		}
+	}
+
+	ShuffleSlice(rng, dataset)
+
+	km := newLloyd(job.Algo, 0.05, plotter, threads, rng)
+	clu, err := km.Partition(dataset, k)
+	if err != nil {
+		return err
+	}
+	for _, c := range clu {
+		result.Centers = append(result.Centers, c.Center)
+	}
+	result.Distortion = km.Distortion
+	return nil
+}
+
+// run loads and clusters the chunk, the files in the corpus directory srcDir
+// (default the SrcDir of the job) and the spectrograms cached in cacheDir.
+func (job *chunkJob) run(srcDir, cacheDir string, threads int) (*chunkResult, error) {
+	if srcDir == "" {
+		srcDir = job.SrcDir
+	}
+	if !job.Cache {
+		cacheDir = ""
+	} else if cacheDir == "" {
+		return nil, fmt.Errorf("the spectrograms are cached by the coordinator, the worker needs a cachedir")
+	}
+	for n := range job.Paths {
+		if _, err := os.Stat(job.path(srcDir, n)); err != nil {
+			return nil, err
+		}
+	}
+	features, err := newFeatureCache(cacheDir, &job.Layout)
+	if err != nil {
+		return nil, err
+	}
+	dataset, result := job.load(features, srcDir, threads, func() {})
+	if len(dataset) == 0 {
+		return result, nil
+	}
+	return result, job.cluster(dataset, result, threads, nil)
+}
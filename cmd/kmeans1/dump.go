@@ -0,0 +1,327 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/neurlang/clusters"
+	"github.com/neurlang/gospeak/codec"
+)
+
+// Exemplar strategies of --exemplar.
+const (
+	// exemplarNearest keeps the corpus frame nearest to the cluster center
+	exemplarNearest = "nearest"
+	// exemplarMedoid keeps the frame of the cluster with the least summed
+	// squared distance to the other frames of the cluster
+	exemplarMedoid = "medoid"
+	// exemplarMean keeps the medoid scaled to the mean magnitude of the cluster
+	exemplarMean = "mean"
+	// exemplarMulti keeps the N frames nearest to the cluster center
+	exemplarMulti = "multi:"
+)
+
+// parseExemplar parses an exemplar strategy, returning the number of
+// exemplars kept per codeword.
+func parseExemplar(spec string) (strategy string, count int, err error) {
+	switch {
+	case spec == exemplarNearest || spec == exemplarMedoid || spec == exemplarMean:
+		return spec, 1, nil
+	case strings.HasPrefix(spec, exemplarMulti):
+		count, err := strconv.Atoi(strings.TrimPrefix(spec, exemplarMulti))
+		if err != nil || count < 1 {
+			return "", 0, fmt.Errorf("invalid exemplar count in %q", spec)
+		}
+		return exemplarMulti, count, nil
+	}
+	return "", 0, fmt.Errorf("unknown exemplar strategy %q", spec)
+}
+
+// exemplar is a corpus frame kept for a codeword.
+type exemplar struct {
+	dist        float64
+	file, frame int
+	coords      []LPFloat
+}
+
+// before orders exemplars by distance, equally near frames by their position in the corpus.
+func (x *exemplar) before(y *exemplar) bool {
+	if x.dist != y.dist {
+		return x.dist < y.dist
+	}
+	if x.file != y.file {
+		return x.file < y.file
+	}
+	return x.frame < y.frame
+}
+
+// exemplars tracks, for every cluster, the corpus frames nearest to a target,
+// the cluster center or the mean of its frames.
+type exemplars struct {
+	mut     sync.Mutex
+	centers []clusters.Coordinates // the targets
+	norms   []float64
+	count   int          // exemplars kept per cluster
+	index   *codec.Index // restricts the frames to the members of the cluster, nil for any frame
+	best    [][]exemplar // the exemplars of every cluster, nearest first
+}
+
+func newExemplars(centers []clusters.Coordinates, count int, index *codec.Index) *exemplars {
+	e := &exemplars{
+		centers: centers,
+		norms:   make([]float64, len(centers)),
+		count:   count,
+		index:   index,
+		best:    make([][]exemplar, len(centers)),
+	}
+	for codeword := range centers {
+		e.norms[codeword] = codec.Norm(centers[codeword])
+	}
+	return e
+}
+
+// bound returns the distance a frame must not exceed to become an exemplar of the codeword.
+func bound(best []exemplar, count int) float64 {
+	if len(best) < count {
+		return math.MaxFloat64
+	}
+	return best[count-1].dist
+}
+
+// insert adds an exemplar to the nearest ones if it is near enough.
+func insert(best []exemplar, x exemplar, count int) []exemplar {
+	i := sort.Search(len(best), func(i int) bool { return x.before(&best[i]) })
+	if i >= count {
+		return best
+	}
+	if len(best) < count {
+		best = append(best, exemplar{})
+	}
+	copy(best[i+1:], best[i:])
+	best[i] = x
+	return best
+}
+
+// update offers the frames of the file with the given index, given as keys
+// and their phase triples.
+//
+// Instead of measuring every frame against every target, a target is skipped
+// when the norm difference already rules out beating its exemplars, and
+// distances are computed with early exit. The exemplars of the file are
+// merged under the lock once per file. Equally near frames resolve to the
+// first frame of the first file, whatever the order the files come in.
+func (e *exemplars) update(file int, keys [][]float64, coords [][]LPFloat) {
+	e.mut.Lock()
+	var bounds = make([]float64, len(e.best))
+	for codeword := range bounds {
+		bounds[codeword] = bound(e.best[codeword], e.count)
+	}
+	e.mut.Unlock()
+
+	var best = make([][]exemplar, len(e.centers))
+	offer := func(codeword, j int, key []float64, norm float64) {
+		if codec.LowerBound(e.norms[codeword], norm) > bounds[codeword] {
+			return
+		}
+		dist := codec.PartialDistance(key, e.centers[codeword], bounds[codeword])
+		if dist > bounds[codeword] {
+			return
+		}
+		best[codeword] = insert(best[codeword], exemplar{dist: dist, file: file, frame: j}, e.count)
+		if b := bound(best[codeword], e.count); b < bounds[codeword] {
+			bounds[codeword] = b
+		}
+	}
+	for j, key := range keys {
+		norm := codec.Norm(key)
+		if e.index != nil {
+			codeword, _ := e.index.Nearest(key)
+			offer(codeword, j, key, norm)
+			continue
+		}
+		for codeword := range e.centers {
+			offer(codeword, j, key, norm)
+		}
+	}
+
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	for codeword := range best {
+		for _, x := range best[codeword] {
+			x.coords = coords[x.frame]
+			e.best[codeword] = insert(e.best[codeword], x, e.count)
+		}
+	}
+}
+
+// clusterStats accumulates the corpus frames nearest to every codeword. The
+// sums of the files are merged in file order, so that they do not depend on
+// the order the files come in.
+type clusterStats struct {
+	mut     sync.Mutex
+	index   *codec.Index
+	counts  []int
+	sums    [][]float64 // key sums, nil unless the means are needed
+	mags    [][]float64 // sums of the magnitude of every frequency, nil unless the means are needed
+	next    int
+	pending map[int]*clusterStats
+}
+
+func newClusterStats(centers []clusters.Coordinates, means bool) *clusterStats {
+	var keys = make([][]float64, len(centers))
+	for codeword := range centers {
+		keys[codeword] = centers[codeword]
+	}
+	s := &clusterStats{index: codec.NewIndex(keys), pending: map[int]*clusterStats{}}
+	s.init(len(centers), len(centers[0]), means)
+	return s
+}
+
+func (s *clusterStats) init(codewords, dims int, means bool) {
+	s.counts = make([]int, codewords)
+	if means {
+		s.sums = make([][]float64, codewords)
+		s.mags = make([][]float64, codewords)
+		for codeword := range s.sums {
+			s.sums[codeword] = make([]float64, dims)
+			s.mags[codeword] = make([]float64, dims/2)
+		}
+	}
+}
+
+// update offers the frames of the file with the given index, every file must be offered once.
+func (s *clusterStats) update(file int, keys [][]float64) {
+	var f = &clusterStats{}
+	f.init(len(s.counts), 0, false)
+	if s.sums != nil {
+		f.sums = make([][]float64, len(s.counts))
+		f.mags = make([][]float64, len(s.counts))
+	}
+	for _, key := range keys {
+		codeword, _ := s.index.Nearest(key)
+		f.counts[codeword]++
+		if f.sums == nil {
+			continue
+		}
+		if f.sums[codeword] == nil {
+			f.sums[codeword] = make([]float64, len(key))
+			f.mags[codeword] = make([]float64, len(key)/2)
+		}
+		for d, v := range key {
+			f.sums[codeword][d] += v
+		}
+		for i := range f.mags[codeword] {
+			f.mags[codeword][i] += math.Hypot(key[2*i], key[2*i+1])
+		}
+	}
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.pending[file] = f
+	for f, ok := s.pending[s.next]; ok; f, ok = s.pending[s.next] {
+		delete(s.pending, s.next)
+		s.next++
+		for codeword, n := range f.counts {
+			s.counts[codeword] += n
+			if f.sums == nil || f.sums[codeword] == nil {
+				continue
+			}
+			for d, v := range f.sums[codeword] {
+				s.sums[codeword][d] += v
+			}
+			for i, v := range f.mags[codeword] {
+				s.mags[codeword][i] += v
+			}
+		}
+	}
+}
+
+// means returns the mean key of every codeword, the center for empty codewords.
+func (s *clusterStats) means(centers []clusters.Coordinates) []clusters.Coordinates {
+	var means = make([]clusters.Coordinates, len(centers))
+	for codeword := range means {
+		if s.counts[codeword] == 0 {
+			means[codeword] = centers[codeword]
+			continue
+		}
+		means[codeword] = make(clusters.Coordinates, len(s.sums[codeword]))
+		for d, v := range s.sums[codeword] {
+			means[codeword][d] = v / float64(s.counts[codeword])
+		}
+	}
+	return means
+}
+
+// rescale scales the phase triples of an exemplar of a codeword to the mean
+// magnitude of every frequency of the frames of the codeword, keeping the phase.
+func (s *clusterStats) rescale(codeword int, coords []LPFloat) []LPFloat {
+	if s.counts[codeword] == 0 {
+		return coords
+	}
+	var scaled = make([]LPFloat, len(coords))
+	for i := 0; 3*i+2 < len(coords); i++ {
+		key := codec.BandKey([][3]float64{{coords[3*i].Value, coords[3*i+1].Value, coords[3*i+2].Value}})
+		var shift float64
+		if mag := math.Hypot(key[0], key[1]); mag > 0 {
+			shift = math.Log2(s.mags[codeword][i] / float64(s.counts[codeword]) / mag)
+		}
+		for l := 0; l < 3; l++ {
+			scaled[3*i+l] = LPFloat{Value: coords[3*i+l].Value + shift, Digits: coords[3*i+l].Digits}
+		}
+	}
+	return scaled
+}
+
+// reportFar prints the codewords having no frames, and those whose exemplar
+// is far from the cluster center: more than threshold dB above the median
+// distance of the exemplars of the band, distances being measured in dB
+// relative to the energy of the centers.
+func reportFar(centers []clusters.Coordinates, counts []int, exemplars [][]LPFloat, threshold float64) {
+	var empty []string
+	var dbs = make([]float64, len(centers))
+	var measured []float64
+	for codeword, center := range centers {
+		if counts[codeword] == 0 {
+			empty = append(empty, strconv.Itoa(codeword))
+		}
+		dbs[codeword] = math.Inf(-1)
+		if len(exemplars[codeword]) == 0 {
+			continue
+		}
+		var frame = make([][3]float64, len(exemplars[codeword])/3)
+		for i := range frame {
+			frame[i] = [3]float64{exemplars[codeword][3*i].Value, exemplars[codeword][3*i+1].Value, exemplars[codeword][3*i+2].Value}
+		}
+		dist := codec.PartialDistance(codec.BandKey(frame), center, math.MaxFloat64)
+		energy := codec.Norm(center)
+		if dist == 0 || energy == 0 {
+			// an exemplar at its center is not far
+			continue
+		}
+		dbs[codeword] = 10 * math.Log10(dist/(energy*energy))
+		measured = append(measured, dbs[codeword])
+	}
+	fmt.Println("Empty clusters:", len(empty), strings.Join(empty, ", "))
+	if len(measured) == 0 {
+		return
+	}
+	sort.Float64s(measured)
+	median := measured[len(measured)/2]
+
+	var far []int
+	for codeword, db := range dbs {
+		if db > median+threshold {
+			far = append(far, codeword)
+		}
+	}
+	sort.SliceStable(far, func(i, j int) bool { return dbs[far[i]] > dbs[far[j]] })
+	var list []string
+	for _, codeword := range far {
+		list = append(list, fmt.Sprintf("%d (%.1f dB)", codeword, dbs[codeword]))
+	}
+	fmt.Printf("Far exemplars, median %.1f dB: %d %s\n", median, len(far), strings.Join(list, ", "))
+}
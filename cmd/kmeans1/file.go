@@ -0,0 +1,25 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// writeJSONFile writes the value as indented JSON, replacing the file only
+// once it is complete.
+func writeJSONFile(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return err
+	}
+	return replaceFile(path, data)
+}
+
+// replaceFile writes the data to a temporary file renamed over the path, so
+// that readers never see a partial file.
+func replaceFile(path string, data []byte) error {
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
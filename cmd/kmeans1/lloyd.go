@@ -0,0 +1,403 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"sort"
+	"sync/atomic"
+
+	"github.com/neurlang/classifier/parallel"
+	"github.com/neurlang/clusters"
+	"github.com/neurlang/gospeak/codec"
+	"github.com/neurlang/kmeans"
+)
+
+// Clustering algorithms of --algo.
+const (
+	// algoLloyd is k-means starting from random centers
+	algoLloyd = "lloyd"
+	// algoKmeansPP is k-means starting from k-means++ seeding
+	algoKmeansPP = "kmeans++"
+	// algoMiniBatch is mini-batch k-means, updating the centers from random batches of points
+	algoMiniBatch = "minibatch"
+	// algoLBG is the Linde-Buzo-Gray algorithm, splitting the codewords until there are k of them
+	algoLBG = "lbg"
+)
+
+// algos lists the clustering algorithms of --algo.
+var algos = []string{algoLloyd, algoKmeansPP, algoMiniBatch, algoLBG}
+
+// lloyd is the k-means algorithm of github.com/neurlang/kmeans made
+// deterministic: all randomness comes from rng, and no result depends on the
+// scheduling of the threads, so a seed reproduces the clusters regardless of
+// the number of threads. The algo selects how the centers are initialised
+// and refined.
+type lloyd struct {
+	algo    string
+	threads int
+	plotter kmeans.Plotter
+	rng     *rand.Rand
+
+	// deltaThreshold stops the iterations once less than this fraction of
+	// the data points shifted clusters in the last iteration, or for
+	// mini-batch once the centers moved less than this fraction of the
+	// distance of the points to them
+	deltaThreshold float64
+	// iterationThreshold is the maximum number of iterations
+	iterationThreshold int
+
+	// Distortion is the mean squared distance of the points to their
+	// centers after the last Partition
+	Distortion float64
+}
+
+func newLloyd(algo string, deltaThreshold float64, plotter kmeans.Plotter, threads int, rng *rand.Rand) *lloyd {
+	return &lloyd{
+		algo:               algo,
+		threads:            threads,
+		plotter:            plotter,
+		rng:                rng,
+		deltaThreshold:     deltaThreshold,
+		iterationThreshold: 96,
+	}
+}
+
+// stageRand returns the random source of one stage of the run, stages being
+// independent of each other so that a resumed run reproduces them.
+func stageRand(seed uint64, rang, stage int) *rand.Rand {
+	return rand.New(rand.NewPCG(seed, uint64(rang)<<32|uint64(stage)))
+}
+
+// Partition partitions the dataset into k clusters.
+func (m *lloyd) Partition(dataset clusters.Observations, k int) (clusters.Clusters, error) {
+	if k > len(dataset) {
+		return nil, fmt.Errorf("the size of the data set must at least equal k")
+	}
+	if k == 0 || len(dataset[0].Coordinates()) == 0 {
+		return nil, fmt.Errorf("there must be at least one dimension and cluster")
+	}
+
+	var centers [][]float64
+	var points []int
+	var err error
+	switch m.algo {
+	case algoKmeansPP:
+		centers = m.kmeansPP(dataset, k)
+		points, err = m.iterate(dataset, centers)
+	case algoMiniBatch:
+		centers, err = m.miniBatch(dataset, k)
+		if err == nil {
+			points, _ = m.assign(dataset, centers)
+		}
+	case algoLBG:
+		centers, points, err = m.lbg(dataset, k)
+	case algoLloyd, "":
+		centers = m.uniform(len(dataset[0].Coordinates()), k)
+		points, err = m.iterate(dataset, centers)
+	default:
+		return nil, fmt.Errorf("unknown clustering algorithm %q", m.algo)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var cc = make(clusters.Clusters, k)
+	for ci := range cc {
+		cc[ci].Center = centers[ci]
+	}
+	for p, ci := range points {
+		cc[ci].Append(dataset[p])
+	}
+	m.Distortion = m.distortion(dataset, points, centers) / float64(len(dataset))
+	return cc, nil
+}
+
+// uniform places the centers uniformly in the unit cube like the library does.
+func (m *lloyd) uniform(dims, k int) [][]float64 {
+	var centers = make([][]float64, k)
+	for ci := range centers {
+		centers[ci] = make([]float64, dims)
+		for d := range centers[ci] {
+			centers[ci][d] = m.rng.Float64()
+		}
+	}
+	return centers
+}
+
+// kmeansPP picks the centers among the points, each with probability
+// proportional to its squared distance to the nearest center picked before.
+func (m *lloyd) kmeansPP(dataset clusters.Observations, k int) [][]float64 {
+	var norms = make([]float64, len(dataset))
+	var dists = make([]float64, len(dataset))
+	parallel.ForEach(len(dataset), m.threads, func(p int) {
+		norms[p] = codec.Norm(dataset[p].Coordinates())
+		dists[p] = math.MaxFloat64
+	})
+	var centers = make([][]float64, 0, k)
+	next := m.rng.IntN(len(dataset))
+	for len(centers) < k {
+		center := append([]float64(nil), dataset[next].Coordinates()...)
+		centers = append(centers, center)
+		norm := codec.Norm(center)
+		parallel.ForEach(len(dataset), m.threads, func(p int) {
+			if codec.LowerBound(norms[p], norm) > dists[p] {
+				return
+			}
+			if dist := codec.PartialDistance(dataset[p].Coordinates(), center, dists[p]); dist < dists[p] {
+				dists[p] = dist
+			}
+		})
+
+		var sum float64
+		for _, dist := range dists {
+			sum += dist
+		}
+		if sum == 0 {
+			// every point is a center already
+			next = m.rng.IntN(len(dataset))
+			continue
+		}
+		r := m.rng.Float64() * sum
+		for next = 0; next < len(dists)-1; next++ {
+			if r -= dists[next]; r < 0 && dists[next] > 0 {
+				break
+			}
+		}
+	}
+	return centers
+}
+
+// miniBatchSize returns the number of points of a batch of mini-batch k-means.
+func miniBatchSize(n, k int) int {
+	size := 4 * k
+	if size < 1024 {
+		size = 1024
+	}
+	if size > n {
+		size = n
+	}
+	return size
+}
+
+// miniBatch runs mini-batch k-means: every iteration assigns a random batch of
+// points to the centers, then moves each center towards its points with a
+// learning rate decreasing with the number of points it has seen. It stops
+// once no center moved by more than deltaThreshold of the root mean squared
+// distance of the batch to the centers.
+func (m *lloyd) miniBatch(dataset clusters.Observations, k int) ([][]float64, error) {
+	var centers = make([][]float64, k)
+	var previous = make([][]float64, k)
+	for ci, p := range m.rng.Perm(len(dataset))[:k] {
+		centers[ci] = append([]float64(nil), dataset[p].Coordinates()...)
+		previous[ci] = make([]float64, len(centers[ci]))
+	}
+	var seen = make([]int, k)
+	var points = make([]int, len(dataset))
+	for p := range points {
+		points[p] = -1
+	}
+	var batch = make([]int, miniBatchSize(len(dataset), k))
+	var nearest = make([]int, len(batch))
+	var dists = make([]float64, len(batch))
+	var cc = make(clusters.Clusters, k)
+	for i := 0; ; i++ {
+		for b := range batch {
+			batch[b] = m.rng.IntN(len(dataset))
+		}
+		index := codec.NewIndex(centers)
+		parallel.ForEach(len(batch), m.threads, func(b int) {
+			nearest[b], dists[b] = index.Nearest(dataset[batch[b]].Coordinates())
+		})
+		for ci := range centers {
+			copy(previous[ci], centers[ci])
+		}
+
+		// only the points assigned before can change their cluster
+		var changes int
+		var distortion float64
+		for b, p := range batch {
+			ci := nearest[b]
+			if points[p] != -1 && points[p] != ci {
+				changes++
+			}
+			points[p] = ci
+			distortion += dists[b]
+			seen[ci]++
+			eta := 1 / float64(seen[ci])
+			for d, x := range dataset[p].Coordinates() {
+				centers[ci][d] += eta * (x - centers[ci][d])
+			}
+		}
+		var shift float64
+		for ci := range centers {
+			shift = math.Max(shift, codec.PartialDistance(previous[ci], centers[ci], math.MaxFloat64))
+		}
+
+		if m.plotter != nil {
+			if err := m.plotter.Plot(cc, -changes); err != nil {
+				return nil, fmt.Errorf("failed to plot chart: %s", err)
+			}
+		}
+		if i == m.iterationThreshold ||
+			shift <= m.deltaThreshold*m.deltaThreshold*distortion/float64(len(batch)) {
+			break
+		}
+	}
+	return centers, nil
+}
+
+// lbg starts from the mean of the points and splits the codewords of the
+// largest distortion in two, refining them with k-means after every split,
+// until there are k codewords.
+func (m *lloyd) lbg(dataset clusters.Observations, k int) ([][]float64, []int, error) {
+	const epsilon = 0.01
+	var points = make([]int, len(dataset))
+	var centers = [][]float64{make([]float64, len(dataset[0].Coordinates()))}
+	m.recenter(dataset, points, []int{len(dataset)}, centers)
+	var cc = make(clusters.Clusters, k)
+
+	for len(centers) < k {
+		// distortion of every codeword
+		var dists = make([]float64, len(dataset))
+		parallel.ForEach(len(dataset), m.threads, func(p int) {
+			dists[p] = codec.PartialDistance(dataset[p].Coordinates(), centers[points[p]], math.MaxFloat64)
+		})
+		var distortion = make([]float64, len(centers))
+		for p, ci := range points {
+			distortion[ci] += dists[p]
+		}
+		var order = make([]int, len(centers))
+		for ci := range order {
+			order[ci] = ci
+		}
+		sort.SliceStable(order, func(i, j int) bool {
+			return distortion[order[i]] > distortion[order[j]]
+		})
+
+		splits := len(centers)
+		if splits > k-len(centers) {
+			splits = k - len(centers)
+		}
+		for _, ci := range order[:splits] {
+			var split = make([]float64, len(centers[ci]))
+			for d, x := range centers[ci] {
+				split[d] = x * (1 - epsilon)
+				centers[ci][d] = x * (1 + epsilon)
+			}
+			centers = append(centers, split)
+		}
+
+		var err error
+		if points, err = m.iterate(dataset, centers); err != nil {
+			return nil, nil, err
+		}
+		if m.plotter != nil {
+			if err := m.plotter.Plot(cc, -(k-len(centers))*len(dataset)/k); err != nil {
+				return nil, nil, fmt.Errorf("failed to plot chart: %s", err)
+			}
+		}
+	}
+	return centers, points, nil
+}
+
+// assign returns the nearest center of every point and the number of points of every center.
+func (m *lloyd) assign(dataset clusters.Observations, centers [][]float64) (points, counts []int) {
+	points = make([]int, len(dataset))
+	index := codec.NewIndex(centers)
+	parallel.ForEach(len(dataset), m.threads, func(p int) {
+		points[p], _ = index.Nearest(dataset[p].Coordinates())
+	})
+	counts = make([]int, len(centers))
+	for _, ci := range points {
+		counts[ci]++
+	}
+	return
+}
+
+// distortion returns the sum of the squared distances of the points to their centers.
+func (m *lloyd) distortion(dataset clusters.Observations, points []int, centers [][]float64) (sum float64) {
+	var dists = make([]float64, len(dataset))
+	parallel.ForEach(len(dataset), m.threads, func(p int) {
+		dists[p] = codec.PartialDistance(dataset[p].Coordinates(), centers[points[p]], math.MaxFloat64)
+	})
+	for _, dist := range dists {
+		sum += dist
+	}
+	return
+}
+
+// iterate refines the centers with k-means, returning the cluster of every point.
+func (m *lloyd) iterate(dataset clusters.Observations, centers [][]float64) ([]int, error) {
+	k := len(centers)
+	var cc = make(clusters.Clusters, k)
+	for ci := range cc {
+		cc[ci].Center = centers[ci]
+	}
+
+	var points = make([]int, len(dataset))
+	for p := range points {
+		points[p] = -1
+	}
+	var counts = make([]int, k)
+	for i := 0; ; i++ {
+		var changes atomic.Uint64
+		index := codec.NewIndex(centers)
+		parallel.ForEach(len(dataset), m.threads, func(p int) {
+			ci, _ := index.Nearest(dataset[p].Coordinates())
+			if points[p] != ci {
+				points[p] = ci
+				changes.Add(1)
+			}
+		})
+
+		for ci := range counts {
+			counts[ci] = 0
+		}
+		for _, ci := range points {
+			counts[ci]++
+		}
+		// move a random point of a cluster having more into every empty cluster
+		for ci := range counts {
+			if counts[ci] != 0 {
+				continue
+			}
+			ri := m.rng.IntN(len(dataset))
+			for counts[points[ri]] < 2 {
+				ri = m.rng.IntN(len(dataset))
+			}
+			counts[points[ri]]--
+			points[ri] = ci
+			counts[ci]++
+			changes.Add(uint64(len(dataset)))
+		}
+
+		if changes.Load() > 0 {
+			m.recenter(dataset, points, counts, centers)
+		}
+		if m.plotter != nil && m.algo != algoLBG {
+			if err := m.plotter.Plot(cc, -int(changes.Load())); err != nil {
+				return nil, fmt.Errorf("failed to plot chart: %s", err)
+			}
+		}
+		if i == m.iterationThreshold ||
+			int(changes.Load()) < int(float64(len(dataset))*m.deltaThreshold) {
+			break
+		}
+	}
+	return points, nil
+}
+
+// recenter moves the centers to the means of their points, summing in the
+// dataset order so that the result does not depend on the threads.
+func (m *lloyd) recenter(dataset clusters.Observations, points, counts []int, centers [][]float64) {
+	parallel.ForEach(len(centers[0]), m.threads, func(d int) {
+		var sums = make([]float64, len(centers))
+		for p, ci := range points {
+			sums[ci] += dataset[p].Coordinates()[d]
+		}
+		for ci := range centers {
+			centers[ci][d] = sums[ci] / float64(counts[ci])
+		}
+	})
+}
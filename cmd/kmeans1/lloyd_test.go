@@ -0,0 +1,44 @@
+package main
+
+import (
+	"math/rand/v2"
+	"testing"
+
+	"github.com/neurlang/clusters"
+)
+
+// iterations counts the iterations plotted.
+type iterations int
+
+func (n *iterations) Plot(cc clusters.Clusters, iteration int) error {
+	*n++
+	return nil
+}
+
+// TestMiniBatchConverges clusters well separated blobs, which mini-batch
+// k-means must separate long before its iteration limit.
+func TestMiniBatchConverges(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	var dataset clusters.Observations
+	for p := 0; p < 40000; p++ {
+		blob := float64(p % 4)
+		dataset = append(dataset, clusters.Coordinates{100*blob + rng.NormFloat64(), -100*blob + rng.NormFloat64()})
+	}
+	var n iterations
+	km := newLloyd(algoMiniBatch, 0.05, &n, 1, rand.New(rand.NewPCG(3, 4)))
+	clu, err := km.Partition(dataset, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int(n) > km.iterationThreshold/2 {
+		t.Errorf("%d iterations of at most %d", n, km.iterationThreshold)
+	}
+	if km.Distortion > 10 {
+		t.Errorf("distortion %v of well separated blobs", km.Distortion)
+	}
+	for ci := range clu {
+		if len(clu[ci].Observations) != 10000 {
+			t.Errorf("cluster %d: %d points, want 10000", ci, len(clu[ci].Observations))
+		}
+	}
+}
@@ -1,5 +1,7 @@
 package main
 
+import "bytes"
+import "encoding/json"
 import "fmt"
 import "sync/atomic"
 import "math"
@@ -14,6 +16,23 @@ func (l LPFloat) MarshalJSON() ([]byte, error) {
 	return []byte(s), nil
 }
 
+// stored returns the value rounded to the digits it is stored with.
+func (l LPFloat) stored() float64 {
+	scale := math.Pow(10, float64(l.Digits))
+	return math.Round(l.Value*scale) / scale
+}
+
+func (l *LPFloat) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &l.Value); err != nil {
+		return err
+	}
+	l.Digits = 0
+	if dot := bytes.IndexByte(data, '.'); dot >= 0 {
+		l.Digits = len(data) - dot - 1
+	}
+	return nil
+}
+
 var badFloatDetected atomic.Bool
 
 func verifyFloat(value float64) float64 {
@@ -32,3 +51,10 @@ func verifyFloat(value float64) float64 {
 	}
 	return value
 }
+
+func verifyFloats(values []float64) []float64 {
+	for _, value := range values {
+		verifyFloat(value)
+	}
+	return values
+}
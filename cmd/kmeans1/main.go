@@ -1,20 +1,14 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
-	"github.com/neurlang/classifier/parallel"
 	"github.com/neurlang/clusters"
 	"github.com/neurlang/gomel/phase"
-	"github.com/neurlang/kmeans"
+	"github.com/neurlang/gospeak/codec"
 	"io/fs"
-	"io/ioutil"
 	"path/filepath"
-	"sort"
+	"slices"
 	"strings"
-	"sync"
-	"sync/atomic"
 	//"math/cmplx"
 	"math"
 )
@@ -45,6 +39,7 @@ func progressBar(progress, width int) string {
 }
 func progressbar(stage, stages int, pos, max uint64, name string) {
 	const progressBarWidth = 40
+	progress.update(stage, stages, pos, max, name)
 	if max > 0 {
 		progress := int(pos * progressBarWidth / max)
 		percent := int(pos * 100 / max)
@@ -89,13 +84,50 @@ func isSilence(frame []float64, logEnergyThreshold float64) bool {
 	for i := range frame {
 		energy += frame[i] * frame[i] // Sum squared magnitudes
 	}
-	return energy < logEnergyThreshold
+	return 10*math.Log10(energy) < logEnergyThreshold
+}
+
+// silentFrames marks the frames quieter than threshold dB below the loudest
+// frame of the file. If trim is set, only the leading and trailing silence is
+// marked. Without a threshold no frame is silent, and it returns nil.
+func silentFrames(melFrames [][3]float64, numFreqs int, threshold float64, trim bool) []bool {
+	if threshold <= 0 {
+		return nil
+	}
+	var keys [][]float64
+	var peak = math.Inf(-1)
+	for j := 0; j+numFreqs <= len(melFrames); j += numFreqs {
+		key := codec.BandKey(melFrames[j : j+numFreqs])
+		var energy float64
+		for _, v := range key {
+			energy += v * v
+		}
+		peak = math.Max(peak, 10*math.Log10(energy))
+		keys = append(keys, key)
+	}
+	var silent = make([]bool, len(keys))
+	for j, key := range keys {
+		silent[j] = isSilence(key, peak-threshold)
+	}
+	if trim {
+		lead, tail := 0, len(silent)
+		for lead < tail && silent[lead] {
+			lead++
+		}
+		for tail > lead && silent[tail-1] {
+			tail--
+		}
+		for j := lead; j < tail; j++ {
+			silent[j] = false
+		}
+	}
+	return silent
 }
 
 // ShuffleSlice shuffles the slice. Now copied straight from the manual.
-// Note: Tested that the randomness source is not deterministic (different shufflings across program runs).
-func ShuffleSlice[T any](slice []T) {
-	rand.Shuffle(len(slice), func(i, j int) {
+// The shuffling is reproducible given the seed of the random source.
+func ShuffleSlice[T any](rng *rand.Rand, slice []T) {
+	rng.Shuffle(len(slice), func(i, j int) {
 		slice[i], slice[j] = slice[j], slice[i]
 	})
 }
@@ -119,6 +151,9 @@ type plotter struct {
 }
 
 func (p *plotter) Plot(cc clusters.Clusters, iteration int) error {
+	if iteration < 0 {
+		progress.iteration(p.stage, p.stages, int(p.itr), -iteration, p.msg)
+	}
 	if iteration < 0 && p.del != 0 {
 		if p.itr == 0 {
 			p.pro = uint64(-iteration)
@@ -166,50 +201,22 @@ func which(n int, possibilities []int) (int, int) {
 	return -1, -1
 }
 
-type Stuffer int
-
-func (numFreqs *Stuffer) doZeroStuff(audio []float64, sampleRate uint32, err error) ([]float64, int) {
+// loadSamples loads an audio file at the codec native sample rate, or returns nil
+func loadSamples(fileName string, layout *codec.Layout) []float64 {
+	audio, sampleRate, err := codec.LoadAudio(fileName)
 	if err != nil {
-		return nil, 0
-	}
-	switch sampleRate {
-	case 8000, 16000, 48000:
-		if *numFreqs != 384*2 {
-			return nil, 0
-		}
-	case 11025, 22050, 44100:
-		if *numFreqs != 418*2 {
-			return nil, 0
-		}
-	}
-	switch sampleRate {
-	case 8000:
-		return audio, 5
-	case 11025:
-		return audio, 3
-	case 16000:
-		return audio, 2
-	case 22050:
-		return audio, 1
-	default:
-		return audio, 0
-	}
-}
-
-func zeroStuffing(audio []float64, zerosCount int) (result []float64) {
-	if zerosCount == 0 {
-		return audio
+		return nil
 	}
-	result = make([]float64, 0, len(audio)*(zerosCount+1))
-	for _, v := range audio {
-		result = append(result, v)
-		for i := 0; i < zerosCount; i++ {
-			result = append(result, 0)
-		}
+	audio, err = codec.ToNative(audio, sampleRate, layout)
+	if err != nil {
+		return nil
 	}
-	return
+	return audio
 }
 
+// silenceSample is the number of silent frames kept per band to train the silence codewords
+const silenceSample = 65536
+
 func chunksKmeanzMasterkmeanz(filesCount, qualityBoost int) (int, int, int) {
 	var chunks = 64
 	var kmeanz = 4096 << qualityBoost
@@ -273,6 +280,10 @@ func command(execString string, chunk, chunks int, wait, debug bool, percentage
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "worker" {
+		handleWorker(os.Args[2:])
+		return
+	}
 	srcDir := flag.String("srcdir", "", "path to directory containing wav or flac files to generate codec for")
 	dstDir := flag.String("dstdir", "", "path to directory to write generated codec to")
 	execute := flag.String("execute", "", "a command to run after each phase gets solved")
@@ -281,6 +292,30 @@ func main() {
 	threads := flag.Int("threads", runtime.NumCPU(), "number of threads (default NumCPU() at startup)")
 	quality := flag.Int("quality", 0, "quality increase factor (small integer, default 0)")
 	checkpoints := flag.Int("checkpoints", 8, "number of checkpoints to preserve")
+	bandsSpec := flag.String("bands", "", "number of frequency bands, or comma separated band edges (default the 8 native bands)")
+	resume := flag.Bool("resume", false, "continue from the latest valid checkpoint in dstdir")
+	seed := flag.Uint64("seed", 0, "random seed for a reproducible run (default random, recorded in the codec)")
+	silenceThreshold := flag.Float64("silence-threshold", 0, "discard frames this many dB below the loudest frame of their file (default 0, keep all)")
+	trimSilence := flag.Bool("trim-silence", false, "discard only the leading and trailing silence of each file")
+	silenceCodewords := flag.Int("silence-codewords", 8, "number of codewords kept for the discarded silence")
+	cache := flag.Bool("cache", false, "cache the spectrograms of the corpus in dstdir/cache")
+	cacheDir := flag.String("cachedir", "", "cache the spectrograms of the corpus in this directory")
+	algo := flag.String("algo", algoLloyd, "clustering algorithm: "+strings.Join(algos, ", "))
+	exemplarSpec := flag.String("exemplar", exemplarNearest, "codeword exemplar: nearest, medoid, mean or multi:N")
+	farThreshold := flag.Float64("far-threshold", 6, "report the exemplars this many dB farther from their cluster center than the median of the band")
+	progressJSON := flag.String("progress-json", "", "write progress events as JSON lines to this file path or file descriptor number")
+	progressListen := flag.String("progress-listen", "", "serve progress events as server-sent events on this address, such as :8080")
+	validationSplit := flag.Float64("validation-split", 0, "fraction of the files kept out of clustering to measure the distortion of unseen speech (default 0)")
+	stages := flag.Int("stages", 1, "quantisation stages per band, the second and third train residual codebooks on what the stages before leave (1 ~ 3)")
+	residualCodewords := flag.Int("residual-codewords", 255, "codewords of every residual stage codebook")
+	adaptSpec := flag.String("adapt", "", "adapt this codebook to the corpus, keeping its codeword IDs")
+	novelty := flag.Float64("novelty", 6, "with --adapt, frames this many dB farther from their nearest codeword than the median of the band are novel")
+	adaptCodewords := flag.Int("adapt-codewords", 16, "with --adapt, the maximum number of codewords appended per band for the novel frames")
+	multiSpeaker := flag.Bool("speakers", false, "train a codebook shared by the speakers, the subdirectories of srcdir, sampling them evenly")
+	bitrateBudget := flag.Float64("bitrate", 0, "token bitrate budget in bits/s, split into codebook sizes descending from the lowest band (default 0, sizes from the corpus)")
+	bandBitsSpec := flag.String("band-bits", "", "comma separated token bit widths of the bands, such as 15,14,13, the codebook sizes are 2^bits-1")
+	workers := flag.String("workers", "", "comma separated host:port addresses of kmeans1 workers to cluster the chunks on, such as host1:7070,host2:7070")
+	maxMemSpec := flag.String("max-mem", "", "memory budget of the frames of a chunk such as 512M or 8G, sampling the frames beyond it (default unlimited)")
 	flag.Parse()
 	if srcDir == nil || *srcDir == "" {
 		println("srcdir is mandatory")
@@ -290,6 +325,44 @@ func main() {
 		println("dstdir is mandatory")
 		return
 	}
+	if !slices.Contains(algos, *algo) {
+		println("unknown algo", *algo)
+		return
+	}
+	exemplarStrategy, exemplarCount, err := parseExemplar(*exemplarSpec)
+	if err != nil {
+		fmt.Println("Error:", err.Error())
+		return
+	}
+	if *stages < 1 || *stages > 3 || *residualCodewords < 1 {
+		println("stages must be 1 ~ 3 and residual-codewords positive")
+		return
+	}
+	if *adaptSpec != "" && *bandsSpec != "" {
+		println("the bands of --adapt are those of the adapted codebook")
+		return
+	}
+	if *bitrateBudget != 0 && *bandBitsSpec != "" {
+		println("bitrate and band-bits are exclusive")
+		return
+	}
+	if *adaptSpec != "" && (*bitrateBudget != 0 || *bandBitsSpec != "") {
+		println("the codebook sizes of --adapt are those of the adapted codebook")
+		return
+	}
+	if *bitrateBudget < 0 {
+		println("bitrate must be positive")
+		return
+	}
+	if *validationSplit < 0 || *validationSplit >= 1 {
+		println("validation-split must be at least 0 and below 1")
+		return
+	}
+	maxMem, err := parseBytes(*maxMemSpec)
+	if *maxMemSpec != "" && err != nil {
+		fmt.Println("Error:", err.Error())
+		return
+	}
 
 	// Check if dstDir exists and is a directory
 	dstInfo, err := os.Stat(*dstDir)
@@ -305,12 +378,7 @@ func main() {
 	const limit = 9999999999999999
 
 	// 1. Load FLAC file and convert to phase spectrogram
-	m := phase.NewPhase()
-	m.YReverse = true
-	m.Window = 640 * 2
-	m.NumFreqs = 0 // unknown
-	m.Resolut = 2048 * 2
-	var ranges []int
+	var layout codec.Layout
 
 	var filesFlac, filesWav []string
 	filepath.Walk(*srcDir, func(path string, info fs.FileInfo, err error) error {
@@ -320,7 +388,7 @@ func main() {
 			return nil
 		}
 		if len(filesFlac)+len(filesWav) < limit {
-			if m.NumFreqs == 0 {
+			if layout.NumFreqs == 0 {
 				var audio []float64
 				var sr uint32
 				var err error
@@ -338,15 +406,8 @@ func main() {
 					return nil
 				}
 				println("Sample rate:", sr)
-				switch sr {
-				case 8000, 16000, 48000:
-					println("Codec native sample rate: 48000")
-					m.NumFreqs = 384 * 2
-					ranges = []int{0, 38, 88, 134, 184, 234, 367, 501, 384 * 2}
-				case 11025, 22050, 44100:
-					println("Codec native sample rate: 44100")
-					m.NumFreqs = 418 * 2
-					ranges = []int{0, 41, 95, 145, 200, 254, 400, 545, 418 * 2}
+				if layout, err = codec.LayoutFor(sr); err == nil {
+					println("Codec native sample rate:", layout.SampleRate)
 				}
 			}
 			if isFlac {
@@ -359,266 +420,224 @@ func main() {
 		return nil
 	})
 
-	if m.NumFreqs == 0 {
+	if layout.NumFreqs == 0 {
 		panic("couldn't figure out project sample rate - no relevant files found?")
 	}
-	var s Stuffer = Stuffer(m.NumFreqs)
-
-	var chunks, kmeanz, masterkmeanz = chunksKmeanzMasterkmeanz(len(filesFlac)+len(filesWav), *quality)
-	println("Files:", len(filesFlac)+len(filesWav))
-	println("Chunks:", chunks)
-	println("Kmeans:", kmeanz)
-	println("Master Kmeans:", masterkmeanz)
-
-	execString := ""
-	if execute != nil {
-		execString = *execute
-	}
-	execdbg := false
-	if executedbg != nil {
-		execdbg = *executedbg
-	}
-	execDet := false
-	if execDetailed != nil {
-		execDet = *execDetailed
+	if bandsSpec != nil && *bandsSpec != "" {
+		if err := layout.SetBands(*bandsSpec); err != nil {
+			fmt.Println("Error:", err.Error())
+			return
+		}
 	}
 
-	var fileMutex sync.Mutex
-	var file struct {
-		minDists  []float64
-		Centroids [][][]LPFloat
+	spk, err := newSpeakers(*srcDir, *multiSpeaker, filesFlac, filesWav)
+	if err != nil {
+		fmt.Println("Error:", err.Error())
+		return
 	}
 
-	for rang := 0; rang < 8; rang++ {
-		file.Centroids = append(file.Centroids, nil)
-		file.minDists = nil
-		// dataset for master problem
-		var master clusters.Observations
-		for chunk := 0; chunk < chunks; chunk++ {
-			fmt.Println()
-
-			// 2. Prepare dataset for K-means
-			var dataset clusters.Observations
-			var dataset_mut sync.Mutex
-			var dataset_progress atomic.Uint64
-			//var dataset_discarded atomic.Uint64
-			var dataset_total atomic.Uint64
-
-			parallel.ForEach(len(filesFlac)+len(filesWav), *threads, func(i int) {
-
-				if i%chunks != chunk {
-					return
-				}
-
-				var audioSamples []float64
-				// Load audio samples
-				switch index, pos := which(i, []int{len(filesFlac), len(filesWav)}); index {
-				case 0:
-					audioSamples = zeroStuffing(s.doZeroStuff(phase.LoadFlacSampleRate(filesFlac[pos])))
-				case 1:
-					audioSamples = zeroStuffing(s.doZeroStuff(phase.LoadWavSampleRate(filesWav[pos])))
-				default:
-					return
-				}
-
-				// Convert to mel spectrogram (returns [][3]float64 where each element is [m.NumFreqs]float64 for sine and cosine and real)
-				melFrames, err := m.ToPhase(audioSamples)
-				if err != nil {
-					panic(err)
-				}
-
-				//var discarded uint64
-				for j := 0; j < len(melFrames); j += m.NumFreqs {
-					var keycoords []float64
-					for i := ranges[rang]; i < ranges[rang+1]; i++ {
-						keycoords = append(keycoords, (math.Sqrt(math.Pow(verifyFloat(math.Exp2(melFrames[j+i][1])), 2) + math.Pow(verifyFloat(math.Exp2(melFrames[j+i][2])), 2))))
-						keycoords = append(keycoords, (math.Sqrt(math.Pow(verifyFloat(math.Exp2(melFrames[j+i][0])), 2) + math.Pow(verifyFloat(math.Exp2(melFrames[j+i][1])), 2))))
-
-					}
-					var coords = clusters.Coordinates(keycoords)
-					dataset_mut.Lock()
-					dataset = append(dataset, coords)
-					dataset_mut.Unlock()
-				}
-				//dataset_discarded.Add(discarded)
-				dataset_total.Add(uint64(len(melFrames)) / uint64(m.NumFreqs))
-				dataset_progress.Add(uint64(chunks))
-				if dataset_progress.Load() > uint64(len(filesFlac)+len(filesWav)) {
-					progressbar(2*chunk+1+(2*chunks+2)*rang, (2*chunks+2)*8, 1, 1, "loading")
-				} else {
-					progressbar(2*chunk+1+(2*chunks+2)*rang, (2*chunks+2)*8, dataset_progress.Load(), uint64(len(filesFlac)+len(filesWav)), "loading")
-				}
-				//println(discarded)
-			})
-			progressbar(2*chunk+1+(2*chunks+2)*rang, (2*chunks+2)*8, 1, 1, "loading")
-			if execute != nil && *execute != "" {
-				command(*execute, 2*chunk+1+(2*chunks+2)*rang, (2*chunks+2)*8, false, executedbg != nil && *executedbg, 96, "loading")
-			}
-
-			fmt.Println()
-
-			//println("Silence discarded: ", dataset_discarded.Load() * 100 / dataset_total.Load() , "%")
-
-			if len(dataset) < kmeanz {
-				ShuffleSlice(dataset)
-				for i := 0; len(dataset) < kmeanz; i++ {
-					dataset = append(dataset, dataset[i])
-				}
-			}
-
-			ShuffleSlice(dataset)
-
-			progressbar(2*chunk+2+(2*chunks+2)*rang, (2*chunks+2)*8, 0, 1, "kmeans")
-
-			plotter := &plotter{
-				stage:        2*chunk + 2 + (2*chunks+2)*rang,
-				stages:       (2*chunks + 2) * 8,
-				del:          0.05,
-				execString:   execString,
-				executedbg:   execdbg,
-				execDetailed: execDet,
-				msg:          "kmeans",
-			}
-
-			// 3. Run K-means clustering
-			km, err := kmeans.NewWithOptions(0.05, plotter)
-			km.Threads = *threads * *threads
-			if err != nil {
-				panic(err)
-			}
-
-			clu, err := km.Partition(dataset, kmeanz)
-			if err != nil {
-				panic(err)
-			}
-
-			for _, c := range clu {
-				master = append(master, c.Center)
-			}
-			progressbar(2*chunk+2+(2*chunks+2)*rang, (2*chunks+2)*8, 1, 1, "kmeans")
-			if execute != nil && *execute != "" {
-				command(*execute, 2*chunk+2+(2*chunks+2)*rang, (2*chunks+2)*8, false, executedbg != nil && *executedbg, 96, "kmeans")
+	// the corpus files relative to srcdir, as the workers find them
+	var paths []string
+	for _, list := range [][]string{filesFlac, filesWav} {
+		for _, path := range list {
+			if rel, err := filepath.Rel(*srcDir, path); err == nil {
+				path = rel
 			}
+			paths = append(paths, filepath.ToSlash(path))
 		}
+	}
+	var pool *workerPool
+	if *workers != "" {
+		pool = newWorkerPool(*workers)
+	}
 
-		ShuffleSlice(master)
-		progressbar(2*chunks+(2*chunks+2)*rang, (2*chunks+2)*8, 1, 1, "kmeans")
-		fmt.Println()
-		progressbar(2*chunks+1+(2*chunks+2)*rang, (2*chunks+2)*8, 0, 1, "final")
-
-		plotter := &plotter{
-			stage:        2*chunks + 1 + (2*chunks+2)*rang,
-			stages:       (2*chunks + 2) * 8,
-			del:          0.05,
-			execString:   execString,
-			executedbg:   execdbg,
-			execDetailed: execDet,
-			msg:          "final",
+	var file checkpoint
+	file.Version = codec.Version
+	file.Corpus = corpusHash(*srcDir, filesFlac, filesWav)
+	if *multiSpeaker {
+		file.Speakers = spk.names
+	}
+	if resume != nil && *resume {
+		if cp := latestCheckpoint(*dstDir); cp == nil {
+			fmt.Println("No checkpoint to resume from, starting from band 0")
+		} else if err := cp.resumable(&layout, file.Corpus); err != nil {
+			fmt.Println("Error: can't resume,", err.Error())
+			return
+		} else if bandsSpec != nil && *bandsSpec != "" && fmt.Sprint(cp.Ranges) != fmt.Sprint(layout.Ranges) {
+			fmt.Println("Error: can't resume, the bands changed from", cp.Ranges, "to", layout.Ranges)
+			return
+		} else if *seed != 0 && *seed != cp.Seed {
+			fmt.Println("Error: can't resume, the seed changed from", cp.Seed, "to", *seed)
+			return
+		} else if fmt.Sprint(cp.Speakers) != fmt.Sprint(file.Speakers) {
+			fmt.Println("Error: can't resume, the speakers changed from", cp.Speakers, "to", file.Speakers)
+			return
+		} else {
+			layout = cp.Layout
+			file.Centroids = cp.Centroids
+			file.Exemplars = cp.Exemplars
+			file.Residuals = cp.Residuals
+			*seed = cp.Seed
+			fmt.Println("Resuming from band", len(file.Centroids))
 		}
-
-		// 4. Run master K-means clustering
-		km, err := kmeans.NewWithOptions(0.05, plotter)
-		km.Threads = *threads * *threads
+	}
+	var adapt *adapter
+	if *adaptSpec != "" {
+		adapt, err = newAdapter(*adaptSpec, *dstDir, *novelty, *adaptCodewords, len(file.Centroids))
 		if err != nil {
-			panic(err)
+			fmt.Println("Error:", err.Error())
+			return
 		}
-		clu, err := km.Partition(master, masterkmeanz)
-		if err != nil {
-			panic(err)
+		if adapt.base.SampleRate != layout.SampleRate {
+			fmt.Println("Error: can't adapt, the codebook sample rate family", adapt.base.SampleRate, "differs from the corpus", layout.SampleRate)
+			return
 		}
-
-		sort.Slice(clu, func(i, j int) bool {
-			return len(clu[i].Observations) > len(clu[j].Observations)
-		})
-
-		// 5. Init cluster info
-		for range clu {
-			//fmt.Printf("Cluster %d - Centroid (%d dimensions) - frames: %d\n", i, len(c.Center), len(c.Observations))
-			file.Centroids[rang] = append(file.Centroids[rang], []LPFloat{})
-			file.minDists = append(file.minDists, math.MaxFloat64)
+		if len(file.Centroids) > 0 && fmt.Sprint(layout.Ranges) != fmt.Sprint(adapt.base.Ranges) {
+			fmt.Println("Error: can't resume, the bands changed from", layout.Ranges, "to", adapt.base.Ranges)
+			return
 		}
-
-		// 6. convert wavs to codewords
-		var final_dump_progress atomic.Uint64
-		progressbar(2*chunks+1+(2*chunks+2)*rang, (2*chunks+2)*8, 1, 1, "final")
-		if execute != nil && *execute != "" {
-			command(*execute, 2*chunks+1+(2*chunks+2)*rang, (2*chunks+2)*8, false, executedbg != nil && *executedbg, 96, "final")
+		layout = adapt.base.Layout
+		file.Parents = adapt.base.Lineage()
+		fmt.Println("Adapting", *adaptSpec, "bands", len(adapt.base.Centroids))
+	}
+	if *bitrateBudget != 0 || *bandBitsSpec != "" {
+		var widths []int
+		if *bandBitsSpec != "" {
+			widths, err = parseBandBits(*bandBitsSpec, layout.Bands())
+		} else {
+			widths, err = allocateBits(*bitrateBudget, layout.FrameRate(), layout.Bands())
 		}
-		fmt.Println()
-		progressbar(2*chunks+2+(2*chunks+2)*rang, (2*chunks+2)*8, 0, 1, "dumping")
+		if err != nil {
+			fmt.Println("Error:", err.Error())
+			return
+		}
+		if len(file.Centroids) > 0 && fmt.Sprint(layout.BandBits) != fmt.Sprint(widths) {
+			fmt.Println("Error: can't resume, the band bits changed from", layout.BandBits, "to", widths)
+			return
+		}
+		layout.BandBits = widths
+	}
+	for *seed == 0 {
+		*seed = rand.Uint64()
+	}
+	file.Layout = layout
+	file.Seed = *seed
 
-		parallel.ForEach(len(filesFlac)+len(filesWav), *threads, func(i int) {
+	if *cache && *cacheDir == "" {
+		*cacheDir = filepath.Join(*dstDir, "cache")
+	}
+	features, err := newFeatureCache(*cacheDir, &layout)
+	if err != nil {
+		fmt.Println("Error:", err.Error())
+		return
+	}
 
-			var audioSamples []float64
-			var fileName string
-			// Load audio samples
+	// the held out files are only measured, the chunks split the other files
+	var held = heldOut(len(filesFlac)+len(filesWav), *validationSplit, *seed)
+	var validation *validationReport
+	var trained = len(held)
+	if *validationSplit > 0 {
+		validation = loadValidation(*dstDir, *validationSplit, *seed, *quality, len(file.Centroids))
+		validation.Files = nil
+		for i := range held {
+			if !held[i] {
+				continue
+			}
+			trained--
+			path := filesWav[0]
 			switch index, pos := which(i, []int{len(filesFlac), len(filesWav)}); index {
 			case 0:
-				fileName = filesFlac[pos]
-				audioSamples = zeroStuffing(s.doZeroStuff(phase.LoadFlacSampleRate(fileName)))
+				path = filesFlac[pos]
 			case 1:
-				fileName = filesWav[pos]
-				audioSamples = zeroStuffing(s.doZeroStuff(phase.LoadWavSampleRate(fileName)))
-			default:
-				return
+				path = filesWav[pos]
 			}
-
-			// Convert to mel spectrogram (returns [][3]float64 where each element is [m.NumFreqs]float64 for sine and cosine and real)
-			melFrames, err := m.ToPhase(audioSamples)
-			if err != nil {
-				panic(err)
+			if rel, err := filepath.Rel(*srcDir, path); err == nil {
+				path = rel
 			}
+			validation.Files = append(validation.Files, filepath.ToSlash(path))
+		}
+	}
 
-			for j := 0; j < len(melFrames); j += m.NumFreqs {
-				// Convert [m.NumFreqs][3]float64 to a flat []float64 (1152 dimensions)
-				var coords []LPFloat
-				for i := ranges[rang]; i < ranges[rang+1]; i++ {
-					coords = append(coords, LPFloat{Value: melFrames[j+i][0], Digits: 3}) // first component
-					coords = append(coords, LPFloat{Value: melFrames[j+i][1], Digits: 3}) // second component
-					coords = append(coords, LPFloat{Value: melFrames[j+i][2], Digits: 3}) // third component
-				}
-				var keycoords []float64
-				for i := ranges[rang]; i < ranges[rang+1]; i++ {
-					keycoords = append(keycoords, (math.Sqrt(math.Pow(verifyFloat(math.Exp2(melFrames[j+i][1])), 2) + math.Pow(verifyFloat(math.Exp2(melFrames[j+i][2])), 2))))
-					keycoords = append(keycoords, (math.Sqrt(math.Pow(verifyFloat(math.Exp2(melFrames[j+i][0])), 2) + math.Pow(verifyFloat(math.Exp2(melFrames[j+i][1])), 2))))
-				}
-				var sample = clusters.Coordinates(keycoords)
-				for codeword := range clu {
-					dist := sample.Distance(clu[codeword].Center)
-
-					fileMutex.Lock()
-					// update solution's nearest Centroids
-					if dist < file.minDists[codeword] {
-						file.minDists[codeword] = dist
-						file.Centroids[rang][codeword] = coords
-					}
-					fileMutex.Unlock()
-				}
-			}
-			progressbar(2*chunks+2+(2*chunks+2)*rang, (2*chunks+2)*8, final_dump_progress.Load(), uint64(len(filesFlac)+len(filesWav)), "dumping")
-			final_dump_progress.Add(1)
-		})
-		progressbar(2*chunks+2+(2*chunks+2)*rang, (2*chunks+2)*8, 1, 1, "dumping")
-		fmt.Println()
-		// Output to file
-		{
-			data, err := json.Marshal(file)
-			if err != nil {
-				panic(err)
-			}
-			data = bytes.ReplaceAll(data, []byte(`],`), []byte("],\n"))
-			err = ioutil.WriteFile(*dstDir+string(os.PathSeparator)+`centroids`+fmt.Sprint(rang)+`.json`, data, 0755)
-			if err != nil {
-				panic(err)
-			}
+	var speakerStats *speakerReport
+	if *multiSpeaker {
+		speakerStats = loadSpeakerReport(*dstDir, spk.names, len(file.Centroids))
+	}
+
+	var chunks, kmeanz, masterkmeanz = chunksKmeanzMasterkmeanz(trained, *quality)
+	println("Files:", len(filesFlac)+len(filesWav))
+	if *multiSpeaker {
+		println("Speakers:", len(spk.names))
+	}
+	if validation != nil {
+		println("Validation files:", len(validation.Files))
+	}
+	println("Chunks:", chunks)
+	if pool != nil {
+		println("Workers:", len(pool.addrs))
+	}
+	println("Kmeans:", kmeanz)
+	println("Master Kmeans:", masterkmeanz)
+	fmt.Println("Bands:", layout.Ranges)
+	if layout.BandBits != nil {
+		var frameBits int
+		for _, width := range layout.BandBits {
+			frameBits += width
 		}
-		// Clean up old checkpoint if needed
-		if checkpoints != nil && rang-*checkpoints >= 0 {
-			os.Remove(*dstDir + string(os.PathSeparator) + `centroids` + fmt.Sprint(rang-*checkpoints) + `.json`)
+		fmt.Println("Band bits:", layout.BandBits)
+		fmt.Printf("Bitrate: %g bits/s\n", float64(frameBits)*layout.FrameRate())
+	}
+	fmt.Println("Seed:", *seed)
+	if *progressJSON != "" {
+		if err := progress.open(*progressJSON); err != nil {
+			fmt.Println("Error:", err.Error())
+			return
 		}
 	}
+	if *progressListen != "" {
+		progress.listen(*progressListen)
+	}
+	progress.begin(len(filesFlac)+len(filesWav), chunks, layout.Bands(), *seed)
+
+	var t = &trainer{
+		srcDir:            *srcDir,
+		dstDir:            *dstDir,
+		cacheDir:          *cacheDir,
+		threads:           *threads,
+		seed:              *seed,
+		algo:              *algo,
+		maxMem:            maxMem,
+		checkpoints:       *checkpoints,
+		silenceThreshold:  *silenceThreshold,
+		trimSilence:       *trimSilence,
+		silenceCodewords:  *silenceCodewords,
+		exemplarStrategy:  exemplarStrategy,
+		exemplarCount:     exemplarCount,
+		farThreshold:      *farThreshold,
+		residualStages:    *stages,
+		residualCodewords: *residualCodewords,
+		execute:           *execute,
+		executedbg:        *executedbg,
+		execDetailed:      *execDetailed,
+		layout:            layout,
+		files:             append(filesFlac, filesWav...),
+		paths:             paths,
+		held:              held,
+		spk:               spk,
+		features:          features,
+		pool:              pool,
+		adapt:             adapt,
+		validation:        validation,
+		speakerStats:      speakerStats,
+		chunks:            chunks,
+		kmeanz:            kmeanz,
+		masterkmeanz:      masterkmeanz,
+		file:              file,
+	}
+	t.train()
+	fmt.Printf("Bitrate: %g bits/s\n", bitrate(&layout, t.file.Centroids))
 	fmt.Println("Codec solved: true")
-	if execute != nil && *execute != "" {
-		command(*execute, (2*chunks+2)*8, (2*chunks+2)*8, true, executedbg != nil && *executedbg, 96, "completed")
+	progress.complete(t.stages())
+	if *execute != "" {
+		command(*execute, t.stages(), t.stages(), true, *executedbg, 96, "completed")
 	}
 }
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// progressEvent is a progress event of --progress-json and --progress-listen.
+type progressEvent struct {
+	// Event is start, progress, iteration, checkpoint or complete
+	Event string
+	Time  time.Time
+	// Stage is the stage number 1 ~ Stages, the stages of a band being the
+	// loading and kmeans stages of every chunk followed by final and dumping
+	Stage  int
+	Stages int
+	Band   int
+	// Chunk is the chunk of a loading or kmeans stage, -1 for other stages
+	Chunk int
+	// Status is loading, kmeans, final, dumping or complete
+	Status       string
+	Percent      int
+	TotalPercent int
+	// ETA is the estimated number of seconds until the run completes, -1 if unknown
+	ETA float64
+
+	// Iteration and Changes describe a k-means iteration: the points which
+	// changed clusters, progress being made as they decrease
+	Iteration int `json:",omitempty"`
+	Changes   int `json:",omitempty"`
+	// Path is the file of a checkpoint event
+	Path string `json:",omitempty"`
+	// Files, Chunks, Bands and Seed describe the run in the start event
+	Files  int    `json:",omitempty"`
+	Chunks int    `json:",omitempty"`
+	Bands  int    `json:",omitempty"`
+	Seed   uint64 `json:",omitempty"`
+}
+
+// progressEvents writes the progress events as JSON lines and serves them as
+// server-sent events. Without a sink it does nothing.
+type progressEvents struct {
+	mut    sync.Mutex
+	w      *bufio.Writer
+	closer io.Closer
+
+	start  time.Time
+	chunks int
+	last   progressEvent // the last progress event, to skip repeated ones
+
+	clients map[chan []byte]bool
+	history [][]byte // the start event and the last event, for new clients
+}
+
+var progress = &progressEvents{}
+
+// open opens the JSON-lines sink, a file descriptor number or a file path.
+func (p *progressEvents) open(target string) error {
+	if fd, err := strconv.Atoi(target); err == nil {
+		f := os.NewFile(uintptr(fd), "progress")
+		if f == nil {
+			return fmt.Errorf("invalid file descriptor %d", fd)
+		}
+		p.w, p.closer = bufio.NewWriter(f), f
+		return nil
+	}
+	f, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	p.w, p.closer = bufio.NewWriter(f), f
+	return nil
+}
+
+// listen serves the events as server-sent events on the address.
+func (p *progressEvents) listen(addr string) {
+	p.mut.Lock()
+	p.clients = map[chan []byte]bool{}
+	p.mut.Unlock()
+	go func() {
+		err := http.ListenAndServe(addr, http.HandlerFunc(p.serve))
+		println("Progress listen:", err.Error())
+	}()
+}
+
+func (p *progressEvents) serve(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	var ch = make(chan []byte, 256)
+	p.mut.Lock()
+	for _, line := range p.history {
+		fmt.Fprintf(w, "data: %s\n\n", line)
+	}
+	p.clients[ch] = true
+	p.mut.Unlock()
+	flusher.Flush()
+	defer func() {
+		p.mut.Lock()
+		delete(p.clients, ch)
+		p.mut.Unlock()
+	}()
+
+	for {
+		select {
+		case line := <-ch:
+			fmt.Fprintf(w, "data: %s\n\n", line)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// active reports whether the events go anywhere.
+func (p *progressEvents) active() bool {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	return p.w != nil || p.clients != nil
+}
+
+// begin emits the start event of a run.
+func (p *progressEvents) begin(files, chunks, bands int, seed uint64) {
+	p.start, p.chunks = time.Now(), chunks
+	p.emit(progressEvent{Event: "start", Files: files, Chunks: chunks, Bands: bands, Seed: seed,
+		Stages: (2*chunks + 2) * bands, Chunk: -1, ETA: -1})
+}
+
+// at fills in the band and chunk of a stage and the estimated time left.
+func (p *progressEvents) at(e progressEvent, stage, stages int, fraction float64) progressEvent {
+	e.Stage, e.Stages = stage, stages
+	perBand := 2*p.chunks + 2
+	if stage > 0 && perBand > 0 {
+		e.Band = (stage - 1) / perBand
+		e.Chunk = -1
+		if local := (stage - 1) % perBand; local < 2*p.chunks {
+			e.Chunk = local / 2
+		}
+	}
+	e.TotalPercent = calculateOverallProgress(stage, stages, e.Percent)
+	e.ETA = -1
+	if done := (float64(stage-1) + fraction) / float64(stages); done > 0 && done <= 1 {
+		e.ETA = time.Since(p.start).Seconds() * (1 - done) / done
+	}
+	return e
+}
+
+// update emits a progress event of a progress bar update.
+func (p *progressEvents) update(stage, stages int, pos, max uint64, status string) {
+	if !p.active() || max == 0 {
+		return
+	}
+	e := p.at(progressEvent{Event: "progress", Status: status, Percent: int(pos * 100 / max)}, stage, stages, float64(pos)/float64(max))
+	p.mut.Lock()
+	repeated := p.last.Stage == e.Stage && p.last.Status == e.Status && p.last.Percent == e.Percent
+	if !repeated {
+		p.last = e
+	}
+	p.mut.Unlock()
+	if !repeated {
+		p.emit(e)
+	}
+}
+
+// iteration emits the event of a k-means iteration.
+func (p *progressEvents) iteration(stage, stages, iteration, changes int, status string) {
+	if !p.active() {
+		return
+	}
+	p.emit(p.at(progressEvent{Event: "iteration", Status: status, Iteration: iteration, Changes: changes}, stage, stages, 0))
+}
+
+// checkpoint emits the event of a written checkpoint.
+func (p *progressEvents) checkpoint(stage, stages int, path string) {
+	if !p.active() {
+		return
+	}
+	p.emit(p.at(progressEvent{Event: "checkpoint", Status: "dumping", Percent: 100, Path: path}, stage, stages, 1))
+}
+
+// complete emits the last event and closes the sink.
+func (p *progressEvents) complete(stages int) {
+	if !p.active() {
+		return
+	}
+	p.emit(p.at(progressEvent{Event: "complete", Status: "complete", Percent: 100}, stages, stages, 1))
+	// give the clients a moment to receive the last event before exiting
+	for i := 0; i < 100 && p.pending(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	if p.w != nil {
+		p.w.Flush()
+		p.closer.Close()
+		p.w = nil
+	}
+}
+
+// pending reports whether a client has events left to send.
+func (p *progressEvents) pending() bool {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	for ch := range p.clients {
+		if len(ch) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *progressEvents) emit(e progressEvent) {
+	if !p.active() {
+		return
+	}
+	e.Time = time.Now()
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	if p.w != nil {
+		p.w.Write(line)
+		p.w.WriteByte('\n')
+		p.w.Flush()
+	}
+	if p.clients != nil {
+		if e.Event == "start" || len(p.history) == 0 {
+			p.history = [][]byte{line}
+		} else {
+			p.history = append(p.history[:1], line)
+		}
+		for ch := range p.clients {
+			select {
+			case ch <- line:
+			default:
+				// a client too slow to keep up misses events
+			}
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProgressEventsStream(t *testing.T) {
+	var p = &progressEvents{}
+	if err := p.open(filepath.Join(t.TempDir(), "progress.jsonl")); err != nil {
+		t.Fatal(err)
+	}
+	p.clients = map[chan []byte]bool{}
+	server := httptest.NewServer(http.HandlerFunc(p.serve))
+	defer server.Close()
+	p.begin(10, 2, 3, 42)
+
+	// clients connect while the training emits events
+	var wg sync.WaitGroup
+	var events = make([][]progressEvent, 3)
+	for c := range events {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			resp, err := http.Get(server.URL)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			scanner := bufio.NewScanner(resp.Body)
+			for scanner.Scan() {
+				line, ok := strings.CutPrefix(scanner.Text(), "data: ")
+				if !ok {
+					continue
+				}
+				var e progressEvent
+				if err := json.Unmarshal([]byte(line), &e); err != nil {
+					t.Error(err)
+					return
+				}
+				events[c] = append(events[c], e)
+				if e.Event == "complete" {
+					return
+				}
+			}
+		}(c)
+	}
+	// the files of a stage are loaded in parallel, reporting progress as they go
+	var stop = make(chan bool)
+	var loaders sync.WaitGroup
+	for l := 0; l < 4; l++ {
+		loaders.Add(1)
+		go func(l int) {
+			defer loaders.Done()
+			for pos := uint64(0); ; pos++ {
+				select {
+				case <-stop:
+					return
+				case <-time.After(time.Millisecond):
+					p.update(1+l, 18, pos%10, 10, "loading")
+				}
+			}
+		}(l)
+	}
+	for stage := 1; stage <= 18; stage++ {
+		p.iteration(stage, 18, 1, 100, "kmeans")
+	}
+	// the clients connecting last get at least the start event and the last event
+	for !p.connected(len(events)) {
+		p.update(18, 18, 10, 10, "dumping")
+	}
+	p.complete(18)
+	close(stop)
+	loaders.Wait()
+	wg.Wait()
+
+	for c, list := range events {
+		if len(list) < 2 || list[0].Event != "start" || list[len(list)-1].Event != "complete" {
+			t.Errorf("client %d: %d events, want the start event first and the complete event last", c, len(list))
+			continue
+		}
+		if list[0].Seed != 42 || list[0].Stages != 18 {
+			t.Errorf("client %d: start event %+v", c, list[0])
+		}
+	}
+}
+
+// connected reports whether the given number of clients listen to the events.
+func (p *progressEvents) connected(clients int) bool {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	return len(p.clients) >= clients
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/neurlang/clusters"
+	"github.com/neurlang/gospeak/codec"
+)
+
+// residualSample is the number of frames sampled per residual codeword to
+// train a residual stage.
+const residualSample = 64
+
+// residualTrainer collects the residuals the exemplars leave of the frames of
+// a band, as the encoder computes them: the frame minus the stored exemplar
+// whose key is nearest to the frame key, in linear magnitudes.
+type residualTrainer struct {
+	exemplars [][]float64 // the exemplars as stored
+	index     *codec.Index
+	sample    *reservoir
+}
+
+func newResidualTrainer(coords [][]LPFloat, files, limit int, seed uint64) *residualTrainer {
+	r := &residualTrainer{
+		exemplars: make([][]float64, len(coords)),
+		sample:    newReservoir(files, limit, seed),
+	}
+	var keys = make([][]float64, len(coords))
+	for codeword, exemplar := range coords {
+		if len(exemplar) == 0 {
+			continue
+		}
+		keys[codeword] = storedKey(exemplar)
+		r.exemplars[codeword] = make([]float64, len(exemplar))
+		for i := range exemplar {
+			r.exemplars[codeword][i] = math.Exp2(exemplar[i].stored())
+		}
+	}
+	r.index = codec.NewIndex(keys)
+	return r
+}
+
+// offer adds the residuals of the frames of a file, given as keys and phase triples.
+func (r *residualTrainer) offer(file int, keys [][]float64, frames [][]LPFloat) {
+	var residuals clusters.Observations
+	for j, key := range keys {
+		codeword, _ := r.index.Nearest(key)
+		if codeword < 0 {
+			continue
+		}
+		var residual = make(clusters.Coordinates, len(frames[j]))
+		for i := range residual {
+			residual[i] = math.Exp2(frames[j][i].Value) - r.exemplars[codeword][i]
+		}
+		residuals = append(residuals, residual)
+	}
+	r.sample.offer(file, residuals)
+}
+
+// train clusters the sampled residuals into the codebooks of the residual
+// stages, every stage on what the stages before leave. Codeword 0 of every
+// stage is the zero residual, so that a stage never takes a frame farther
+// away. cluster partitions the residuals of a stage, 1 being the first
+// residual stage.
+func (r *residualTrainer) train(stages, codewords int, cluster func(stage int, dataset clusters.Observations, k int) clusters.Clusters) [][][]LPFloat {
+	var dataset = r.sample.observations()
+	var codebooks = make([][][]LPFloat, stages-1)
+	for stage := 1; stage < stages; stage++ {
+		codebooks[stage-1] = [][]LPFloat{}
+		if len(dataset) == 0 {
+			continue
+		}
+		k := codewords - 1
+		if k > len(dataset) {
+			k = len(dataset)
+		}
+		before := meanSquare(dataset)
+		clu := cluster(stage, append(clusters.Observations{}, dataset...), k)
+
+		// the codewords as stored, the residual left is what the encoder leaves
+		var width = len(dataset[0].Coordinates())
+		var keys = [][]float64{make([]float64, width)}
+		codebooks[stage-1] = append(codebooks[stage-1], make([]LPFloat, width))
+		for _, c := range clu {
+			var coords = make([]LPFloat, len(c.Center))
+			var key = make([]float64, len(c.Center))
+			for i, v := range c.Center {
+				// linear magnitudes of quiet bins need more digits than log2 exemplars
+				coords[i] = LPFloat{Value: v, Digits: 5}
+				key[i] = coords[i].stored()
+			}
+			codebooks[stage-1] = append(codebooks[stage-1], coords)
+			keys = append(keys, key)
+		}
+		index := codec.NewIndex(keys)
+		for j, observation := range dataset {
+			residual := observation.Coordinates()
+			codeword, _ := index.Nearest(residual)
+			var left = make(clusters.Coordinates, len(residual))
+			for i := range left {
+				left[i] = residual[i] - keys[codeword][i]
+			}
+			dataset[j] = left
+		}
+		fmt.Printf("Residual stage %d distortion: %g to %g\n", stage+1, before, meanSquare(dataset))
+	}
+	return codebooks
+}
+
+// meanSquare returns the mean squared norm of the residuals.
+func meanSquare(dataset clusters.Observations) (sum float64) {
+	if len(dataset) == 0 {
+		return 0
+	}
+	for _, observation := range dataset {
+		for _, v := range observation.Coordinates() {
+			sum += v * v
+		}
+	}
+	return sum / float64(len(dataset))
+}
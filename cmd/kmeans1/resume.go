@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/neurlang/gospeak/codec"
+)
+
+// checkpoint is the content of a centroids<rang>.json file, the codec solved
+// up to band rang.
+type checkpoint struct {
+	Version int
+	codec.Layout
+	// Corpus identifies the list of files the codec was trained on
+	Corpus string
+	// Seed is the random seed which reproduces the codec
+	Seed      uint64
+	Centroids [][][]LPFloat
+	// Exemplars are the alternatives of the codewords kept by --exemplar multi:N
+	Exemplars [][][][]LPFloat `json:",omitempty"`
+	// Residuals are the residual stage codebooks of --stages, indexed by stage, band and codeword
+	Residuals [][][][]LPFloat `json:",omitempty"`
+	// Speakers are the speaker directories of a codebook shared by --speakers
+	Speakers []string `json:",omitempty"`
+	// Parents are the codebook of --adapt and its own parents, whose token
+	// bitstreams the adapted codebook reads
+	Parents []codec.Parent `json:",omitempty"`
+}
+
+// corpusHash identifies the list of corpus files, by their paths relative to the corpus directory.
+func corpusHash(srcDir string, files ...[]string) string {
+	h := sha256.New()
+	for _, list := range files {
+		for _, path := range list {
+			if rel, err := filepath.Rel(srcDir, path); err == nil {
+				path = rel
+			}
+			fmt.Fprintln(h, filepath.ToSlash(path))
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// checkpointPath is the path of the checkpoint of a band.
+func checkpointPath(dstDir string, rang int) string {
+	return dstDir + string(os.PathSeparator) + `centroids` + fmt.Sprint(rang) + `.json`
+}
+
+// latestCheckpoint loads the checkpoint of the most bands which is complete,
+// or returns nil if there is none.
+func latestCheckpoint(dstDir string) *checkpoint {
+	entries, err := os.ReadDir(dstDir)
+	if err != nil {
+		return nil
+	}
+	var best *checkpoint
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, "centroids") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		rang, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, "centroids"), ".json"))
+		if err != nil || (best != nil && rang < len(best.Centroids)) {
+			continue
+		}
+		data, err := os.ReadFile(checkpointPath(dstDir, rang))
+		if err != nil {
+			continue
+		}
+		var cp checkpoint
+		if err := json.Unmarshal(data, &cp); err != nil {
+			fmt.Println("Skipping invalid checkpoint", name+":", err.Error())
+			continue
+		}
+		if !cp.valid(rang) {
+			fmt.Println("Skipping incomplete checkpoint", name)
+			continue
+		}
+		best = &cp
+	}
+	return best
+}
+
+// valid reports whether the checkpoint holds the solved bands 0 to rang.
+func (cp *checkpoint) valid(rang int) bool {
+	if cp.Version != codec.Version || cp.Corpus == "" || len(cp.Centroids) != rang+1 || rang+1 > cp.Bands() {
+		return false
+	}
+	for _, band := range cp.Centroids {
+		if len(band) == 0 {
+			return false
+		}
+	}
+	for _, stage := range cp.Residuals {
+		if len(stage) > len(cp.Centroids) {
+			return false
+		}
+	}
+	return len(cp.Exemplars) <= len(cp.Centroids)
+}
+
+// resumable explains why training of the layout on the corpus can not
+// continue from the checkpoint, or returns nil.
+func (cp *checkpoint) resumable(layout *codec.Layout, corpus string) error {
+	if cp.Corpus != corpus {
+		return fmt.Errorf("the corpus file list changed")
+	}
+	if cp.SampleRate != layout.SampleRate {
+		return fmt.Errorf("the sample rate family changed from %d to %d", cp.SampleRate, layout.SampleRate)
+	}
+	return nil
+}
+
+// writeCheckpoint writes the checkpoint of a band, replacing the file only once it is complete.
+func writeCheckpoint(dstDir string, rang int, data []byte) error {
+	return replaceFile(checkpointPath(dstDir, rang), data)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/neurlang/clusters"
+)
+
+// frameOverhead estimates the memory of a frame besides its values, the
+// slice and interface headers, the sample bookkeeping and the k-means state.
+const frameOverhead = 96
+
+// reservoir collects the frames of a stage. Given a limit, it keeps a uniform
+// sample of the frames: every frame gets a pseudo random priority derived from
+// the seed and its position in the corpus, and the frames of the lowest
+// priorities are kept, so the sample does not depend on the order in which
+// the files are loaded.
+type reservoir struct {
+	mut     sync.Mutex
+	limit   int // maximum number of frames kept, 0 keeps all
+	seed    uint64
+	offered int
+
+	files  []clusters.Observations // all frames per file, without limit
+	sample sampleHeap              // the sample, with limit
+}
+
+func newReservoir(files, limit int, seed uint64) *reservoir {
+	r := &reservoir{limit: limit, seed: seed}
+	if limit == 0 {
+		r.files = make([]clusters.Observations, files)
+	}
+	return r
+}
+
+// offer adds the frames of a file.
+func (r *reservoir) offer(file int, frames clusters.Observations) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.offered += len(frames)
+	if r.limit == 0 {
+		r.files[file] = append(r.files[file], frames...)
+		return
+	}
+	for frame, coords := range frames {
+		s := sampled{priority: mix(r.seed ^ uint64(file)<<32 ^ uint64(frame)), file: file, frame: frame, coords: coords}
+		if len(r.sample) < r.limit {
+			heap.Push(&r.sample, s)
+		} else if s.less(r.sample[0]) {
+			r.sample[0] = s
+			heap.Fix(&r.sample, 0)
+		}
+	}
+}
+
+// observations returns the kept frames in corpus order.
+func (r *reservoir) observations() (dataset clusters.Observations) {
+	if r.limit == 0 {
+		for _, frames := range r.files {
+			dataset = append(dataset, frames...)
+		}
+		return
+	}
+	sort.Slice(r.sample, func(i, j int) bool {
+		if r.sample[i].file != r.sample[j].file {
+			return r.sample[i].file < r.sample[j].file
+		}
+		return r.sample[i].frame < r.sample[j].frame
+	})
+	for _, s := range r.sample {
+		dataset = append(dataset, s.coords)
+	}
+	return
+}
+
+type sampled struct {
+	priority    uint64
+	file, frame int
+	coords      clusters.Observation
+}
+
+func (s sampled) less(t sampled) bool {
+	if s.priority != t.priority {
+		return s.priority < t.priority
+	}
+	if s.file != t.file {
+		return s.file < t.file
+	}
+	return s.frame < t.frame
+}
+
+// sampleHeap is a max-heap of the kept frames, the root being dropped first.
+type sampleHeap []sampled
+
+func (h sampleHeap) Len() int           { return len(h) }
+func (h sampleHeap) Less(i, j int) bool { return h[j].less(h[i]) }
+func (h sampleHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *sampleHeap) Push(x any)        { *h = append(*h, x.(sampled)) }
+func (h *sampleHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// mix is the splitmix64 finalizer.
+func mix(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ x>>30) * 0xbf58476d1ce4e5b9
+	x = (x ^ x>>27) * 0x94d049bb133111eb
+	return x ^ x>>31
+}
+
+// parseBytes parses a memory size such as 512M or 8G.
+func parseBytes(s string) (int64, error) {
+	var unit int64 = 1
+	s = strings.ToUpper(strings.TrimSpace(s))
+	s = strings.TrimSuffix(s, "B")
+	switch {
+	case strings.HasSuffix(s, "K"):
+		unit = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		unit = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		unit = 1 << 30
+	case strings.HasSuffix(s, "T"):
+		unit = 1 << 40
+	}
+	if unit != 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid memory size %q", s)
+	}
+	return int64(n * float64(unit)), nil
+}
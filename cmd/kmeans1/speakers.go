@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/neurlang/clusters"
+)
+
+// speakersPath is the path of the speaker report of --speakers.
+func speakersPath(dstDir string) string {
+	return filepath.Join(dstDir, "speakers.json")
+}
+
+// speakers assigns the corpus files to the speakers of a multi-speaker
+// corpus, the subdirectories of the corpus directory.
+type speakers struct {
+	names []string
+	of    []int // the speaker of every file
+}
+
+// newSpeakers assigns every file to the speaker directory it is in, or all
+// the files to a single speaker unless multi is set.
+func newSpeakers(srcDir string, multi bool, files ...[]string) (*speakers, error) {
+	var s = &speakers{}
+	var index = make(map[string]int)
+	for _, list := range files {
+		for _, path := range list {
+			var name string
+			if multi {
+				rel, err := filepath.Rel(srcDir, path)
+				if err != nil {
+					return nil, err
+				}
+				parts := strings.SplitN(filepath.ToSlash(rel), "/", 2)
+				if len(parts) < 2 {
+					return nil, fmt.Errorf("%s is not in a speaker directory", rel)
+				}
+				name = parts[0]
+			}
+			speaker, ok := index[name]
+			if !ok {
+				speaker = len(s.names)
+				index[name] = speaker
+				s.names = append(s.names, name)
+			}
+			s.of = append(s.of, speaker)
+		}
+	}
+	return s, nil
+}
+
+// multi reports whether the corpus has more than one speaker.
+func (s *speakers) multi() bool {
+	return len(s.names) > 1
+}
+
+// sample returns a reservoir per speaker, sharing the limit.
+func (s *speakers) sample(files, limit int, seed uint64) []*reservoir {
+	var samples = make([]*reservoir, len(s.names))
+	for speaker := range samples {
+		share := limit
+		if limit > 0 {
+			share = (limit + len(samples) - 1) / len(samples)
+		}
+		samples[speaker] = newReservoir(files, share, seed)
+	}
+	return samples
+}
+
+// offer adds the frames of a file to the sample of its speaker.
+func (s *speakers) offer(samples []*reservoir, file int, frames clusters.Observations) {
+	samples[s.of[file]].offer(file, frames)
+}
+
+// balance merges the samples of the speakers, every speaker having frames
+// contributing the mean number of frames of the speakers: the frames of the
+// larger speakers are sampled, those of the smaller ones repeated. It returns
+// the frames and the number of frames offered.
+func (s *speakers) balance(samples []*reservoir, seed uint64) (dataset clusters.Observations, offered int) {
+	var observations = make([]clusters.Observations, len(samples))
+	var total, present int
+	for speaker, sample := range samples {
+		observations[speaker] = sample.observations()
+		offered += sample.offered
+		if len(observations[speaker]) > 0 {
+			total += len(observations[speaker])
+			present++
+		}
+	}
+	if len(samples) == 1 {
+		return observations[0], offered
+	}
+	if present == 0 {
+		return nil, offered
+	}
+	share := total / present
+	for speaker, frames := range observations {
+		if len(frames) == 0 {
+			continue
+		}
+		if len(frames) > share {
+			sample := newReservoir(1, share, mix(seed^uint64(speaker)))
+			sample.offer(0, frames)
+			frames = sample.observations()
+		}
+		for i := 0; i < share; i++ {
+			dataset = append(dataset, frames[i%len(frames)])
+		}
+	}
+	return dataset, offered
+}
+
+// speakerUsage is the distortion and the codeword usage of a speaker in a band.
+type speakerUsage struct {
+	Speaker    string
+	Distortion distortion
+	// Codewords is the number of codewords the frames of the speaker fall in
+	Codewords int
+	// Shared is the number of these codewords other speakers use too
+	Shared int
+	// Overlap is the fraction of the frames of the speaker in shared codewords
+	Overlap float64
+}
+
+// speakerBand is the usage of the codewords of a band by the speakers.
+type speakerBand struct {
+	Band      int
+	Codewords int
+	// Common is the number of codewords every speaker uses
+	Common   int
+	Speakers []speakerUsage
+}
+
+// speakerReport is the content of speakers.json.
+type speakerReport struct {
+	Speakers []string
+	Bands    []speakerBand
+}
+
+// loadSpeakerReport loads the report of an interrupted run of the same
+// speakers, keeping its bands below rang, or starts a new report.
+func loadSpeakerReport(dstDir string, names []string, rang int) *speakerReport {
+	var report speakerReport
+	if data, err := os.ReadFile(speakersPath(dstDir)); err == nil && json.Unmarshal(data, &report) == nil &&
+		fmt.Sprint(report.Speakers) == fmt.Sprint(names) {
+		var bands []speakerBand
+		for _, band := range report.Bands {
+			if band.Band < rang {
+				bands = append(bands, band)
+			}
+		}
+		report.Bands = bands
+		return &report
+	}
+	return &speakerReport{Speakers: names}
+}
+
+// measure summarises the distortion and the codeword usage of every speaker
+// in the trained files, prints them and adds them to the report.
+func (s *speakers) measure(report *speakerReport, rang, codewords int, measured *distortions, held []bool) {
+	var band = speakerBand{Band: rang, Codewords: codewords}
+	var counts = make([][]int, len(s.names))
+	for speaker := range counts {
+		counts[speaker] = make([]int, codewords)
+	}
+	for file, fileCodewords := range measured.codewords {
+		if held[file] {
+			continue
+		}
+		for _, codeword := range fileCodewords {
+			if codeword >= 0 {
+				counts[s.of[file]][codeword]++
+			}
+		}
+	}
+	var users = make([]int, codewords)
+	for _, speakerCounts := range counts {
+		for codeword, count := range speakerCounts {
+			if count > 0 {
+				users[codeword]++
+			}
+		}
+	}
+	for codeword := range users {
+		if users[codeword] == len(s.names) {
+			band.Common++
+		}
+	}
+	for speaker, name := range s.names {
+		usage := speakerUsage{
+			Speaker: name,
+			Distortion: measured.summarize(func(file int) bool {
+				return !held[file] && s.of[file] == speaker
+			}),
+		}
+		var shared int
+		for codeword, count := range counts[speaker] {
+			if count == 0 {
+				continue
+			}
+			usage.Codewords++
+			if users[codeword] > 1 {
+				usage.Shared++
+				shared += count
+			}
+		}
+		if usage.Distortion.Frames > 0 {
+			usage.Overlap = float64(shared) / float64(usage.Distortion.Frames)
+		}
+		fmt.Printf("Speaker %s distortion: %v, codewords %d, shared %d, overlap %.1f%%\n",
+			name, usage.Distortion, usage.Codewords, usage.Shared, 100*usage.Overlap)
+		band.Speakers = append(band.Speakers, usage)
+	}
+	fmt.Println("Common codewords:", band.Common, "of", codewords)
+	report.Bands = append(report.Bands, band)
+}
+
+// write replaces the report file once it is complete.
+func (r *speakerReport) write(dstDir string) error {
+	return writeJSONFile(speakersPath(dstDir), r)
+}
@@ -0,0 +1,596 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync/atomic"
+
+	"github.com/neurlang/classifier/parallel"
+	"github.com/neurlang/clusters"
+	"github.com/neurlang/gospeak/codec"
+)
+
+// trainer trains the codebook band by band. Every band takes 2*chunks+2
+// stages: the loading and the kmeans of every chunk, the final clustering and
+// the dumping of the exemplars.
+type trainer struct {
+	srcDir, dstDir, cacheDir string
+	threads                  int
+	seed                     uint64
+	algo                     string
+	// maxMem is the memory budget of the frames in bytes, 0 unlimited
+	maxMem      int64
+	checkpoints int
+
+	silenceThreshold float64
+	trimSilence      bool
+	silenceCodewords int
+	exemplarStrategy string
+	exemplarCount    int
+	farThreshold     float64
+	// residualStages are the quantisation stages per band, of residualCodewords codewords
+	residualStages    int
+	residualCodewords int
+
+	// execute is run after every stage, after every progress update too with execDetailed
+	execute      string
+	executedbg   bool
+	execDetailed bool
+
+	layout codec.Layout
+	// files are the corpus files, paths them relative to srcDir as the workers find them
+	files    []string
+	paths    []string
+	held     []bool // the held out files are only measured, the chunks split the other files
+	spk      *speakers
+	features *featureCache
+	pool     *workerPool
+	adapt    *adapter
+
+	validation   *validationReport
+	speakerStats *speakerReport
+
+	chunks, kmeanz, masterkmeanz int
+
+	file checkpoint
+}
+
+// stages returns the number of stages of the run.
+func (t *trainer) stages() int {
+	return (2*t.chunks + 2) * t.layout.Bands()
+}
+
+// loadingStage and kmeansStage return the stages of a chunk of the band,
+// finalStage and dumpingStage the last two stages of the band.
+func (t *trainer) loadingStage(rang, chunk int) int { return (2*t.chunks+2)*rang + 2*chunk + 1 }
+func (t *trainer) kmeansStage(rang, chunk int) int  { return (2*t.chunks+2)*rang + 2*chunk + 2 }
+func (t *trainer) finalStage(rang int) int          { return (2*t.chunks+2)*rang + 2*t.chunks + 1 }
+func (t *trainer) dumpingStage(rang int) int        { return (2*t.chunks+2)*rang + 2*t.chunks + 2 }
+
+// report shows the progress of the stage.
+func (t *trainer) report(stage int, pos, max uint64, status string) {
+	progressbar(stage, t.stages(), pos, max, status)
+}
+
+// executed runs the --execute command after the stage.
+func (t *trainer) executed(stage int, status string) {
+	if t.execute != "" {
+		command(t.execute, stage, t.stages(), false, t.executedbg, 96, status)
+	}
+}
+
+// done shows the stage complete and runs the --execute command.
+func (t *trainer) done(stage int, status string) {
+	t.report(stage, 1, 1, status)
+	t.executed(stage, status)
+}
+
+// plotter returns the plotter of the k-means iterations of the stage.
+func (t *trainer) plotter(stage int, status string) *plotter {
+	return &plotter{
+		stage:        stage,
+		stages:       t.stages(),
+		del:          0.05,
+		execString:   t.execute,
+		executedbg:   t.executedbg,
+		execDetailed: t.execDetailed,
+		msg:          status,
+	}
+}
+
+// frameLimit returns the number of frames of the band of the given size per
+// frequency fitting --max-mem, 0 when unlimited.
+func (t *trainer) frameLimit(rang, size int) int {
+	if t.maxMem <= 0 {
+		return 0
+	}
+	return int(t.maxMem / int64(size*(t.layout.Ranges[rang+1]-t.layout.Ranges[rang])+frameOverhead))
+}
+
+// read reads the frames of a band of every file, as keys and as phase triples
+func (t *trainer) read(rang int, visit func(i int, keys [][]float64, frames [][]LPFloat), done func()) {
+	var ranges = t.layout.Ranges
+	var numFreqs = t.layout.NumFreqs
+	parallel.ForEach(len(t.files), t.threads, func(i int) {
+		// Load the mel spectrogram (returns [][3]float64 where each element is [m.NumFreqs]float64 for sine and cosine and real)
+		var melFrames = t.features.frames(t.files[i])
+
+		var keys [][]float64
+		var frames [][]LPFloat
+		for j := 0; j+numFreqs <= len(melFrames); j += numFreqs {
+			// Convert [m.NumFreqs][3]float64 to a flat []float64 (1152 dimensions)
+			var coords []LPFloat
+			for i := ranges[rang]; i < ranges[rang+1]; i++ {
+				coords = append(coords, LPFloat{Value: melFrames[j+i][0], Digits: 3}) // first component
+				coords = append(coords, LPFloat{Value: melFrames[j+i][1], Digits: 3}) // second component
+				coords = append(coords, LPFloat{Value: melFrames[j+i][2], Digits: 3}) // third component
+			}
+			keys = append(keys, verifyFloats(codec.BandKey(melFrames[j+ranges[rang]:j+ranges[rang+1]])))
+			frames = append(frames, coords)
+		}
+		visit(i, keys, frames)
+		done()
+	})
+}
+
+// train trains the bands of the codebook left.
+func (t *trainer) train() {
+	for rang := len(t.file.Centroids); rang < t.layout.Bands(); rang++ {
+		t.file.Centroids = append(t.file.Centroids, nil)
+		if t.adapt.adapts(rang) {
+			// adapt the band of the codebook instead of clustering from scratch
+			t.adaptBand(rang)
+		} else {
+			t.trainBand(rang)
+		}
+	}
+}
+
+// trainBand clusters the chunks of the band, clusters their centers into the
+// codewords and dumps the exemplars.
+func (t *trainer) trainBand(rang int) {
+	// the codebook size of the band, the chunks yield enough centers for it
+	var bandKmeanz, bandMasterkmeanz = t.kmeanz, t.masterkmeanz
+	if t.layout.BandBits != nil {
+		bandMasterkmeanz = bandSize(t.layout.BandBits[rang])
+		if per := (bandMasterkmeanz + t.chunks - 1) / t.chunks; per > bandKmeanz {
+			bandKmeanz = per
+		}
+	}
+	master, silence := t.clusterChunks(rang, bandKmeanz)
+
+	var rng = stageRand(t.seed, rang, t.chunks)
+	ShuffleSlice(rng, master)
+	t.report(t.kmeansStage(rang, t.chunks-1), 1, 1, "kmeans")
+	fmt.Println()
+	var silencekmeanz = t.silenceCodewords
+	if len(silence) < silencekmeanz {
+		silencekmeanz = len(silence)
+	}
+	if silencekmeanz < 0 {
+		silencekmeanz = 0
+	}
+	var speechkmeanz = bandMasterkmeanz - silencekmeanz
+	if speechkmeanz > len(master) {
+		println("Codewords limited by the corpus:", len(master)+silencekmeanz, "of", bandMasterkmeanz)
+		speechkmeanz = len(master)
+	}
+	var final = t.finalStage(rang)
+	t.report(final, 0, 1, "final")
+
+	// 4. Run master K-means clustering
+	km := newLloyd(t.algo, 0.05, t.plotter(final, "final"), t.threads, rng)
+	clu, err := km.Partition(master, speechkmeanz)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println()
+	fmt.Println("Distortion:", km.Distortion)
+
+	sort.SliceStable(clu, func(i, j int) bool {
+		return len(clu[i].Observations) > len(clu[j].Observations)
+	})
+
+	// the silence codewords follow the speech codewords
+	if silencekmeanz > 0 {
+		silenceClu, err := newLloyd(t.algo, 0.05, nil, t.threads, rng).Partition(silence, silencekmeanz)
+		if err != nil {
+			panic(err)
+		}
+		clu = append(clu, silenceClu...)
+	}
+
+	// 5. Init cluster info
+	var centers = make([]clusters.Coordinates, len(clu))
+	for codeword := range clu {
+		centers[codeword] = clu[codeword].Center
+	}
+	t.done(final, "final")
+	fmt.Println()
+
+	// 6. convert wavs to codewords
+	var means = t.exemplarStrategy == exemplarMedoid || t.exemplarStrategy == exemplarMean
+	stats, nearest, measured := t.dump(rang, centers, centers, means, t.exemplarCount)
+	var coords = make([][]LPFloat, len(centers))
+	var alternatives [][][]LPFloat
+	if t.exemplarStrategy == exemplarMulti {
+		alternatives = make([][][]LPFloat, len(centers))
+	}
+	for codeword, best := range nearest.best {
+		coords[codeword] = []LPFloat{}
+		if len(best) == 0 {
+			continue
+		}
+		coords[codeword] = best[0].coords
+		if t.exemplarStrategy == exemplarMean {
+			coords[codeword] = stats.rescale(codeword, best[0].coords)
+		}
+		if alternatives != nil {
+			alternatives[codeword] = [][]LPFloat{}
+			for _, x := range best[1:] {
+				alternatives[codeword] = append(alternatives[codeword], x.coords)
+			}
+		}
+	}
+	t.solved(rang, centers, stats.counts, coords, alternatives, centers, measured)
+}
+
+// adaptBand adapts a band of the codebook of --adapt: the frames near the
+// codewords refine their exemplars, the novel frames are clustered into
+// appended codewords
+func (t *trainer) adaptBand(rang int) {
+	var files = len(t.files)
+	var loading = t.loadingStage(rang, 0)
+	var loaded atomic.Uint64
+	progressLoading := func() {
+		t.report(loading, loaded.Add(1), uint64(2*files), "loading")
+	}
+	fmt.Println()
+
+	// 2. Measure the distance of the frames to their nearest codeword
+	var old = t.adapt.keys(rang)
+	var near = newClusterStats(old, true)
+	var before = newDistortions(near.index, files)
+	t.read(rang, func(i int, keys [][]float64, frames [][]LPFloat) {
+		if !t.held[i] {
+			before.update(i, keys)
+		}
+	}, progressLoading)
+	var threshold = t.adapt.threshold(before, t.held)
+
+	// the frames farther than the threshold are novel, the others refine their codeword
+	var novel = newReservoir(files, t.frameLimit(rang, 16), mix(t.seed^uint64(rang)<<32))
+	t.read(rang, func(i int, keys [][]float64, frames [][]LPFloat) {
+		var known [][]float64
+		var far clusters.Observations
+		for j := 0; !t.held[i] && j < len(keys); j++ {
+			if before.files[i][j] > threshold {
+				far = append(far, clusters.Coordinates(keys[j]))
+			} else {
+				known = append(known, keys[j])
+			}
+		}
+		near.update(i, known)
+		novel.offer(i, far)
+	}, progressLoading)
+	t.done(loading, "loading")
+	fmt.Println()
+
+	// 3. Cluster the novel frames into the appended codewords
+	var dataset = novel.observations()
+	var k = t.adapt.append(novel.offered)
+	if k > len(dataset) {
+		k = len(dataset)
+	}
+	var centers = append([]clusters.Coordinates{}, old...)
+	var targets = near.means(old)
+	var final = t.finalStage(rang)
+	t.report(final, 0, 1, "final")
+	if k > 0 {
+		var rng = stageRand(t.seed, rang, t.chunks)
+		ShuffleSlice(rng, dataset)
+		clu, err := newLloyd(t.algo, 0.05, t.plotter(final, "final"), t.threads, rng).Partition(dataset, k)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println()
+		sort.SliceStable(clu, func(i, j int) bool {
+			return len(clu[i].Observations) > len(clu[j].Observations)
+		})
+		for _, c := range clu {
+			centers = append(centers, c.Center)
+			targets = append(targets, c.Center)
+		}
+	}
+	t.done(final, "final")
+	fmt.Println()
+
+	// 4. Choose the exemplars nearest to the refined centers
+	stats, nearest, measured := t.dump(rang, centers, targets, false, 1)
+	var coords = make([][]LPFloat, len(centers))
+	var alternatives = make([][][]LPFloat, len(centers))
+	band := t.adapt.refine(rang, targets, stats.counts, nearest, coords, alternatives)
+	band.Novel = novel.offered
+	if rang >= len(t.adapt.base.Exemplars) {
+		alternatives = nil
+	}
+	if err := t.adapt.record(band, t.dstDir); err != nil {
+		panic(err)
+	}
+	t.solved(rang, targets, stats.counts, coords, alternatives, centers, measured)
+}
+
+// dump reads the frames of the band, counting the frames of the codewords
+// of the centers and measuring their distortion, and collects the count
+// exemplars nearest to the targets. With means set, the exemplars are the
+// medoids instead, the frames nearest to the mean of their cluster.
+func (t *trainer) dump(rang int, centers, targets []clusters.Coordinates, means bool, count int) (*clusterStats, *exemplars, *distortions) {
+	var stats = newClusterStats(centers, means)
+	var nearest = newExemplars(targets, count, nil)
+	var measured *distortions
+	if t.validation != nil || t.speakerStats != nil {
+		measured = newDistortions(stats.index, len(t.files))
+	}
+	var passes = 1
+	if means {
+		passes = 2
+	}
+	var dumping = t.dumpingStage(rang)
+	var dumped atomic.Uint64
+	t.report(dumping, 0, 1, "dumping")
+	dump := func(visit func(i int, keys [][]float64, frames [][]LPFloat)) {
+		t.read(rang, visit, func() {
+			t.report(dumping, dumped.Add(1), uint64(passes*len(t.files)), "dumping")
+		})
+	}
+	dump(func(i int, keys [][]float64, frames [][]LPFloat) {
+		if measured != nil {
+			measured.update(i, keys)
+		}
+		if t.held[i] {
+			// the held out files stay unseen
+			stats.update(i, nil)
+			return
+		}
+		stats.update(i, keys)
+		if !means {
+			nearest.update(i, keys, frames)
+		}
+	})
+	if means {
+		// the medoid is the frame of the cluster nearest to the mean of its frames
+		nearest = newExemplars(stats.means(centers), 1, stats.index)
+		dump(func(i int, keys [][]float64, frames [][]LPFloat) {
+			if !t.held[i] {
+				nearest.update(i, keys, frames)
+			}
+		})
+	}
+	t.report(dumping, 1, 1, "dumping")
+	fmt.Println()
+	return stats, nearest, measured
+}
+
+// chunkJob prepares the clustering of the frames of a chunk of the band into
+// k centers, file by file so that the order is reproducible.
+func (t *trainer) chunkJob(rang, chunk, k int) *chunkJob {
+	var job = &chunkJob{
+		Layout:           t.layout,
+		Band:             rang,
+		Chunk:            chunk,
+		Seed:             t.seed,
+		SrcDir:           t.srcDir,
+		FileCount:        len(t.held),
+		Speakers:         t.spk.of,
+		SpeakerCount:     len(t.spk.names),
+		K:                k,
+		Kmeanz:           t.kmeanz,
+		Algo:             t.algo,
+		SilenceThreshold: t.silenceThreshold,
+		TrimSilence:      t.trimSilence,
+		Cache:            t.cacheDir != "",
+		Limit:            t.frameLimit(rang, 16),
+	}
+	if t.maxMem > 0 && job.Limit < k {
+		job.Limit = k
+	}
+	for i := chunk; i < len(t.held); i += t.chunks {
+		if !t.held[i] {
+			job.Files = append(job.Files, i)
+			job.Paths = append(job.Paths, t.paths[i])
+		}
+	}
+	return job
+}
+
+// clusterChunks clusters the chunks of the band into k centers each, on the
+// workers if any, and returns the centers of the chunks and a sample of the
+// discarded silence.
+func (t *trainer) clusterChunks(rang, k int) (master, silence clusters.Observations) {
+	// the chunks clustered by the workers
+	var remote []*chunkResult
+	if t.pool != nil {
+		var jobs = make([]*chunkJob, t.chunks)
+		for chunk := range jobs {
+			jobs[chunk] = t.chunkJob(rang, chunk, k)
+		}
+		fmt.Println()
+		remote = t.pool.run(jobs, func(job *chunkJob) *chunkResult {
+			result, err := job.run(t.srcDir, t.cacheDir, t.threads)
+			if err != nil {
+				panic(err)
+			}
+			return result
+		}, func(job *chunkJob, result *chunkResult, worker string) {
+			t.report(t.loadingStage(rang, job.Chunk), 1, 1, "loading")
+			t.report(t.kmeansStage(rang, job.Chunk), 1, 1, "kmeans")
+			if worker != "" {
+				fmt.Print("by ", worker)
+			}
+			fmt.Println()
+			t.executed(t.kmeansStage(rang, job.Chunk), "kmeans")
+		})
+	}
+	for chunk := 0; chunk < t.chunks; chunk++ {
+		// 2. Prepare dataset for K-means
+		var job = t.chunkJob(rang, chunk, k)
+		var dataset clusters.Observations
+		var result *chunkResult
+		if remote != nil {
+			result = remote[chunk]
+		} else {
+			fmt.Println()
+			var loading = t.loadingStage(rang, chunk)
+			var loaded atomic.Uint64
+			var files = uint64(len(t.files))
+			dataset, result = job.load(t.features, t.srcDir, t.threads, func() {
+				// every chunk holds about a chunks-th of the files
+				if pos := loaded.Add(uint64(t.chunks)); pos < files {
+					t.report(loading, pos, files, "loading")
+				} else {
+					t.report(loading, 1, 1, "loading")
+				}
+			})
+			t.done(loading, "loading")
+			fmt.Println()
+		}
+
+		if t.silenceThreshold > 0 && result.Total > 0 {
+			println("Silence discarded:", result.Discarded*100/result.Total, "%")
+			for _, coords := range result.Silence {
+				silence = append(silence, clusters.Coordinates(coords))
+			}
+			// keep a bounded sample of the silence for its codewords
+			if len(silence) > silenceSample {
+				ShuffleSlice(stageRand(^t.seed, rang, chunk), silence)
+				silence = silence[:silenceSample]
+			}
+		}
+		if result.Offered != result.Clustered {
+			println("Frames clustered:", result.Clustered, "of", result.Offered)
+		} else {
+			println("Frames clustered:", result.Clustered)
+		}
+		if result.Clustered == 0 {
+			println("No frames to cluster in chunk", chunk)
+			continue
+		}
+
+		if remote == nil {
+			var kmeans = t.kmeansStage(rang, chunk)
+			t.report(kmeans, 0, 1, "kmeans")
+			// 3. Run K-means clustering
+			if err := job.cluster(dataset, result, t.threads, t.plotter(kmeans, "kmeans")); err != nil {
+				panic(err)
+			}
+			fmt.Println()
+		}
+		fmt.Println("Distortion:", result.Distortion)
+
+		for _, center := range result.Centers {
+			master = append(master, clusters.Coordinates(center))
+		}
+		if remote == nil {
+			t.done(t.kmeansStage(rang, chunk), "kmeans")
+		}
+	}
+	return master, silence
+}
+
+// trainResiduals trains the residual stage codebooks of a band on the
+// residuals its exemplars leave of the frames
+func (t *trainer) trainResiduals(rang int, coords [][]LPFloat) {
+	if t.residualStages <= 1 {
+		return
+	}
+	var dumping = t.dumpingStage(rang)
+	var limit = residualSample * t.residualCodewords
+	if budget := t.frameLimit(rang, 24); t.maxMem > 0 && budget < limit {
+		limit = budget
+	}
+	var residuals = newResidualTrainer(coords, len(t.held), limit, ^mix(t.seed^uint64(rang)<<32))
+	var residual_progress atomic.Uint64
+	t.read(rang, func(i int, keys [][]float64, frames [][]LPFloat) {
+		if !t.held[i] {
+			residuals.offer(i, keys, frames)
+		}
+	}, func() {
+		t.report(dumping, residual_progress.Add(1), uint64(len(t.held)), "residual")
+	})
+	fmt.Println()
+	codebooks := residuals.train(t.residualStages, t.residualCodewords, func(s int, dataset clusters.Observations, k int) clusters.Clusters {
+		var rng = stageRand(t.seed, rang, t.chunks+s)
+		ShuffleSlice(rng, dataset)
+		clu, err := newLloyd(t.algo, 0.05, t.plotter(dumping, "residual"), t.threads, rng).Partition(dataset, k)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println()
+		return clu
+	})
+	for s, codebook := range codebooks {
+		if len(t.file.Residuals) <= s {
+			t.file.Residuals = append(t.file.Residuals, nil)
+		}
+		for len(t.file.Residuals[s]) < rang {
+			t.file.Residuals[s] = append(t.file.Residuals[s], [][]LPFloat{})
+		}
+		t.file.Residuals[s] = append(t.file.Residuals[s][:rang], codebook)
+	}
+}
+
+// solved reports the exemplars far from the targets, trains the residuals,
+// stores the exemplars of a band, reports its validation distortion and
+// writes its checkpoint
+func (t *trainer) solved(rang int, targets []clusters.Coordinates, counts []int, coords [][]LPFloat, alternatives [][][]LPFloat, centers []clusters.Coordinates, measured *distortions) {
+	reportFar(targets, counts, coords, t.farThreshold)
+	t.trainResiduals(rang, coords)
+	t.file.Centroids[rang] = coords
+	if alternatives != nil {
+		for len(t.file.Exemplars) < rang {
+			t.file.Exemplars = append(t.file.Exemplars, [][][]LPFloat{})
+		}
+		t.file.Exemplars = append(t.file.Exemplars[:rang], alternatives)
+	}
+	if t.validation != nil {
+		band := bandValidation{
+			Band:       rang,
+			Codewords:  len(centers),
+			Train:      measured.summary(t.held, false),
+			Validation: measured.summary(t.held, true),
+		}
+		if band.Train.Mean > 0 {
+			band.Ratio = band.Validation.Mean / band.Train.Mean
+		}
+		fmt.Println("Train distortion:", band.Train)
+		fmt.Println("Validation distortion:", band.Validation)
+		fmt.Printf("Validation ratio: %.3f\n", band.Ratio)
+		t.validation.Bands = append(t.validation.Bands, band)
+		if err := t.validation.write(t.dstDir); err != nil {
+			panic(err)
+		}
+	}
+	if t.speakerStats != nil {
+		t.spk.measure(t.speakerStats, rang, len(centers), measured, t.held)
+		if err := t.speakerStats.write(t.dstDir); err != nil {
+			panic(err)
+		}
+	}
+	// Output to file
+	data, err := json.Marshal(t.file)
+	if err != nil {
+		panic(err)
+	}
+	data = bytes.ReplaceAll(data, []byte(`],`), []byte("],\n"))
+	if err := writeCheckpoint(t.dstDir, rang, data); err != nil {
+		panic(err)
+	}
+	progress.checkpoint(t.dumpingStage(rang), t.stages(), checkpointPath(t.dstDir, rang))
+	// Clean up old checkpoint if needed
+	if rang-t.checkpoints >= 0 {
+		os.Remove(checkpointPath(t.dstDir, rang-t.checkpoints))
+	}
+}
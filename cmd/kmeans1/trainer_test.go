@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/neurlang/gomel/phase"
+	"github.com/neurlang/gospeak/codec"
+)
+
+// testCorpus writes a corpus of synthetic speech of the given number of files
+// and returns its directory and the files relative to it.
+func testCorpus(t *testing.T, files int) (string, []string) {
+	dir := t.TempDir()
+	rng := rand.New(rand.NewSource(25))
+	var paths []string
+	for i := 0; i < files; i++ {
+		var audio = make([]float64, 24000)
+		pitch := 100 + 200*rng.Float64()
+		for n := range audio {
+			time := float64(n) / 48000
+			for h := 1; h <= 4; h++ {
+				audio[n] += 0.1 / float64(h) * math.Sin(2*math.Pi*pitch*float64(h)*time)
+			}
+			audio[n] += 0.01 * rng.NormFloat64()
+		}
+		path := fmt.Sprintf("%d.wav", i)
+		if err := phase.SaveWav(filepath.Join(dir, path), audio, 48000); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	return dir, paths
+}
+
+// testTrainer returns a trainer of a codebook of three bands of a synthetic
+// corpus, a fifth of the files held out.
+func testTrainer(t *testing.T, dir string, paths []string, threads int) *trainer {
+	layout, err := codec.LayoutFor(48000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := layout.SetBands("3"); err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	for _, path := range paths {
+		files = append(files, filepath.Join(dir, path))
+	}
+	spk, err := newSpeakers(dir, false, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	features, err := newFeatureCache("", &layout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tr = &trainer{
+		srcDir:            dir,
+		dstDir:            t.TempDir(),
+		threads:           threads,
+		seed:              12,
+		algo:              algoLloyd,
+		checkpoints:       8,
+		silenceThreshold:  30,
+		silenceCodewords:  2,
+		exemplarStrategy:  exemplarMedoid,
+		exemplarCount:     1,
+		farThreshold:      6,
+		residualStages:    2,
+		residualCodewords: 7,
+		layout:            layout,
+		files:             files,
+		paths:             paths,
+		held:              heldOut(len(files), 0.2, 12),
+		spk:               spk,
+		features:          features,
+		chunks:            2,
+		kmeanz:            16,
+		masterkmeanz:      31,
+	}
+	tr.file.Layout = layout
+	tr.file.Seed = tr.seed
+	return tr
+}
+
+func TestTrainerThreadsDeterministic(t *testing.T) {
+	dir, paths := testCorpus(t, 10)
+	var runs []*trainer
+	for _, threads := range []int{1, 8} {
+		tr := testTrainer(t, dir, paths, threads)
+		tr.train()
+		runs = append(runs, tr)
+	}
+	one, eight := runs[0].file, runs[1].file
+	if len(one.Centroids) != 3 || len(one.Residuals) != 1 {
+		t.Fatalf("%d bands and %d residual stages, want 3 and 1", len(one.Centroids), len(one.Residuals))
+	}
+	for rang := range one.Centroids {
+		if len(one.Centroids[rang]) < 2 {
+			t.Errorf("band %d: %d codewords", rang, len(one.Centroids[rang]))
+		}
+	}
+	if !reflect.DeepEqual(one.Centroids, eight.Centroids) {
+		t.Error("the centroids of 1 and 8 threads differ")
+	}
+	if !reflect.DeepEqual(one.Residuals, eight.Residuals) {
+		t.Error("the residuals of 1 and 8 threads differ")
+	}
+}
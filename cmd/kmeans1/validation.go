@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/neurlang/gospeak/codec"
+)
+
+// validationPath is the path of the validation report of --validation-split.
+func validationPath(dstDir string) string {
+	return filepath.Join(dstDir, "validation.json")
+}
+
+// heldOut chooses the files kept out of clustering, the given fraction of
+// the files of the lowest pseudo random priority derived from the seed. At
+// least one file is held out of a positive split and one file is trained on.
+func heldOut(files int, split float64, seed uint64) []bool {
+	var held = make([]bool, files)
+	n := int(split*float64(files) + 0.5)
+	if n == 0 && split > 0 {
+		n = 1
+	}
+	if n > files-1 {
+		n = files - 1
+	}
+	if n <= 0 {
+		return held
+	}
+	var order = make([]int, files)
+	var priority = make([]uint64, files)
+	for i := range order {
+		order[i] = i
+		priority[i] = mix(^seed ^ uint64(i))
+	}
+	sort.Slice(order, func(i, j int) bool { return priority[order[i]] < priority[order[j]] })
+	for _, i := range order[:n] {
+		held[i] = true
+	}
+	return held
+}
+
+// distortion is the quantisation distortion of a set of frames, the squared
+// distance of every frame to the nearest cluster center in the feature space
+// of the band.
+type distortion struct {
+	Frames int
+	Mean   float64
+	P50    float64
+	P90    float64
+	P99    float64
+	Max    float64
+}
+
+// bandValidation is the distortion of the training and held out frames of a band.
+type bandValidation struct {
+	Band      int
+	Codewords int
+	Train     distortion
+	// Validation is the distortion of the frames of the held out files
+	Validation distortion
+	// Ratio is the mean validation distortion relative to the mean training
+	// distortion, growing beyond 1 as the codebook overfits
+	Ratio float64
+}
+
+// validationReport is the content of validation.json.
+type validationReport struct {
+	Split   float64
+	Seed    uint64
+	Quality int
+	// Files are the held out files, relative to the corpus directory
+	Files []string
+	Bands []bandValidation
+}
+
+// loadValidation loads the report of an interrupted run of the same split
+// and seed, keeping its bands below rang, or starts a new report.
+func loadValidation(dstDir string, split float64, seed uint64, quality, rang int) *validationReport {
+	var report validationReport
+	if data, err := os.ReadFile(validationPath(dstDir)); err == nil && json.Unmarshal(data, &report) == nil &&
+		report.Split == split && report.Seed == seed && report.Quality == quality {
+		var bands []bandValidation
+		for _, band := range report.Bands {
+			if band.Band < rang {
+				bands = append(bands, band)
+			}
+		}
+		report.Bands = bands
+		return &report
+	}
+	return &validationReport{Split: split, Seed: seed, Quality: quality}
+}
+
+// write replaces the report file once it is complete.
+func (r *validationReport) write(dstDir string) error {
+	return writeJSONFile(validationPath(dstDir), r)
+}
+
+// distortions collects the distortion and the nearest cluster of every frame
+// per file, so that the summaries do not depend on the order the files come in.
+type distortions struct {
+	mut       sync.Mutex
+	index     *codec.Index
+	files     [][]float64
+	codewords [][]int
+}
+
+func newDistortions(index *codec.Index, files int) *distortions {
+	return &distortions{index: index, files: make([][]float64, files), codewords: make([][]int, files)}
+}
+
+// update measures the frames of the file with the given index.
+func (d *distortions) update(file int, keys [][]float64) {
+	var dists = make([]float64, len(keys))
+	var codewords = make([]int, len(keys))
+	for j, key := range keys {
+		codewords[j], dists[j] = d.index.Nearest(key)
+	}
+	d.mut.Lock()
+	d.files[file] = dists
+	d.codewords[file] = codewords
+	d.mut.Unlock()
+}
+
+// summary summarises the frames of the files selected by held.
+func (d *distortions) summary(held []bool, selected bool) distortion {
+	return d.summarize(func(file int) bool { return held[file] == selected })
+}
+
+// summarize summarises the frames of the files for which include is true.
+func (d *distortions) summarize(include func(file int) bool) (s distortion) {
+	var dists []float64
+	for file, fileDists := range d.files {
+		if include(file) {
+			dists = append(dists, fileDists...)
+		}
+	}
+	s.Frames = len(dists)
+	if len(dists) == 0 {
+		return
+	}
+	for _, dist := range dists {
+		s.Mean += dist
+	}
+	s.Mean /= float64(len(dists))
+	sort.Float64s(dists)
+	percentile := func(p float64) float64 {
+		return dists[int(math.Ceil(p*float64(len(dists))))-1]
+	}
+	s.P50, s.P90, s.P99, s.Max = percentile(0.5), percentile(0.9), percentile(0.99), dists[len(dists)-1]
+	return
+}
+
+// String formats the distortion for the console.
+func (s distortion) String() string {
+	return fmt.Sprintf("mean %.4g p50 %.4g p90 %.4g p99 %.4g max %.4g (%d frames)", s.Mean, s.P50, s.P90, s.P99, s.Max, s.Frames)
+}
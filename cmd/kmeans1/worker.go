@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/gob"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// workerDialTimeout is the time a worker of --workers has to accept the connection.
+const workerDialTimeout = 10 * time.Second
+
+var (
+	// workerHeartbeat is the interval of the heartbeats a worker sends while
+	// it runs a job, a worker silent for workerTimeout counting as failed
+	workerHeartbeat = 10 * time.Second
+	workerTimeout   = 3 * workerHeartbeat
+	// workerRetry is the wait before reconnecting to a failed worker, given
+	// up after workerRetries failures in a row
+	workerRetry   = 30 * time.Second
+	workerRetries = 3
+)
+
+// chunkReply is the reply of a worker to a chunkJob, a Heartbeat while the
+// job runs.
+type chunkReply struct {
+	Heartbeat bool
+	Error     string
+	Result    *chunkResult
+}
+
+// handleWorker serves the chunk jobs of the coordinators connecting to the
+// listen address, the kmeans1 runs given the address in --workers.
+func handleWorker(args []string) {
+	cmd := flag.NewFlagSet("worker", flag.ExitOnError)
+	listen := cmd.String("listen", "", "address to accept the chunk jobs of a coordinator on, such as :7070")
+	srcDir := cmd.String("srcdir", "", "corpus directory, if mounted elsewhere than on the coordinator (default the coordinator srcdir)")
+	threads := cmd.Int("threads", runtime.NumCPU(), "number of threads (default NumCPU() at startup)")
+	cacheDir := cmd.String("cachedir", "", "cache the spectrograms of the corpus in this directory, needed when the coordinator caches them")
+	cmd.Parse(args)
+	if *listen == "" {
+		println("listen is mandatory")
+		return
+	}
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		fmt.Println("Error:", err.Error())
+		return
+	}
+	fmt.Println("Worker listening on", listener.Addr())
+	serveWorker(listener, *srcDir, *cacheDir, *threads)
+}
+
+// serveWorker serves the coordinators connecting to the listener until it is closed.
+func serveWorker(listener net.Listener, srcDir, cacheDir string, threads int) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			fmt.Println("Error:", err.Error())
+			return
+		}
+		go serveChunks(conn, srcDir, cacheDir, threads)
+	}
+}
+
+// serveChunks runs the chunk jobs a coordinator sends on the connection one
+// after another, replying with their results.
+func serveChunks(conn net.Conn, srcDir, cacheDir string, threads int) {
+	defer conn.Close()
+	var decoder = gob.NewDecoder(conn)
+	var encoder = gob.NewEncoder(conn)
+	for {
+		var job chunkJob
+		if err := decoder.Decode(&job); err != nil {
+			if err != io.EOF {
+				fmt.Println("Coordinator", conn.RemoteAddr(), "error:", err.Error())
+			}
+			return
+		}
+		fmt.Println("Clustering band", job.Band, "chunk", job.Chunk, "of", conn.RemoteAddr())
+		start := time.Now()
+		var reply chunkReply
+		var result *chunkResult
+		var err error
+		var done = make(chan bool)
+		go func() {
+			result, err = job.run(srcDir, cacheDir, threads)
+			close(done)
+		}()
+		// tell the coordinator the job is still running
+		var heartbeat = time.NewTicker(workerHeartbeat)
+		for running := true; running; {
+			select {
+			case <-done:
+				running = false
+			case <-heartbeat.C:
+				if err := encoder.Encode(&chunkReply{Heartbeat: true}); err != nil {
+					heartbeat.Stop()
+					fmt.Println("Coordinator", conn.RemoteAddr(), "error:", err.Error())
+					return
+				}
+			}
+		}
+		heartbeat.Stop()
+		if err != nil {
+			reply.Error = err.Error()
+			fmt.Println("Error:", err.Error())
+		} else {
+			reply.Result = result
+			fmt.Println("Clustered band", job.Band, "chunk", job.Chunk, "frames", result.Clustered, "in", time.Since(start))
+		}
+		if err := encoder.Encode(&reply); err != nil {
+			fmt.Println("Coordinator", conn.RemoteAddr(), "error:", err.Error())
+			return
+		}
+	}
+}
+
+// workerPool farms the chunk jobs out to the workers of --workers.
+type workerPool struct {
+	addrs []string
+}
+
+func newWorkerPool(spec string) *workerPool {
+	var p = &workerPool{}
+	for _, addr := range strings.Split(spec, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			p.addrs = append(p.addrs, addr)
+		}
+	}
+	return p
+}
+
+// run runs the jobs on the workers, every worker a job at a time. The job of
+// a worker failing, or silent for workerTimeout, is dispatched again to the
+// other workers and the failed worker is reconnected to after workerRetry,
+// up to workerRetries times in a row. The jobs left once every worker gave
+// up are run by local. done is called as the jobs complete, by the worker
+// address or an empty one.
+func (p *workerPool) run(jobs []*chunkJob, local func(job *chunkJob) *chunkResult, done func(job *chunkJob, result *chunkResult, worker string)) []*chunkResult {
+	var results = make([]*chunkResult, len(jobs))
+	var queue = make(chan int, len(jobs))
+	for i := range jobs {
+		queue <- i
+	}
+	var left atomic.Int64
+	left.Store(int64(len(jobs)))
+	// finished is closed with the queue, once every job completed
+	var finished = make(chan bool)
+	if len(jobs) == 0 {
+		close(queue)
+		close(finished)
+	}
+	var mut sync.Mutex
+	var complete = func(i int, result *chunkResult, addr string) {
+		results[i] = result
+		mut.Lock()
+		done(jobs[i], result, addr)
+		mut.Unlock()
+		if left.Add(-1) == 0 {
+			close(queue)
+			close(finished)
+		}
+	}
+	var wg sync.WaitGroup
+	for _, addr := range p.addrs {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			for failures := 0; ; {
+				completed, err := session(addr, jobs, queue, complete)
+				if err == nil {
+					return
+				}
+				if completed > 0 {
+					failures = 0
+				}
+				if failures++; failures >= workerRetries {
+					fmt.Println("Worker", addr, "unavailable:", err.Error())
+					return
+				}
+				fmt.Println("Worker", addr, "failed, reconnecting in", workerRetry, "error:", err.Error())
+				select {
+				case <-finished:
+					return
+				case <-time.After(workerRetry):
+				}
+			}
+		}(addr)
+	}
+	wg.Wait()
+	for left.Load() > 0 {
+		// no worker is left
+		i := <-queue
+		fmt.Println("Clustering chunk", jobs[i].Chunk, "locally")
+		results[i] = local(jobs[i])
+		done(jobs[i], results[i], "")
+		left.Add(-1)
+	}
+	return results
+}
+
+// session runs the jobs of the queue on the worker over a connection until
+// the queue is closed, returning the number of jobs completed. The job of a
+// failure ending the session is put back to the queue.
+func session(addr string, jobs []*chunkJob, queue chan int, complete func(i int, result *chunkResult, addr string)) (int, error) {
+	conn, err := net.DialTimeout("tcp", addr, workerDialTimeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	var encoder = gob.NewEncoder(conn)
+	var decoder = gob.NewDecoder(conn)
+	var completed int
+	for i := range queue {
+		result, err := runRemote(conn, encoder, decoder, jobs[i])
+		if err != nil {
+			fmt.Println("Worker", addr, "failed chunk", jobs[i].Chunk, "dispatching it again:", err.Error())
+			queue <- i
+			return completed, err
+		}
+		complete(i, result, addr)
+		completed++
+	}
+	return completed, nil
+}
+
+// runRemote sends the job to the worker and waits for its result, the worker
+// sending a heartbeat at least every workerTimeout.
+func runRemote(conn net.Conn, encoder *gob.Encoder, decoder *gob.Decoder, job *chunkJob) (*chunkResult, error) {
+	conn.SetDeadline(time.Now().Add(workerTimeout))
+	if err := encoder.Encode(job); err != nil {
+		return nil, err
+	}
+	for {
+		var reply chunkReply
+		conn.SetReadDeadline(time.Now().Add(workerTimeout))
+		if err := decoder.Decode(&reply); err != nil {
+			return nil, err
+		}
+		if reply.Heartbeat {
+			continue
+		}
+		if reply.Result == nil {
+			return nil, errors.New(reply.Error)
+		}
+		return reply.Result, nil
+	}
+}
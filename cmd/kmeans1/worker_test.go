@@ -0,0 +1,199 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/neurlang/gospeak/codec"
+)
+
+// testJobs returns the jobs of the chunks of a synthetic corpus.
+func testJobs(t *testing.T, files, chunks int) []*chunkJob {
+	dir, paths := testCorpus(t, files)
+	layout, err := codec.LayoutFor(48000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var jobs = make([]*chunkJob, chunks)
+	for chunk := range jobs {
+		jobs[chunk] = &chunkJob{Layout: layout, Chunk: chunk, Seed: 7, SrcDir: dir, FileCount: files,
+			Speakers: make([]int, files), SpeakerCount: 1, K: 8, Kmeanz: 8, Algo: algoLloyd}
+	}
+	for i, path := range paths {
+		job := jobs[i%chunks]
+		job.Files = append(job.Files, i)
+		job.Paths = append(job.Paths, path)
+	}
+	return jobs
+}
+
+// fastWorkers shortens the heartbeats and retries of the workers for the test.
+func fastWorkers(t *testing.T) {
+	heartbeat, timeout, retry := workerHeartbeat, workerTimeout, workerRetry
+	workerHeartbeat, workerTimeout, workerRetry = 20*time.Millisecond, 300*time.Millisecond, 10*time.Millisecond
+	t.Cleanup(func() {
+		workerHeartbeat, workerTimeout, workerRetry = heartbeat, timeout, retry
+	})
+}
+
+// startWorker serves chunk jobs on a loopback port, the listener wrapped by
+// wrap, and returns the address.
+func startWorker(t *testing.T, wrap func(net.Listener) net.Listener) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go serveWorker(wrap(listener), "", "", 2)
+	return listener.Addr().String()
+}
+
+// faultyListener makes its worker fail on the first reply to a job: killed,
+// closing the listener and the connections like a machine going down, or
+// hung, the replies never arriving. failed is closed then.
+type faultyListener struct {
+	net.Listener
+	hang   bool
+	failed chan bool
+	once   sync.Once
+	mut    sync.Mutex
+	conns  []net.Conn
+}
+
+func newFaultyListener(hang bool) *faultyListener {
+	return &faultyListener{hang: hang, failed: make(chan bool)}
+}
+
+func (l *faultyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	l.conns = append(l.conns, conn)
+	return &faultyConn{Conn: conn, l: l}, nil
+}
+
+// fail fails the worker.
+func (l *faultyListener) fail() {
+	l.once.Do(func() {
+		close(l.failed)
+		if l.hang {
+			return
+		}
+		l.Listener.Close()
+		l.mut.Lock()
+		defer l.mut.Unlock()
+		for _, conn := range l.conns {
+			conn.Close()
+		}
+	})
+}
+
+type faultyConn struct {
+	net.Conn
+	l *faultyListener
+}
+
+func (c *faultyConn) Write(b []byte) (int, error) {
+	c.l.fail()
+	if c.l.hang {
+		return len(b), nil
+	}
+	return 0, net.ErrClosed
+}
+
+// gatedListener accepts no connections before the gate is closed, so that
+// the other workers do not take every job first.
+type gatedListener struct {
+	net.Listener
+	gate chan bool
+}
+
+func (l *gatedListener) Accept() (net.Conn, error) {
+	<-l.gate
+	return l.Listener.Accept()
+}
+
+// testPool runs the jobs on the workers, checking the results match the
+// jobs run locally and returning the number of jobs done per worker.
+func testPool(t *testing.T, jobs []*chunkJob, addrs []string) map[string]int {
+	var want = make([]*chunkResult, len(jobs))
+	for i, job := range jobs {
+		result, err := job.run("", "", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result.Centers) == 0 {
+			t.Fatalf("chunk %d: no centers", i)
+		}
+		want[i] = result
+	}
+	var pool = &workerPool{addrs: addrs}
+	var by = map[string]int{}
+	got := pool.run(jobs, func(job *chunkJob) *chunkResult {
+		t.Errorf("chunk %d clustered locally", job.Chunk)
+		result, _ := job.run("", "", 1)
+		return result
+	}, func(job *chunkJob, result *chunkResult, worker string) {
+		by[worker]++
+	})
+	for i := range jobs {
+		if !reflect.DeepEqual(got[i], want[i]) {
+			t.Errorf("chunk %d: the result of the workers differs from the local result", i)
+		}
+	}
+	var total int
+	for _, n := range by {
+		total += n
+	}
+	if total != len(jobs) {
+		t.Errorf("%d jobs done, want %d", total, len(jobs))
+	}
+	return by
+}
+
+func TestWorkerKilledMidJob(t *testing.T) {
+	fastWorkers(t)
+	jobs := testJobs(t, 12, 6)
+	killed := newFaultyListener(false)
+	var addrs = []string{startWorker(t, func(l net.Listener) net.Listener {
+		killed.Listener = l
+		return killed
+	})}
+	for w := 0; w < 2; w++ {
+		addrs = append(addrs, startWorker(t, func(l net.Listener) net.Listener {
+			return &gatedListener{Listener: l, gate: killed.failed}
+		}))
+	}
+	by := testPool(t, jobs, addrs)
+	select {
+	case <-killed.failed:
+	default:
+		t.Fatal("the killed worker got no job")
+	}
+	if by[addrs[0]] != 0 {
+		t.Errorf("the killed worker completed %d jobs", by[addrs[0]])
+	}
+}
+
+func TestWorkerHung(t *testing.T) {
+	fastWorkers(t)
+	jobs := testJobs(t, 8, 4)
+	hung := newFaultyListener(true)
+	var addrs = []string{startWorker(t, func(l net.Listener) net.Listener {
+		hung.Listener = l
+		return hung
+	})}
+	addrs = append(addrs, startWorker(t, func(l net.Listener) net.Listener {
+		return &gatedListener{Listener: l, gate: hung.failed}
+	}))
+	by := testPool(t, jobs, addrs)
+	if by[addrs[0]] != 0 {
+		t.Errorf("the hung worker completed %d jobs", by[addrs[0]])
+	}
+}
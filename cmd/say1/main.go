@@ -9,18 +9,23 @@ import "github.com/neurlang/classifier/net/feedforward"
 import (
 	"bufio"
 	"encoding/json"
+	"flag"
 	"fmt"
-	"github.com/neurlang/gomel/phase"
+	"io"
+	"github.com/neurlang/gospeak/codec"
 	"io/ioutil"
 	"os"
 	"strconv"
 )
 
+// logw receives the diagnostic output, stderr when audio is streamed to stdout
+var logw io.Writer = os.Stdout
+
 func bigram_gen_next(bigrams map[string]map[string]int, current string) (out []uint32) {
 	// Check if current number exists in the model
 	nextOptions, exists := bigrams[current]
 	if !exists {
-		fmt.Printf("No data for number '%s' in the bigram model\n", current)
+		fmt.Fprintf(logw, "No data for number '%s' in the bigram model\n", current)
 		return nil
 	}
 
@@ -32,10 +37,13 @@ func bigram_gen_next(bigrams map[string]map[string]int, current string) (out []u
 
 	return
 }
-func unpack_tokens_into_mels_centroids(n []uint32) (ret []uint32) {
-	const mask = ((1 << 15) - 1)
+func unpack_tokens_into_mels_centroids(n []uint32, group int) (ret []uint32) {
+	var bits = 30 / group
+	var mask uint32 = ((1 << bits) - 1)
 	for _, num := range n {
-		ret = append(ret, ((num >> 15) & mask), ((num >> 0) & mask))
+		for i := group - 1; i >= 0; i-- {
+			ret = append(ret, ((num >> (bits * i)) & mask))
+		}
 	}
 	return
 }
@@ -53,50 +61,22 @@ func centroids_unpad(centroids []uint32) []uint32 {
 	return centroids
 }
 
-func centroids_vocode(centroids []uint32, all_centroids [][]float64, filename string) {
-
-	var samplerate int
-	var freqs = len(all_centroids[0])/3
-	switch freqs {
-	case 384 * 2:
-		samplerate = 48000
-	case 418 * 2:
-		samplerate = 44100
-	default:
-		println("freqs:", freqs)
-		panic("unsupported sample rate")
-	}
-
-	m := phase.NewPhase()
-	m.YReverse = true
-	m.Window = 640 * 2
-	m.NumFreqs = freqs
-	m.Resolut = 2048 * 2
-	m.VolumeBoost = 4
-
-	fmt.Println(centroids)
-
-	var buf [][3]float64
-	for _, centroid := range centroids {
-		var prev0, prev1 float64
-		for i, float := range all_centroids[centroid] {
-			if i%3 == 0 {
-				prev0 = float
-			} else if i%3 == 1 {
-				prev1 = float
-			} else {
-				buf = append(buf, [3]float64{prev0, prev1, float})
-			}
+func decodeStream(dec *codec.Decoder, centroids []uint32, w *codec.SampleWriter) error {
+	stream := dec.Stream()
+	for i := range centroids {
+		samples, err := stream.Write(centroids[i : i+1])
+		if err != nil {
+			return err
 		}
+		w.Write(samples)
+		w.Flush()
 	}
-
-	//fmt.Println(buf)
-
-	speech, err := m.FromPhase(buf)
+	samples, err := stream.Close()
 	if err != nil {
-		panic(err)
+		return err
 	}
-	phase.SaveWav(filename, speech, samplerate)
+	w.Write(samples)
+	return w.Flush()
 }
 
 func predict_acoustic_codewords(line string, fanout1 int, bigrams map[string]map[string]int, net feedforward.FeedforwardNetwork) (ret []uint32) {
@@ -146,7 +126,7 @@ func predict_acoustic_codewords(line string, fanout1 int, bigrams map[string]map
 			ret = sample.Target
 		}
 		sample.Target = append(sample.Target, 0)
-		fmt.Println(sample.Target)
+		fmt.Fprintln(logw, sample.Target)
 
 		if len(sample.Target) > 6*len(sample.Source) {
 			println("target sequence is long, breaking")
@@ -163,21 +143,31 @@ func predict_acoustic_codewords(line string, fanout1 int, bigrams map[string]map
 }
 
 func main() {
+	output := flag.String("o", "test.wav", "output WAV file path, or - to stream the audio of all utterances to stdout")
+	raw := flag.String("raw", "", "stream raw PCM in format s16le or f32le instead of WAV (with -o -)")
+	flag.Parse()
+
 	start := time.Now()
 	modeldir := `../../dict/slovak/`
 
-	var file struct {
-		Centroids [][]float64
+	cb, err := codec.LoadCodebook(modeldir + `centroids.json`)
+	if err != nil {
+		panic(err)
 	}
-	{
-		data, err := ioutil.ReadFile(modeldir + `centroids.json`)
-		if err != nil {
-			panic(err)
+	dec := codec.NewDecoder(cb)
+
+	var stream *codec.SampleWriter
+	if *output == "-" {
+		logw = os.Stderr
+		if *raw != "" {
+			stream, err = codec.NewRawWriter(os.Stdout, *raw)
+		} else {
+			stream, err = codec.NewWavWriter(os.Stdout, dec.SampleRate())
 		}
-		err = json.Unmarshal(data, &file)
 		if err != nil {
 			panic(err)
 		}
+		defer stream.Close()
 	}
 	var bigrams map[string]map[string]int
 	{
@@ -210,7 +200,7 @@ func main() {
 	net.NewCombiner(sum.MustNew([]uint{fanout1 * fanout2}, 0))
 	net.NewLayer(1, 0)
 
-	err := net.ReadZlibWeightsFromFile(modeldir + `output.99.json.t.lzw`)
+	err = net.ReadZlibWeightsFromFile(modeldir + `output.99.json.t.lzw`)
 	if err != nil {
 		panic(err)
 	}
@@ -218,12 +208,15 @@ func main() {
 	duration := time.Since(start)
 
 	// Formatted string, such as "2h3m0.5s" or "4.503μs"
-	fmt.Println(duration)
+	fmt.Fprintln(logw, duration)
 
-	//centroids_vocode([]uint32{0, 0, 0, 0, 0, 0, 0, 0, 0}, file.Centroids, "000.wav")
-	centroids_vocode([]uint32{
+	//dec.DecodeFile([]uint32{0, 0, 0, 0, 0, 0, 0, 0, 0}, "000.wav")
+	err = dec.DecodeFile([]uint32{
 		5870, 17390, 5089, 2148, 7879, 16094, 2754, 8719, 11767, 2723, 10786, 3223, 2593, 1248, 363, 63, 47, 15849, 14221, 31292},
-		file.Centroids, "robot.wav")
+		"robot.wav")
+	if err != nil {
+		panic(err)
+	}
 
 	// Create a new scanner to read the file line by line
 	scanner := bufio.NewScanner(os.Stdin)
@@ -234,12 +227,12 @@ func main() {
 			continue
 		}
 
-		fmt.Println([]rune(line))
+		fmt.Fprintln(logw, []rune(line))
 
 		start := time.Now()
-		var centroids = unpack_tokens_into_mels_centroids(predict_acoustic_codewords(line, fanout1, bigrams, net))
+		var centroids = unpack_tokens_into_mels_centroids(predict_acoustic_codewords(line, fanout1, bigrams, net), cb.FramesPerGroup)
 
-		fmt.Println(centroids)
+		fmt.Fprintln(logw, centroids)
 
 		if len(centroids) == 0 {
 			continue
@@ -250,12 +243,21 @@ func main() {
 			continue
 		}
 
-		centroids_vocode(centroids, file.Centroids, "test.wav")
+		fmt.Fprintln(logw, centroids)
+
+		if stream != nil {
+			err = decodeStream(dec, centroids, stream)
+		} else {
+			err = dec.DecodeFile(centroids, *output)
+		}
+		if err != nil {
+			panic(err)
+		}
 
 		// Code to measure
 		duration := time.Since(start)
 
 		// Formatted string, such as "2h3m0.5s" or "4.503μs"
-		fmt.Println(duration)
+		fmt.Fprintln(logw, duration)
 	}
 }
@@ -0,0 +1,29 @@
+package codec
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/neurlang/gomel/phase"
+)
+
+// LoadAudio loads a mono FLAC or WAV file and returns its samples and sample rate.
+func LoadAudio(inputFile string) ([]float64, uint32, error) {
+	var audio []float64
+	var sampleRate uint32
+	var err error
+	if strings.HasSuffix(inputFile, ".flac") {
+		audio, sampleRate, err = phase.LoadFlacSampleRate(inputFile)
+	} else {
+		audio, sampleRate, err = phase.LoadWavSampleRate(inputFile)
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("Error loading audio: %v", err)
+	}
+	return audio, sampleRate, nil
+}
+
+// ToNative resamples audio to the native sample rate of the layout.
+func ToNative(audio []float64, sampleRate uint32, layout *Layout) ([]float64, error) {
+	return Resample(audio, int(sampleRate), layout.SampleRate)
+}
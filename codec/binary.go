@@ -0,0 +1,471 @@
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+
+	"github.com/x448/float16"
+)
+
+// Binary codebook file layout, all integers and floats are little-endian:
+//
+//	magic          [4]byte  "GSCB"
+//	version        uint16
+//	precision      uint16   bytes per value, 2 (float16) or 4 (float32)
+//	sampleRate     uint32
+//	numFreqs       uint32
+//	window         uint32   (since version 2)
+//	resolut        uint32   (since version 2)
+//	volumeBoost    float32  (since version 2)
+//	framesPerGroup uint32   (since version 2)
+//	bands          uint32
+//	ranges         [bands+1]uint32
+//	sizes          [bands]uint32   codewords per band
+//	payload        per band, per codeword, 3*(ranges[b+1]-ranges[b]) values
+//	alternatives   uint32   (optional) number of exemplars per codeword
+//	exemplars      per band, per codeword, alternatives times the values of a codeword
+//	stages         uint32   (optional) number of residual stages
+//	residuals      per stage: sizes [bands]uint32, then per band, per codeword, the values of a codeword as float32
+//	bandBits       [bands]uint32 (optional) token bit width of every band, all 0 without BandBits
+//	seed           uint64   (optional) Seed
+//	corpus         uint32 length, then the bytes of Corpus
+//	parents        uint32   (optional) number of Parents, then per parent the hash [8]byte and bits [bands]uint8
+//
+// Empty codewords and missing exemplars are stored as NaN values. The
+// exemplars section is present only for codebooks having Exemplars or
+// Residuals, the residuals section only for codebooks having Residuals,
+// readers not knowing them ignore them. The sections before bandBits are
+// written empty for codebooks having only BandBits, those before seed for
+// codebooks having only a Seed, a Corpus or Parents. The residuals are small
+// linear magnitude differences which float16 would flush to zero, so they are
+// float32 whatever the precision. Version 1 files lack the spectrogram
+// parameters, the defaults of LayoutFor are assumed for them.
+const binaryMagic = "GSCB"
+
+// Precision of the binary codebook payload, in bytes per value
+const (
+	Float16 = 2
+	Float32 = 4
+)
+
+// ErrBadFormat is returned when a binary codebook is malformed
+var ErrBadFormat = errors.New("codec: malformed binary codebook")
+
+// IsBinaryCodebook reports whether data starts like a binary codebook.
+func IsBinaryCodebook(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(binaryMagic))
+}
+
+// WriteBinary writes the codebook in the binary format with the given precision.
+func (cb *Codebook) WriteBinary(w io.Writer, precision int) error {
+	if precision != Float16 && precision != Float32 {
+		return fmt.Errorf("codec: unsupported precision %d", precision)
+	}
+	bw := bufio.NewWriter(w)
+	var header = []uint32{uint32(cb.SampleRate), uint32(cb.NumFreqs), uint32(cb.Window), uint32(cb.Resolut),
+		math.Float32bits(float32(cb.VolumeBoost)), uint32(cb.FramesPerGroup), uint32(cb.Bands())}
+	for _, edge := range cb.Ranges {
+		header = append(header, uint32(edge))
+	}
+	for rang := 0; rang < cb.Bands(); rang++ {
+		header = append(header, uint32(cb.Size(rang)))
+	}
+	bw.WriteString(binaryMagic)
+	binary.Write(bw, binary.LittleEndian, [2]uint16{Version, uint16(precision)})
+	binary.Write(bw, binary.LittleEndian, header)
+
+	var buf [4]byte
+	write := func(centroid []float64, values, precision int) {
+		for i := 0; i < values; i++ {
+			var v = math.NaN()
+			if len(centroid) != 0 {
+				v = centroid[i]
+			}
+			if precision == Float16 {
+				binary.LittleEndian.PutUint16(buf[:], float16.Fromfloat32(float32(v)).Bits())
+			} else {
+				binary.LittleEndian.PutUint32(buf[:], math.Float32bits(float32(v)))
+			}
+			bw.Write(buf[:precision])
+		}
+	}
+	for rang, band := range cb.Centroids {
+		values := 3 * (cb.Ranges[rang+1] - cb.Ranges[rang])
+		for _, centroid := range band {
+			write(centroid, values, precision)
+		}
+	}
+	var meta = cb.Seed != 0 || cb.Corpus != "" || cb.Parents != nil
+	var tail = cb.BandBits != nil || meta
+	if alternatives := cb.alternatives(); alternatives > 0 || cb.Residuals != nil || tail {
+		binary.Write(bw, binary.LittleEndian, uint32(alternatives))
+		for rang, band := range cb.Centroids {
+			values := 3 * (cb.Ranges[rang+1] - cb.Ranges[rang])
+			for idx := range band {
+				for a := 0; a < alternatives; a++ {
+					var alternative []float64
+					if rang < len(cb.Exemplars) && idx < len(cb.Exemplars[rang]) && a < len(cb.Exemplars[rang][idx]) {
+						alternative = cb.Exemplars[rang][idx][a]
+					}
+					write(alternative, values, precision)
+				}
+			}
+		}
+	}
+	if cb.Residuals != nil || tail {
+		binary.Write(bw, binary.LittleEndian, uint32(len(cb.Residuals)))
+		for stage := range cb.Residuals {
+			for rang := 0; rang < cb.Bands(); rang++ {
+				binary.Write(bw, binary.LittleEndian, uint32(cb.ResidualSize(stage+1, rang)))
+			}
+			for rang, band := range cb.Residuals[stage] {
+				values := 3 * (cb.Ranges[rang+1] - cb.Ranges[rang])
+				for _, codeword := range band {
+					write(codeword, values, Float32)
+				}
+			}
+		}
+	}
+	if tail {
+		for rang := 0; rang < cb.Bands(); rang++ {
+			var n int
+			if cb.BandBits != nil {
+				n = cb.BandBits[rang]
+			}
+			binary.Write(bw, binary.LittleEndian, uint32(n))
+		}
+	}
+	if meta {
+		binary.Write(bw, binary.LittleEndian, cb.Seed)
+		binary.Write(bw, binary.LittleEndian, uint32(len(cb.Corpus)))
+		bw.WriteString(cb.Corpus)
+		binary.Write(bw, binary.LittleEndian, uint32(len(cb.Parents)))
+		for _, parent := range cb.Parents {
+			hash, err := parent.hash()
+			if err != nil {
+				return err
+			}
+			bw.Write(hash[:])
+			for rang := 0; rang < cb.Bands(); rang++ {
+				var n int
+				if rang < len(parent.Bits) {
+					n = parent.Bits[rang]
+				}
+				bw.WriteByte(byte(n))
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// ParseBinaryCodebook parses a codebook in the binary format.
+func ParseBinaryCodebook(data []byte) (*Codebook, error) {
+	cb, err := parseBinaryHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	precision := int(binary.LittleEndian.Uint16(data[6:]))
+	bands := cb.Bands()
+	data = data[binaryHeaderSize(cb.Version, bands):]
+	var sizes = make([]int, bands)
+	for i := range sizes {
+		sizes[i] = int(binary.LittleEndian.Uint32(data[4*i:]))
+	}
+	data = data[4*bands:]
+
+	read := func(values, precision int) []float64 {
+		centroid := make([]float64, values)
+		for i := range centroid {
+			if precision == Float16 {
+				centroid[i] = float64(float16.Frombits(binary.LittleEndian.Uint16(data)).Float32())
+			} else {
+				centroid[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(data)))
+			}
+			data = data[precision:]
+		}
+		if values > 0 && math.IsNaN(centroid[0]) {
+			return nil
+		}
+		return centroid
+	}
+	cb.Centroids = make([][][]float64, bands)
+	for rang, size := range sizes {
+		values := 3 * (cb.Ranges[rang+1] - cb.Ranges[rang])
+		if !fits(data, precision, size, values) {
+			return nil, fmt.Errorf("%w: truncated band %d", ErrBadFormat, rang)
+		}
+		cb.Centroids[rang] = make([][]float64, size)
+		for idx := range cb.Centroids[rang] {
+			cb.Centroids[rang][idx] = read(values, precision)
+		}
+	}
+	var exemplars [][][][]float64
+	if len(data) >= 4 {
+		alternatives := int(binary.LittleEndian.Uint32(data))
+		data = data[4:]
+		if alternatives > 0 {
+			exemplars = make([][][][]float64, bands)
+		}
+		for rang, size := range sizes {
+			values := 3 * (cb.Ranges[rang+1] - cb.Ranges[rang])
+			if !fits(data, precision, size, alternatives, values) {
+				return nil, fmt.Errorf("%w: truncated exemplars of band %d", ErrBadFormat, rang)
+			}
+			if alternatives == 0 {
+				continue
+			}
+			exemplars[rang] = make([][][]float64, size)
+			for idx := range exemplars[rang] {
+				for a := 0; a < alternatives; a++ {
+					if alternative := read(values, precision); alternative != nil {
+						exemplars[rang][idx] = append(exemplars[rang][idx], alternative)
+					}
+				}
+			}
+		}
+	}
+	// drop the trailing empty bands of partial codebooks
+	for len(cb.Centroids) > 0 && len(cb.Centroids[len(cb.Centroids)-1]) == 0 {
+		cb.Centroids = cb.Centroids[:len(cb.Centroids)-1]
+	}
+	var residuals [][][][]float64
+	if len(data) >= 4 {
+		stages := int(binary.LittleEndian.Uint32(data))
+		data = data[4:]
+		for stage := 0; stage < stages; stage++ {
+			if len(data) < 4*bands {
+				return nil, fmt.Errorf("%w: truncated residual stage %d", ErrBadFormat, stage+2)
+			}
+			var sizes = make([]int, bands)
+			for i := range sizes {
+				sizes[i] = int(binary.LittleEndian.Uint32(data[4*i:]))
+			}
+			data = data[4*bands:]
+			var band = make([][][]float64, len(cb.Centroids))
+			for rang := range band {
+				values := 3 * (cb.Ranges[rang+1] - cb.Ranges[rang])
+				if !fits(data, Float32, sizes[rang], values) {
+					return nil, fmt.Errorf("%w: truncated residual stage %d band %d", ErrBadFormat, stage+2, rang)
+				}
+				for idx := 0; idx < sizes[rang]; idx++ {
+					band[rang] = append(band[rang], read(values, Float32))
+				}
+			}
+			residuals = append(residuals, band)
+		}
+	}
+	if len(data) >= 4*bands {
+		var bandBits = make([]int, bands)
+		var set bool
+		for i := range bandBits {
+			bandBits[i] = int(binary.LittleEndian.Uint32(data[4*i:]))
+			set = set || bandBits[i] != 0
+		}
+		data = data[4*bands:]
+		if set {
+			cb.BandBits = bandBits
+		}
+		if err := cb.validate(); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrBadFormat, err)
+		}
+	}
+	if len(data) >= 12 {
+		cb.Seed = binary.LittleEndian.Uint64(data)
+		n := int(binary.LittleEndian.Uint32(data[8:]))
+		data = data[12:]
+		if n > len(data) {
+			return nil, fmt.Errorf("%w: truncated corpus", ErrBadFormat)
+		}
+		cb.Corpus = string(data[:n])
+		data = data[n:]
+	}
+	if len(data) >= 4 {
+		n := int(binary.LittleEndian.Uint32(data))
+		data = data[4:]
+		if n > len(data)/(8+bands) {
+			return nil, fmt.Errorf("%w: truncated parents", ErrBadFormat)
+		}
+		for i := 0; i < n; i++ {
+			var parent = Parent{Hash: hex.EncodeToString(data[:8])}
+			for _, width := range data[8 : 8+bands] {
+				parent.Bits = append(parent.Bits, int(width))
+			}
+			cb.Parents = append(cb.Parents, parent)
+			data = data[8+bands:]
+		}
+	}
+	if len(exemplars) > len(cb.Centroids) {
+		exemplars = exemplars[:len(cb.Centroids)]
+	}
+	if err := cb.init(); err != nil {
+		return nil, err
+	}
+	if err := cb.SetExemplars(exemplars); err != nil {
+		return nil, err
+	}
+	return cb, cb.SetResiduals(residuals)
+}
+
+// fits reports whether data holds the product of counts values of precision
+// bytes. It divides instead of multiplying, so the counts of a malformed
+// header can't overflow it.
+func fits(data []byte, precision int, counts ...int) bool {
+	room := len(data) / precision
+	for _, count := range counts {
+		if count == 0 {
+			return true
+		}
+		if count < 0 || count > room {
+			return false
+		}
+		room /= count
+	}
+	return true
+}
+
+// binaryHeaderSize returns the size of the header preceding the band sizes.
+func binaryHeaderSize(version, bands int) int {
+	if version >= 2 {
+		return 8 + 4*(8+bands)
+	}
+	return 8 + 4*(4+bands)
+}
+
+// parseBinaryHeader parses the header of a binary codebook into an empty codebook.
+func parseBinaryHeader(data []byte) (*Codebook, error) {
+	if !IsBinaryCodebook(data) || len(data) < 8 {
+		return nil, ErrBadFormat
+	}
+	version := binary.LittleEndian.Uint16(data[4:])
+	precision := int(binary.LittleEndian.Uint16(data[6:]))
+	if version == 0 || version > Version {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrBadFormat, version)
+	}
+	if precision != Float16 && precision != Float32 {
+		return nil, fmt.Errorf("%w: unsupported precision %d", ErrBadFormat, precision)
+	}
+	data = data[8:]
+	next := func() int {
+		if len(data) < 4 {
+			return 0
+		}
+		v := binary.LittleEndian.Uint32(data)
+		data = data[4:]
+		return int(v)
+	}
+	cb := &Codebook{Version: int(version)}
+	cb.SampleRate = next()
+	cb.NumFreqs = next()
+	if version >= 2 {
+		cb.Window = next()
+		cb.Resolut = next()
+		cb.VolumeBoost = float64(math.Float32frombits(uint32(next())))
+		cb.FramesPerGroup = next()
+	}
+	bands := next()
+	if bands <= 0 || bands > cb.NumFreqs || len(data) < 4*(2*bands+1) {
+		return nil, ErrBadFormat
+	}
+	for i := 0; i <= bands; i++ {
+		cb.Ranges = append(cb.Ranges, next())
+	}
+	cb.defaults()
+	if err := cb.validate(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadFormat, err)
+	}
+	return cb, nil
+}
+
+// WriteJSON writes the codebook in the JSON format of kmeans1.
+func (cb *Codebook) WriteJSON(w io.Writer) error {
+	meta, err := json.Marshal(struct {
+		Version int
+		Layout
+		Seed    uint64   `json:",omitempty"`
+		Corpus  string   `json:",omitempty"`
+		Parents []Parent `json:",omitempty"`
+	}{Version, cb.Layout, cb.Seed, cb.Corpus, cb.Parents})
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	bw.Write(meta[:len(meta)-1])
+	bw.WriteString(`,"Centroids":[`)
+	for rang, band := range cb.Centroids {
+		if rang > 0 {
+			bw.WriteString(",\n")
+		}
+		writeCodewords(bw, band, 3)
+	}
+	bw.WriteByte(']')
+	if cb.Exemplars != nil {
+		bw.WriteString(`,"Exemplars":[`)
+		for rang, band := range cb.Exemplars {
+			if rang > 0 {
+				bw.WriteString(",\n")
+			}
+			bw.WriteByte('[')
+			for idx, alternatives := range band {
+				if idx > 0 {
+					bw.WriteByte(',')
+				}
+				writeCodewords(bw, alternatives, 3)
+			}
+			bw.WriteByte(']')
+		}
+		bw.WriteByte(']')
+	}
+	if cb.Residuals != nil {
+		bw.WriteString(`,"Residuals":[`)
+		for stage, bands := range cb.Residuals {
+			if stage > 0 {
+				bw.WriteString(",\n")
+			}
+			bw.WriteByte('[')
+			for rang, band := range bands {
+				if rang > 0 {
+					bw.WriteString(",\n")
+				}
+				writeCodewords(bw, band, -1)
+			}
+			bw.WriteByte(']')
+		}
+		bw.WriteByte(']')
+	}
+	bw.WriteString("}\n")
+	return bw.Flush()
+}
+
+// writeCodewords writes a JSON array of codewords, one per line, the values
+// with the given decimals, or -1 for the shortest form keeping them in float32.
+// The residuals are linear magnitudes, whose quiet bins need more decimals than
+// the log2 exemplars.
+func writeCodewords(bw *bufio.Writer, codewords [][]float64, decimals int) {
+	bw.WriteByte('[')
+	for idx, centroid := range codewords {
+		if idx > 0 {
+			bw.WriteString(",\n")
+		}
+		bw.WriteByte('[')
+		for i, v := range centroid {
+			if i > 0 {
+				bw.WriteByte(',')
+			}
+			if decimals < 0 {
+				bw.WriteString(strconv.FormatFloat(v, 'g', -1, 32))
+			} else {
+				bw.WriteString(strconv.FormatFloat(v, 'f', decimals, 64))
+			}
+		}
+		bw.WriteByte(']')
+	}
+	bw.WriteByte(']')
+}
@@ -0,0 +1,220 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/x448/float16"
+)
+
+// testLayout is a small layout of three bands for codebooks without audio.
+func testLayout() Layout {
+	l := Layout{SampleRate: 48000, NumFreqs: 8, Window: 4, Resolut: 16, Ranges: []int{0, 2, 5, 8}}
+	l.defaults()
+	return l
+}
+
+// randomCodewords returns the given number of random codewords of every band,
+// rounded to what the precision keeps.
+func randomCodewords(rng *rand.Rand, l Layout, sizes []int, precision int) [][][]float64 {
+	var centroids = make([][][]float64, len(sizes))
+	for rang, size := range sizes {
+		for idx := 0; idx < size; idx++ {
+			var codeword = make([]float64, 3*(l.Ranges[rang+1]-l.Ranges[rang]))
+			for i := range codeword {
+				codeword[i] = round(rng.NormFloat64()*4-10, precision)
+			}
+			centroids[rang] = append(centroids[rang], codeword)
+		}
+	}
+	return centroids
+}
+
+// round rounds a value to the precision of the binary format.
+func round(v float64, precision int) float64 {
+	if precision == Float16 {
+		return float64(float16.Fromfloat32(float32(v)).Float32())
+	}
+	return float64(float32(v))
+}
+
+func testCodebook(t testing.TB, rng *rand.Rand, sizes []int, precision int) *Codebook {
+	cb, err := NewCodebookLayout(testLayout(), randomCodewords(rng, testLayout(), sizes, precision))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cb
+}
+
+func writeBinary(t testing.TB, cb *Codebook, precision int) []byte {
+	var buf bytes.Buffer
+	if err := cb.WriteBinary(&buf, precision); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// sameExemplars reports whether the codebooks have the same alternatives of
+// every codeword, missing bands having none.
+func sameExemplars(a, b *Codebook) bool {
+	for rang := range a.Centroids {
+		for idx := range a.Centroids[rang] {
+			var x, y [][]float64
+			if rang < len(a.Exemplars) && idx < len(a.Exemplars[rang]) {
+				x = a.Exemplars[rang][idx]
+			}
+			if rang < len(b.Exemplars) && idx < len(b.Exemplars[rang]) {
+				y = b.Exemplars[rang][idx]
+			}
+			if len(x) != len(y) || (len(x) > 0 && !reflect.DeepEqual(x, y)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func TestBinaryRoundtrip(t *testing.T) {
+	for _, precision := range []int{Float16, Float32} {
+		rng := rand.New(rand.NewSource(1))
+		cb := testCodebook(t, rng, []int{5, 3, 4}, precision)
+		cb.Centroids[1][2] = nil
+		if err := cb.SetExemplars([][][][]float64{randomCodewords(rng, cb.Layout, []int{5}, precision)[0:1]}); err == nil {
+			t.Fatal("exemplars of the wrong count accepted")
+		}
+		var alternatives = make([][][]float64, 5)
+		for idx := range alternatives {
+			alternatives[idx] = randomCodewords(rng, cb.Layout, []int{idx % 3}, precision)[0]
+		}
+		if err := cb.SetExemplars([][][][]float64{alternatives}); err != nil {
+			t.Fatal(err)
+		}
+		cb.BandBits = []int{4, 3, 3}
+
+		got, err := ParseBinaryCodebook(writeBinary(t, cb, precision))
+		if err != nil {
+			t.Fatalf("precision %d: %v", precision, err)
+		}
+		if !reflect.DeepEqual(got.Layout, cb.Layout) {
+			t.Errorf("precision %d: layout %+v, want %+v", precision, got.Layout, cb.Layout)
+		}
+		if !reflect.DeepEqual(got.Centroids, cb.Centroids) {
+			t.Errorf("precision %d: centroids differ", precision)
+		}
+		if !sameExemplars(got, cb) {
+			t.Errorf("precision %d: exemplars %v, want %v", precision, got.Exemplars, cb.Exemplars)
+		}
+	}
+}
+
+func TestBinaryPartialCodebook(t *testing.T) {
+	cb := testCodebook(t, rand.New(rand.NewSource(2)), []int{4, 2}, Float32)
+	got, err := ParseBinaryCodebook(writeBinary(t, cb, Float32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Centroids) != 2 || got.Bands() != 3 {
+		t.Errorf("got %d of %d bands, want 2 of 3", len(got.Centroids), got.Bands())
+	}
+}
+
+func TestBinaryTruncated(t *testing.T) {
+	cb := testCodebook(t, rand.New(rand.NewSource(3)), []int{3, 2, 2}, Float16)
+	data := writeBinary(t, cb, Float16)
+	for n := 0; n < len(data); n++ {
+		if _, err := ParseBinaryCodebook(data[:n]); err == nil {
+			t.Errorf("codebook truncated to %d of %d bytes accepted", n, len(data))
+		}
+	}
+}
+
+func TestBinaryOverflowingHeader(t *testing.T) {
+	cb := testCodebook(t, rand.New(rand.NewSource(4)), []int{3, 2, 2}, Float32)
+	data := writeBinary(t, cb, Float32)
+	sizes := binaryHeaderSize(Version, cb.Bands())
+
+	for _, size := range []uint32{1 << 31, 1<<32 - 1} {
+		corrupt := append([]byte(nil), data...)
+		binary.LittleEndian.PutUint32(corrupt[sizes:], size)
+		if _, err := ParseBinaryCodebook(corrupt); !errors.Is(err, ErrBadFormat) {
+			t.Errorf("band size %d: got %v, want ErrBadFormat", size, err)
+		}
+	}
+
+	// the band count, following the fixed header fields
+	corrupt := append([]byte(nil), data...)
+	binary.LittleEndian.PutUint32(corrupt[sizes-4*(cb.Bands()+2):], 1<<32-1)
+	if _, err := ParseBinaryCodebook(corrupt); !errors.Is(err, ErrBadFormat) {
+		t.Errorf("band count overflow: got %v, want ErrBadFormat", err)
+	}
+
+	// the exemplar count multiplied by the band sizes
+	corrupt = append(append([]byte(nil), data...), 0xff, 0xff, 0xff, 0x7f)
+	if _, err := ParseBinaryCodebook(corrupt); !errors.Is(err, ErrBadFormat) {
+		t.Errorf("exemplar count overflow: got %v, want ErrBadFormat", err)
+	}
+}
+
+func TestBinaryResiduals(t *testing.T) {
+	rng := rand.New(rand.NewSource(5))
+	cb := testCodebook(t, rng, []int{4, 3, 2}, Float16)
+	// residuals are linear magnitude differences, far below the float16 resolution
+	var residuals = make([][][][]float64, 2)
+	for stage := range residuals {
+		residuals[stage] = randomCodewords(rng, cb.Layout, []int{3, 2, 2}, Float32)
+		for _, band := range residuals[stage] {
+			for _, codeword := range band {
+				for i := range codeword {
+					codeword[i] = round(codeword[i]*1e-7, Float32)
+				}
+			}
+		}
+	}
+	if err := cb.SetResiduals(residuals); err != nil {
+		t.Fatal(err)
+	}
+	for _, precision := range []int{Float16, Float32} {
+		got, err := ParseBinaryCodebook(writeBinary(t, cb, precision))
+		if err != nil {
+			t.Fatalf("precision %d: %v", precision, err)
+		}
+		if !reflect.DeepEqual(got.Residuals, cb.Residuals) {
+			t.Errorf("precision %d: residuals %v, want %v", precision, got.Residuals, cb.Residuals)
+		}
+		if !reflect.DeepEqual(got.Centroids, cb.Centroids) {
+			t.Errorf("precision %d: centroids differ", precision)
+		}
+	}
+}
+
+func TestMetadataRoundtrip(t *testing.T) {
+	for _, bandBits := range [][]int{nil, {3, 3, 2}} {
+		cb := testCodebook(t, rand.New(rand.NewSource(6)), []int{4, 3, 2}, Float32)
+		cb.BandBits = bandBits
+		cb.Seed, cb.Corpus = 1<<63+12345, "0f1e2d3c"
+
+		got, err := ParseBinaryCodebook(writeBinary(t, cb, Float16))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Seed != cb.Seed || got.Corpus != cb.Corpus || !reflect.DeepEqual(got.BandBits, bandBits) {
+			t.Errorf("binary: seed %d corpus %q band bits %v, want %d %q %v", got.Seed, got.Corpus, got.BandBits, cb.Seed, cb.Corpus, bandBits)
+		}
+
+		var buf bytes.Buffer
+		if err := cb.WriteJSON(&buf); err != nil {
+			t.Fatal(err)
+		}
+		got, err = ParseCodebook(buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Seed != cb.Seed || got.Corpus != cb.Corpus || !reflect.DeepEqual(got.BandBits, bandBits) {
+			t.Errorf("JSON: seed %d corpus %q band bits %v, want %d %q %v", got.Seed, got.Corpus, got.BandBits, cb.Seed, cb.Corpus, bandBits)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package codec
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+
+	"github.com/neurlang/classifier/parallel"
+)
+
+// Version is the codebook metadata version written by this package
+const Version = 2
+
+// Codebook holds the codewords of every band together with the layout they were trained for.
+type Codebook struct {
+	// Version is the metadata version, 0 for legacy codebooks without metadata
+	Version int
+
+	Layout
+
+	// Seed is the random seed of kmeans1 which reproduces the codebook, 0 if unknown
+	Seed uint64
+	// Corpus identifies the list of files the codebook was trained on, empty if unknown
+	Corpus string
+	// Parents are the codebooks this one was adapted from by kmeans1 --adapt,
+	// the nearest first, nil for codebooks trained from scratch
+	Parents []Parent
+
+	// Centroids are indexed by band and codeword, each codeword is a flat
+	// slice of log2 phase triples covering the band frequencies
+	Centroids [][][]float64
+
+	// Exemplars are the alternatives of the codewords, indexed by band,
+	// codeword and alternative, nil for codebooks of a single exemplar per
+	// codeword. The decoder picks among a codeword and its alternatives the
+	// one most similar to the previous frame.
+	Exemplars [][][][]float64
+
+	// Residuals are the residual stage codebooks, indexed by stage, band and
+	// codeword, nil for codebooks of a single stage. Each residual codeword is
+	// a flat slice of phase triple differences in linear magnitude, the
+	// decoder adds the residual codewords of the enhancement tokens to the
+	// primary exemplar.
+	Residuals [][][][]float64
+
+	// keys are the precomputed magnitude coordinates of Centroids
+	keys [][][]float64
+	// indexes are the nearest codeword search indexes of every band
+	indexes []*Index
+	// residualIndexes are the nearest residual codeword search indexes of every stage and band
+	residualIndexes [][]*Index
+
+	// hash is the memoized Hash, valid if hashed is set
+	hashMut sync.Mutex
+	hash    [8]byte
+	hashed  bool
+}
+
+// NewCodebook creates a codebook from per band codewords and detects its layout.
+//
+// A codebook may hold fewer bands than its layout, as partial codebooks are
+// checkpointed by kmeans1 after each band, the missing bands then decode to
+// silence and encode to codeword 0.
+func NewCodebook(centroids [][][]float64) (*Codebook, error) {
+	layout, err := detectLayout(centroids)
+	if err != nil {
+		return nil, err
+	}
+	cb, err := NewCodebookLayout(layout, centroids)
+	if err != nil {
+		return nil, err
+	}
+	cb.Version = 0
+	return cb, nil
+}
+
+// NewCodebookLayout creates a codebook from per band codewords trained for the layout.
+func NewCodebookLayout(layout Layout, centroids [][][]float64) (*Codebook, error) {
+	cb := &Codebook{
+		Version:   Version,
+		Layout:    layout,
+		Centroids: centroids,
+	}
+	cb.defaults()
+	if err := cb.validate(); err != nil {
+		return nil, err
+	}
+	if err := cb.init(); err != nil {
+		return nil, err
+	}
+	return cb, nil
+}
+
+// LoadCodebook loads a codebook file in either the JSON or the binary format.
+func LoadCodebook(centroidsFile string) (*Codebook, error) {
+	data, err := os.ReadFile(centroidsFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading centroids: %v", err)
+	}
+	return ParseCodebook(data)
+}
+
+// LoadLayout loads only the layout of a codebook file. For files carrying
+// metadata this avoids parsing the codewords.
+func LoadLayout(centroidsFile string) (Layout, error) {
+	f, err := os.Open(centroidsFile)
+	if err != nil {
+		return Layout{}, fmt.Errorf("Error reading centroids: %v", err)
+	}
+	defer f.Close()
+	r := bufio.NewReaderSize(f, 1<<16)
+	if magic, _ := r.Peek(len(binaryMagic)); IsBinaryCodebook(magic) {
+		header, _ := r.Peek(1 << 16)
+		cb, err := parseBinaryHeader(header)
+		if err != nil {
+			return Layout{}, err
+		}
+		return cb.Layout, nil
+	}
+	// the metadata precedes the centroids in JSON codebooks
+	var meta struct {
+		Version int
+		Layout
+	}
+	dec := json.NewDecoder(r)
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return Layout{}, fmt.Errorf("Error parsing centroids JSON: %v", err)
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return Layout{}, fmt.Errorf("Error parsing centroids JSON: %v", err)
+		}
+		if tok == "Centroids" {
+			break
+		}
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return Layout{}, fmt.Errorf("Error parsing centroids JSON: %v", err)
+		}
+		field, _ := json.Marshal(map[string]json.RawMessage{tok.(string): value})
+		json.Unmarshal(field, &meta)
+	}
+	if meta.Version != 0 {
+		meta.defaults()
+		return meta.Layout, meta.validate()
+	}
+	cb, err := LoadCodebook(centroidsFile)
+	if err != nil {
+		return Layout{}, err
+	}
+	return cb.Layout, nil
+}
+
+// ParseCodebook parses a binary or JSON codebook. Codebooks carrying no
+// metadata get their layout detected from the codeword sizes, besides the per
+// band codebooks of kmeans1 this accepts JSON single band codebooks of whole
+// frames.
+func ParseCodebook(data []byte) (*Codebook, error) {
+	if IsBinaryCodebook(data) {
+		return ParseBinaryCodebook(data)
+	}
+	var banded struct {
+		Version int
+		Layout
+		Seed      uint64
+		Corpus    string
+		Parents   []Parent
+		Centroids [][][]float64
+		Exemplars [][][][]float64
+		Residuals [][][][]float64
+	}
+	if err := json.Unmarshal(data, &banded); err == nil {
+		var cb *Codebook
+		if banded.Version == 0 {
+			cb, err = NewCodebook(banded.Centroids)
+		} else if banded.Version > Version {
+			return nil, fmt.Errorf("codec: unsupported codebook version %d", banded.Version)
+		} else {
+			cb, err = NewCodebookLayout(banded.Layout, banded.Centroids)
+		}
+		if err != nil {
+			return nil, err
+		}
+		cb.Seed, cb.Corpus, cb.Parents = banded.Seed, banded.Corpus, banded.Parents
+		if err := cb.SetExemplars(banded.Exemplars); err != nil {
+			return nil, err
+		}
+		return cb, cb.SetResiduals(banded.Residuals)
+	}
+	var whole struct{ Centroids [][]float64 }
+	if err := json.Unmarshal(data, &whole); err != nil {
+		return nil, fmt.Errorf("Error parsing centroids JSON: %v", err)
+	}
+	return NewCodebook([][][]float64{whole.Centroids})
+}
+
+// width returns the number of frequencies of the band codewords, or 0 if the band is empty.
+func width(band [][]float64) int {
+	for _, centroid := range band {
+		if len(centroid) != 0 {
+			return len(centroid) / 3
+		}
+	}
+	return 0
+}
+
+func detectLayout(centroids [][][]float64) (Layout, error) {
+	if len(centroids) == 0 {
+		return Layout{}, ErrUnknownLayout
+	}
+	var first = width(centroids[0])
+	for _, l := range layouts {
+		if len(centroids) == 1 && first == l.NumFreqs {
+			// whole frame codebooks of say1, with two frames per token
+			l.Ranges = []int{0, l.NumFreqs}
+			l.FramesPerGroup = 2
+			l.defaults()
+			return l, nil
+		}
+	}
+	for _, l := range layouts {
+		if len(centroids) <= l.Bands() && first == l.Ranges[1] {
+			l.Ranges = append([]int(nil), l.Ranges...)
+			l.defaults()
+			return l, nil
+		}
+	}
+	return Layout{}, ErrUnknownLayout
+}
+
+// init validates the codewords against the layout and precomputes their keys.
+func (cb *Codebook) init() error {
+	if len(cb.Centroids) > cb.Bands() {
+		return fmt.Errorf("codec: codebook has %d bands, layout has %d", len(cb.Centroids), cb.Bands())
+	}
+	cb.keys = make([][][]float64, len(cb.Centroids))
+	cb.indexes = make([]*Index, len(cb.Centroids))
+	for rang, band := range cb.Centroids {
+		want := 3 * (cb.Ranges[rang+1] - cb.Ranges[rang])
+		for idx, centroid := range band {
+			if len(centroid) != 0 && len(centroid) != want {
+				return fmt.Errorf("codec: band %d codeword %d has %d values, expected %d", rang, idx, len(centroid), want)
+			}
+		}
+		cb.keys[rang] = make([][]float64, len(band))
+		parallel.ForEach(len(band), runtime.NumCPU(), func(idx int) {
+			if len(band[idx]) != 0 {
+				cb.keys[rang][idx] = triplesKey(band[idx])
+			}
+		})
+		cb.indexes[rang] = NewIndex(cb.keys[rang])
+	}
+	cb.forgetHash()
+	return nil
+}
+
+// SetExemplars sets the alternatives of the codewords, see Exemplars.
+func (cb *Codebook) SetExemplars(exemplars [][][][]float64) error {
+	if len(exemplars) > len(cb.Centroids) {
+		return fmt.Errorf("codec: exemplars have %d bands, codebook has %d", len(exemplars), len(cb.Centroids))
+	}
+	for rang, band := range exemplars {
+		if len(band) != 0 && len(band) != cb.Size(rang) {
+			return fmt.Errorf("codec: band %d has exemplars of %d codewords, expected %d", rang, len(band), cb.Size(rang))
+		}
+		want := 3 * (cb.Ranges[rang+1] - cb.Ranges[rang])
+		for idx, alternatives := range band {
+			for _, alternative := range alternatives {
+				if len(alternative) != want {
+					return fmt.Errorf("codec: band %d codeword %d has an exemplar of %d values, expected %d", rang, idx, len(alternative), want)
+				}
+			}
+		}
+	}
+	cb.Exemplars = exemplars
+	cb.forgetHash()
+	return nil
+}
+
+// alternatives returns the number of alternatives of the codewords with the most of them.
+func (cb *Codebook) alternatives() (n int) {
+	for _, band := range cb.Exemplars {
+		for _, alternatives := range band {
+			if len(alternatives) > n {
+				n = len(alternatives)
+			}
+		}
+	}
+	return
+}
+
+// Size returns the number of codewords in band rang.
+func (cb *Codebook) Size(rang int) int {
+	if rang >= len(cb.Centroids) {
+		return 0
+	}
+	return len(cb.Centroids[rang])
+}
@@ -0,0 +1,209 @@
+// Package codec implements the gospeak acoustic codec.
+//
+// Speech is converted into phase-preserving spectrogram frames (see
+// github.com/neurlang/gomel/phase), every frame is split into frequency
+// bands, and each band is replaced by the index of its nearest codeword in a
+// Codebook trained by kmeans1. A token frame is therefore one uint32 index
+// per band, and an utterance is a flat []uint32 of consecutive token frames.
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/neurlang/gomel/phase"
+)
+
+var (
+	// ErrUnsupportedSampleRate is returned for an invalid sample rate
+	ErrUnsupportedSampleRate = errors.New("codec: unsupported sample rate")
+	// ErrUnknownLayout is returned when a codebook does not match any known band layout
+	ErrUnknownLayout = errors.New("codec: unknown codebook layout")
+	// ErrTokenRange is returned when a token does not index a codeword of its band
+	ErrTokenRange = errors.New("codec: token out of codebook range")
+)
+
+// MaxBandBits is the largest token bit width of a band.
+const MaxBandBits = 24
+
+// Layout describes the spectrogram geometry used by a codec.
+type Layout struct {
+	// SampleRate is the codec native sample rate
+	SampleRate int
+	// NumFreqs is the number of spectrogram frequencies per frame
+	NumFreqs int
+	// Window is the spectrogram hop size in samples
+	Window int
+	// Resolut is the spectrogram FFT size in samples
+	Resolut int
+	// VolumeBoost is the gain applied to decoded audio
+	VolumeBoost float64
+	// Ranges are the band edges, band b spans frequencies Ranges[b] to Ranges[b+1]
+	Ranges []int
+	// FramesPerGroup is the number of token frames packed into one token
+	// group by the models trained on top of the codec
+	FramesPerGroup int
+	// BandBits are the token bit widths of the bands chosen by kmeans1
+	// --bitrate or --band-bits, nil when the widths follow the codebook sizes
+	BandBits []int `json:",omitempty"`
+}
+
+var layouts = []Layout{
+	{SampleRate: 48000, NumFreqs: 384 * 2, Ranges: []int{0, 38, 88, 134, 184, 234, 367, 501, 384 * 2}},
+	{SampleRate: 44100, NumFreqs: 418 * 2, Ranges: []int{0, 41, 95, 145, 200, 254, 400, 545, 418 * 2}},
+}
+
+// LayoutFor returns the default layout of the sample rate family the sample
+// rate belongs to. Multiples of 11025 Hz belong to the 44.1 kHz family, any
+// other sample rate is resampled to 48 kHz.
+func LayoutFor(sampleRate uint32) (Layout, error) {
+	var l Layout
+	switch {
+	case sampleRate == 0:
+		return Layout{}, ErrUnsupportedSampleRate
+	case sampleRate%11025 == 0:
+		l = layouts[1]
+	default:
+		l = layouts[0]
+	}
+	l.Ranges = append([]int(nil), l.Ranges...)
+	l.defaults()
+	return l, nil
+}
+
+// defaults fills in the parameters which legacy codebooks did not store.
+func (l *Layout) defaults() {
+	if l.Window == 0 {
+		l.Window = 640 * 2
+	}
+	if l.Resolut == 0 {
+		l.Resolut = 2048 * 2
+	}
+	if l.VolumeBoost == 0 {
+		l.VolumeBoost = 4
+	}
+	if l.FramesPerGroup == 0 {
+		l.FramesPerGroup = 1
+	}
+}
+
+// SetBands changes the band edges. The spec is either a band count, giving
+// bands of equal width on the mel scale, or the comma separated band edges
+// from 0 to NumFreqs.
+func (l *Layout) SetBands(spec string) error {
+	var ranges []int
+	if !strings.Contains(spec, ",") {
+		bands, err := strconv.Atoi(strings.TrimSpace(spec))
+		if err != nil || bands <= 0 || bands > l.NumFreqs {
+			return fmt.Errorf("codec: invalid band count %q", spec)
+		}
+		ranges = melRanges(l, bands)
+	} else {
+		for _, edge := range strings.Split(spec, ",") {
+			n, err := strconv.Atoi(strings.TrimSpace(edge))
+			if err != nil {
+				return fmt.Errorf("codec: invalid band edge %q", edge)
+			}
+			ranges = append(ranges, n)
+		}
+	}
+	var old, oldBits = l.Ranges, l.BandBits
+	l.Ranges, l.BandBits = ranges, nil
+	if err := l.validate(); err != nil {
+		l.Ranges, l.BandBits = old, oldBits
+		return fmt.Errorf("codec: invalid band edges %v", ranges)
+	}
+	return nil
+}
+
+// FrameRate returns the number of token frames per second.
+func (l *Layout) FrameRate() float64 {
+	return float64(l.SampleRate) / float64(l.Window)
+}
+
+// melRanges splits the frequencies into bands of equal mel scale width.
+func melRanges(l *Layout, bands int) []int {
+	mel := func(hz float64) float64 { return 2595 * math.Log10(1+hz/700) }
+	hz := func(mel float64) float64 { return 700 * (math.Pow(10, mel/2595) - 1) }
+	binHz := float64(l.SampleRate) / float64(l.Resolut)
+	top := mel(float64(l.NumFreqs) * binHz)
+	var ranges = []int{0}
+	for i := 1; i < bands; i++ {
+		edge := int(math.Round(hz(top*float64(i)/float64(bands)) / binHz))
+		if edge <= ranges[i-1] {
+			edge = ranges[i-1] + 1
+		}
+		ranges = append(ranges, edge)
+	}
+	for i := bands - 1; i > 0 && ranges[i] >= l.NumFreqs-(bands-i)+1; i-- {
+		ranges[i] = l.NumFreqs - (bands - i)
+	}
+	return append(ranges, l.NumFreqs)
+}
+
+// validate checks that the layout parameters are consistent.
+func (l *Layout) validate() error {
+	if l.SampleRate <= 0 || l.NumFreqs <= 0 || l.Window <= 0 || l.Resolut <= 0 || l.FramesPerGroup <= 0 {
+		return ErrUnknownLayout
+	}
+	if 2*l.NumFreqs > l.Resolut || l.Bands() == 0 || l.Ranges[0] != 0 || l.Ranges[l.Bands()] != l.NumFreqs {
+		return ErrUnknownLayout
+	}
+	for i := 1; i < len(l.Ranges); i++ {
+		if l.Ranges[i] <= l.Ranges[i-1] {
+			return ErrUnknownLayout
+		}
+	}
+	if l.BandBits != nil && len(l.BandBits) != l.Bands() {
+		return ErrUnknownLayout
+	}
+	for _, n := range l.BandBits {
+		if n < 0 || n > MaxBandBits {
+			return ErrUnknownLayout
+		}
+	}
+	return nil
+}
+
+// Bands returns the number of bands per token frame.
+func (l *Layout) Bands() int {
+	if len(l.Ranges) == 0 {
+		return 0
+	}
+	return len(l.Ranges) - 1
+}
+
+// Phase returns a spectrogram converter configured for the layout.
+func (l *Layout) Phase() *phase.Phase {
+	m := phase.NewPhase()
+	m.YReverse = true
+	m.Window = l.Window
+	m.NumFreqs = l.NumFreqs
+	m.Resolut = l.Resolut
+	m.VolumeBoost = l.VolumeBoost
+	return m
+}
+
+// BandKey converts spectrogram frames of one band to the magnitude
+// coordinates used for codeword matching.
+func BandKey(frames [][3]float64) []float64 {
+	var key = make([]float64, 0, 2*len(frames))
+	for _, frame := range frames {
+		val1 := math.Sqrt(math.Pow(math.Exp2(frame[1]), 2) + math.Pow(math.Exp2(frame[2]), 2))
+		val2 := math.Sqrt(math.Pow(math.Exp2(frame[0]), 2) + math.Pow(math.Exp2(frame[1]), 2))
+		key = append(key, val1, val2)
+	}
+	return key
+}
+
+// triplesKey is BandKey for a flat codeword of phase triples.
+func triplesKey(centroid []float64) []float64 {
+	var key = make([]float64, 0, 2*(len(centroid)/3))
+	for i := 0; 3*i+2 < len(centroid); i++ {
+		key = append(key, BandKey([][3]float64{{centroid[3*i], centroid[3*i+1], centroid[3*i+2]}})...)
+	}
+	return key
+}
@@ -0,0 +1,158 @@
+package codec
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/neurlang/gomel/phase"
+)
+
+// silence is the log2 spectrogram floor, used for bands missing from the codebook
+var silence = math.Log2(1e-10)
+
+// Decoder converts token frames back into audio.
+//
+// The spectrogram starts with the first token frame, and the bands missing
+// from the codebook or from a trailing incomplete frame are the silence floor
+// log2(1e-10). The decoders of codec1 and say1 this replaces started with a
+// frame of zeros and left the missing bands at 0, a magnitude of 1.
+//
+// A codeword having Exemplars decodes to the exemplar nearest to the band of
+// the frame before, so the same tokens may decode differently after different
+// frames. The leading frame of an utterance has no frame before, its codewords
+// decode to themselves.
+type Decoder struct {
+	cb *Codebook
+}
+
+// NewDecoder creates a decoder for the codebook.
+func NewDecoder(cb *Codebook) *Decoder {
+	return &Decoder{cb: cb}
+}
+
+// SampleRate returns the sample rate of the decoded audio.
+func (d *Decoder) SampleRate() int {
+	return d.cb.SampleRate
+}
+
+// Frames converts token frames into a phase spectrogram. A trailing
+// incomplete token frame is decoded with its missing bands silent.
+func (d *Decoder) Frames(tokens []uint32) ([][3]float64, error) {
+	return d.frames(tokens, nil, nil)
+}
+
+// FramesLayers converts token frames and their enhancement layer, the tokens
+// of the first residual stages, into a phase spectrogram.
+func (d *Decoder) FramesLayers(tokens []uint32, enhancement [][]uint32) ([][3]float64, error) {
+	return d.frames(tokens, enhancement, nil)
+}
+
+// frames converts token frames into a phase spectrogram following the
+// previous frame, nil at the start of an utterance. Codewords having
+// exemplars decode to the exemplar most similar to the frame before, unless
+// an enhancement layer refines the primary exemplar.
+func (d *Decoder) frames(tokens []uint32, enhancement [][]uint32, previous [][3]float64) ([][3]float64, error) {
+	if len(enhancement) > len(d.cb.Residuals) {
+		return nil, fmt.Errorf("codec: %d residual stages decoded, the codebook has %d", len(enhancement), len(d.cb.Residuals))
+	}
+	bands := d.cb.Bands()
+	frames := (len(tokens) + bands - 1) / bands
+	var buf = make([][3]float64, frames*d.cb.NumFreqs)
+	for i := range buf {
+		buf[i] = [3]float64{silence, silence, silence}
+	}
+	for iii, token := range tokens {
+		jj, rang := iii/bands, iii%bands
+		if rang >= len(d.cb.Centroids) {
+			continue
+		}
+		if int(token) >= len(d.cb.Centroids[rang]) {
+			return nil, fmt.Errorf("%w: band %d token %d", ErrTokenRange, rang, token)
+		}
+		centroid := d.cb.Centroids[rang][token]
+		frame := buf[jj*d.cb.NumFreqs+d.cb.Ranges[rang]:]
+		if len(enhancement) == 0 && rang < len(d.cb.Exemplars) && int(token) < len(d.cb.Exemplars[rang]) {
+			before := previous
+			if jj > 0 {
+				before = buf[(jj-1)*d.cb.NumFreqs:]
+			}
+			if before != nil {
+				centroid = nearestExemplar(centroid, d.cb.Exemplars[rang][token], before[d.cb.Ranges[rang]:])
+			}
+		}
+		for i := 0; 3*i+2 < len(centroid); i++ {
+			frame[i] = [3]float64{centroid[3*i], centroid[3*i+1], centroid[3*i+2]}
+		}
+		if len(enhancement) > 0 && len(centroid) > 0 {
+			var stages = make([]uint32, 0, len(enhancement))
+			for _, layer := range enhancement {
+				if iii < len(layer) {
+					stages = append(stages, layer[iii])
+				}
+			}
+			if err := d.cb.addResiduals(frame, rang, stages); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return buf, nil
+}
+
+// Decode converts token frames into mono audio at SampleRate.
+func (d *Decoder) Decode(tokens []uint32) ([]float64, error) {
+	return d.DecodeLayers(tokens, nil)
+}
+
+// DecodeLayers converts token frames and their enhancement layer into mono
+// audio at SampleRate, see FramesLayers.
+func (d *Decoder) DecodeLayers(tokens []uint32, enhancement [][]uint32) ([]float64, error) {
+	buf, err := d.FramesLayers(tokens, enhancement)
+	if err != nil {
+		return nil, err
+	}
+	return d.Synthesize(buf)
+}
+
+// Synthesize converts a phase spectrogram of Frames into mono audio at
+// SampleRate. The spectrogram is overwritten.
+func (d *Decoder) Synthesize(frames [][3]float64) ([]float64, error) {
+	if len(frames) == 0 {
+		return nil, nil
+	}
+	return d.cb.Phase().FromPhase(frames)
+}
+
+// DecodeFile decodes token frames into a WAV file.
+func (d *Decoder) DecodeFile(tokens []uint32, outputFile string) error {
+	return d.DecodeFileLayers(tokens, nil, outputFile)
+}
+
+// DecodeFileLayers decodes token frames and their enhancement layer into a WAV file.
+func (d *Decoder) DecodeFileLayers(tokens []uint32, enhancement [][]uint32, outputFile string) error {
+	speech, err := d.DecodeLayers(tokens, enhancement)
+	if err != nil {
+		return err
+	}
+	return phase.SaveWav(outputFile, speech, d.SampleRate())
+}
+
+// nearestExemplar returns the codeword or the alternative closest to the
+// phase triples of the frame before.
+func nearestExemplar(centroid []float64, alternatives [][]float64, before [][3]float64) []float64 {
+	distance := func(codeword []float64) (dist float64) {
+		for i := 0; 3*i+2 < len(codeword); i++ {
+			for l := 0; l < 3; l++ {
+				diff := codeword[3*i+l] - before[i][l]
+				dist += diff * diff
+			}
+		}
+		return
+	}
+	best, bestDist := centroid, distance(centroid)
+	for _, alternative := range alternatives {
+		if dist := distance(alternative); dist < bestDist {
+			best, bestDist = alternative, dist
+		}
+	}
+	return best
+}
@@ -0,0 +1,102 @@
+package codec
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDecoderLeadingFrame(t *testing.T) {
+	layout, err := LayoutFor(48000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a codebook of the first two bands, of two codewords each
+	var centroids = make([][][]float64, 2)
+	for rang := range centroids {
+		width := 3 * (layout.Ranges[rang+1] - layout.Ranges[rang])
+		for idx := 0; idx < 2; idx++ {
+			var codeword = make([]float64, width)
+			for i := range codeword {
+				codeword[i] = float64(100*rang+10*idx) + float64(i%3)
+			}
+			centroids[rang] = append(centroids[rang], codeword)
+		}
+	}
+	cb, err := NewCodebook(centroids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a frame of the two bands and a trailing frame of the first band only
+	buf, err := NewDecoder(cb).Frames([]uint32{1, 0, 0, 0, 0, 0, 0, 0, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buf) != 2*layout.NumFreqs {
+		t.Fatalf("%d frequencies, want 2 frames of %d without a leading frame", len(buf), layout.NumFreqs)
+	}
+	var floor = math.Log2(1e-10)
+	for j := 0; j < 2; j++ {
+		for f := 0; f < layout.NumFreqs; f++ {
+			var want = [3]float64{floor, floor, floor}
+			switch {
+			case f < layout.Ranges[1]:
+				v := float64(10 * (1 - j))
+				want = [3]float64{v, v + 1, v + 2}
+			case f < layout.Ranges[2] && j == 0:
+				want = [3]float64{100, 101, 102}
+			}
+			if got := buf[j*layout.NumFreqs+f]; got != want {
+				t.Fatalf("frame %d frequency %d: %v, want %v", j, f, got, want)
+			}
+		}
+	}
+}
+
+func TestDecoderExemplars(t *testing.T) {
+	layout, err := LayoutFor(48000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a codebook of the first band, of the codewords 0 and 10, the latter
+	// having the alternative 1
+	width := 3 * layout.Ranges[1]
+	codeword := func(v float64) []float64 {
+		var c = make([]float64, width)
+		for i := range c {
+			c[i] = v
+		}
+		return c
+	}
+	cb, err := NewCodebook([][][]float64{{codeword(0), codeword(10)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cb.SetExemplars([][][][]float64{{nil, {codeword(1)}}}); err != nil {
+		t.Fatal(err)
+	}
+	var frame = make([]uint32, cb.Bands())
+	for _, c := range []struct {
+		name   string
+		tokens []uint32
+		want   []float64
+	}{
+		{"leading frame", []uint32{1}, []float64{10}},
+		{"after silence", []uint32{0, 1}, []float64{0, 1}},
+		{"after itself", []uint32{1, 1}, []float64{10, 10}},
+	} {
+		var tokens []uint32
+		for _, token := range c.tokens {
+			frame[0] = token
+			tokens = append(tokens, frame...)
+		}
+		buf, err := NewDecoder(cb).Frames(tokens)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j, v := range c.want {
+			if got := buf[j*layout.NumFreqs]; got != [3]float64{v, v, v} {
+				t.Errorf("%s: frame %d decoded to %v, want %v", c.name, j, got, v)
+			}
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package codec
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/neurlang/classifier/parallel"
+)
+
+// Encoder converts audio into token frames.
+type Encoder struct {
+	cb *Codebook
+
+	// Threads is the number of frames encoded in parallel
+	Threads int
+
+	// Linear disables the nearest codeword index in favour of a linear scan
+	Linear bool
+}
+
+// NewEncoder creates an encoder for the codebook.
+func NewEncoder(cb *Codebook) *Encoder {
+	return &Encoder{
+		cb:      cb,
+		Threads: 100,
+	}
+}
+
+// EncodeFile loads a FLAC or WAV file and encodes it.
+func (e *Encoder) EncodeFile(inputFile string) ([]uint32, error) {
+	audio, sampleRate, err := LoadAudio(inputFile)
+	if err != nil {
+		return nil, err
+	}
+	return e.Encode(audio, sampleRate)
+}
+
+// Encode encodes mono audio of any sample rate.
+func (e *Encoder) Encode(audio []float64, sampleRate uint32) ([]uint32, error) {
+	tokens, _, err := e.EncodeLayers(audio, sampleRate, 1)
+	return tokens, err
+}
+
+// EncodeFileLayers loads a FLAC or WAV file and encodes it in the given number of stages.
+func (e *Encoder) EncodeFileLayers(inputFile string, stages int) ([]uint32, [][]uint32, error) {
+	audio, sampleRate, err := LoadAudio(inputFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	return e.EncodeLayers(audio, sampleRate, stages)
+}
+
+// EncodeLayers encodes mono audio of any sample rate in the given number of
+// stages, returning the base tokens and the enhancement layer, the tokens of
+// every residual stage.
+func (e *Encoder) EncodeLayers(audio []float64, sampleRate uint32, stages int) ([]uint32, [][]uint32, error) {
+	audio, err := ToNative(audio, sampleRate, &e.cb.Layout)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Convert to phase spectrogram
+	melFrames, err := e.cb.Phase().ToPhase(audio)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error creating spectrogram: %v", err)
+	}
+	return e.EncodeFramesLayers(melFrames, stages)
+}
+
+// EncodeFrames encodes a phase spectrogram of whole frames.
+func (e *Encoder) EncodeFrames(melFrames [][3]float64) ([]uint32, error) {
+	tokens, _, err := e.EncodeFramesLayers(melFrames, 1)
+	return tokens, err
+}
+
+// EncodeFramesLayers encodes a phase spectrogram of whole frames in the given
+// number of stages, 1 ~ Codebook.Stages, see EncodeLayers.
+func (e *Encoder) EncodeFramesLayers(melFrames [][3]float64, stages int) ([]uint32, [][]uint32, error) {
+	if stages < 1 || stages > e.cb.Stages() {
+		return nil, nil, fmt.Errorf("codec: %d stages requested, the codebook has %d", stages, e.cb.Stages())
+	}
+	frameSize := e.cb.NumFreqs
+	bands := e.cb.Bands()
+	frames := len(melFrames) / frameSize
+	var indices = make([]uint32, bands*frames)
+	var enhancement = make([][]uint32, stages-1)
+	for stage := range enhancement {
+		enhancement[stage] = make([]uint32, bands*frames)
+	}
+	parallel.ForEach(frames, e.Threads, func(jj int) {
+		j := jj * frameSize
+		e.encodeFrame(indices[bands*jj:bands*jj+bands], melFrames[j:j+frameSize])
+		if len(enhancement) > 0 {
+			var out = make([][]uint32, len(enhancement))
+			for stage := range out {
+				out[stage] = enhancement[stage][bands*jj : bands*jj+bands]
+			}
+			e.cb.encodeResiduals(out, indices[bands*jj:bands*jj+bands], melFrames[j:j+frameSize])
+		}
+	})
+	return indices, enhancement, nil
+}
+
+// encodeFrame stores the nearest codeword of every band of a frame into out.
+func (e *Encoder) encodeFrame(out []uint32, frame [][3]float64) {
+	for rang := range out {
+		if rang >= len(e.cb.keys) || len(e.cb.keys[rang]) == 0 {
+			break
+		}
+		key := BandKey(frame[e.cb.Ranges[rang]:e.cb.Ranges[rang+1]])
+		if e.Linear {
+			out[rang] = uint32(nearest(e.cb.keys[rang], key))
+		} else if idx, _ := e.cb.indexes[rang].Nearest(key); idx >= 0 {
+			out[rang] = uint32(idx)
+		}
+	}
+}
+
+// nearest finds the closest codeword key by squared euclidean distance.
+func nearest(keys [][]float64, key []float64) int {
+	minDist := math.MaxFloat64
+	nearestIdx := 0
+	for idx, valueCoords := range keys {
+		if len(valueCoords) == 0 {
+			continue
+		}
+		var dist float64
+		for k := range key {
+			diff := key[k] - valueCoords[k]
+			dist += diff * diff
+		}
+		if dist < minDist {
+			minDist = dist
+			nearestIdx = idx
+		}
+	}
+	return nearestIdx
+}
@@ -0,0 +1,442 @@
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+)
+
+// Packed token bitstream (.gsc) layout, all integers are little-endian:
+//
+//	magic    [4]byte  "GSCT"
+//	version  uint16
+//	flags    uint16   GSCRangeCoded if the payload is range coded, GSCEnhancement for an enhancement layer
+//	hash     [8]byte  Codebook.Hash of the codebook the tokens index
+//	frames   uint32   number of token frames
+//	bands    uint16
+//	bits     [bands]uint8  bit width of the tokens of every band
+//	payload
+//
+// The packed payload stores the tokens frame by frame, every token in the
+// bit width of its band, most significant bit first. The range coded payload
+// codes the same bits with an adaptive binary range coder, using separate
+// adaptive statistics for every band.
+const gscMagic = "GSCT"
+
+// GSCVersion is the version of the packed token bitstream written
+const GSCVersion = 1
+
+// Header flags of the packed token bitstream
+const (
+	// GSCRangeCoded is the header flag of a range coded payload
+	GSCRangeCoded = 1
+	// GSCEnhancement is the header flag of an enhancement layer, see WriteGSCEnhancement
+	GSCEnhancement = 2
+)
+
+var (
+	// ErrBadBitstream is returned when a packed token bitstream is malformed
+	ErrBadBitstream = errors.New("codec: malformed token bitstream")
+	// ErrCodebookMismatch is returned when a token bitstream was encoded with another codebook
+	ErrCodebookMismatch = errors.New("codec: token bitstream encoded with another codebook")
+)
+
+// GSCHeader describes a packed token bitstream.
+type GSCHeader struct {
+	Version int
+	Flags   int
+	Hash    [8]byte
+	Frames  int
+	// Bits is the bit width of the tokens of every band
+	Bits []int
+}
+
+// IsGSC reports whether data starts like a packed token bitstream.
+func IsGSC(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(gscMagic))
+}
+
+// Hash identifies the codewords of the codebook, it is the start of the
+// SHA-256 of the layout and the codewords in a canonical encoding, which does
+// not depend on the codebook format, its version or the other metadata. It is
+// computed once, the codewords must not change afterwards but through
+// SetExemplars and SetResiduals.
+func (cb *Codebook) Hash() [8]byte {
+	cb.hashMut.Lock()
+	defer cb.hashMut.Unlock()
+	if !cb.hashed {
+		cb.hash, cb.hashed = cb.computeHash(), true
+	}
+	return cb.hash
+}
+
+// forgetHash makes Hash compute the hash again, after the codewords changed.
+func (cb *Codebook) forgetHash() {
+	cb.hashMut.Lock()
+	cb.hashed = false
+	cb.hashMut.Unlock()
+}
+
+// computeHash hashes the spectrogram parameters and the band edges, then for
+// every band the codewords, for every codeword its alternatives, and for every
+// residual stage the codewords of its bands. Every list is preceded by its
+// length, all integers are little-endian uint32, the values float32, empty
+// codewords NaN.
+func (cb *Codebook) computeHash() (hash [8]byte) {
+	h := sha256.New()
+	bw := bufio.NewWriter(h)
+	var buf [4]byte
+	put := func(v uint32) {
+		binary.LittleEndian.PutUint32(buf[:], v)
+		bw.Write(buf[:])
+	}
+	codewords := func(band [][]float64, values int) {
+		put(uint32(len(band)))
+		for _, codeword := range band {
+			for i := 0; i < values; i++ {
+				var v = math.NaN()
+				if len(codeword) != 0 {
+					v = codeword[i]
+				}
+				put(math.Float32bits(float32(v)))
+			}
+		}
+	}
+	for _, v := range []int{cb.SampleRate, cb.NumFreqs, cb.Window, cb.Resolut} {
+		put(uint32(v))
+	}
+	put(math.Float32bits(float32(cb.VolumeBoost)))
+	put(uint32(cb.FramesPerGroup))
+	put(uint32(len(cb.Ranges)))
+	for _, edge := range cb.Ranges {
+		put(uint32(edge))
+	}
+	put(uint32(len(cb.Centroids)))
+	for rang, band := range cb.Centroids {
+		values := 3 * (cb.Ranges[rang+1] - cb.Ranges[rang])
+		codewords(band, values)
+		for idx := range band {
+			var alternatives [][]float64
+			if rang < len(cb.Exemplars) && idx < len(cb.Exemplars[rang]) {
+				alternatives = cb.Exemplars[rang][idx]
+			}
+			codewords(alternatives, values)
+		}
+	}
+	put(uint32(len(cb.Residuals)))
+	for _, bands := range cb.Residuals {
+		put(uint32(len(bands)))
+		for rang, band := range bands {
+			codewords(band, 3*(cb.Ranges[rang+1]-cb.Ranges[rang]))
+		}
+	}
+	bw.Flush()
+	copy(hash[:], h.Sum(nil))
+	return
+}
+
+// Parent is a codebook another one was adapted from. The adapted codebook
+// keeps the codeword IDs of its parent, so it reads the token bitstreams
+// written with the parent, in the bit widths of the parent.
+type Parent struct {
+	// Hash is the Codebook.Hash of the parent, in hex
+	Hash string
+	// Bits are the token bit widths of the bands of the parent
+	Bits []int
+}
+
+// hash decodes the hash of the parent.
+func (p *Parent) hash() (hash [8]byte, err error) {
+	if n, err := hex.Decode(hash[:], []byte(p.Hash)); err != nil || n != len(hash) {
+		return hash, fmt.Errorf("codec: invalid parent codebook hash %q", p.Hash)
+	}
+	return hash, nil
+}
+
+// Lineage returns the Parents of a codebook adapted from this one: this
+// codebook followed by its own parents.
+func (cb *Codebook) Lineage() []Parent {
+	hash := cb.Hash()
+	var parent = Parent{Hash: hex.EncodeToString(hash[:])}
+	for rang := 0; rang < cb.Bands(); rang++ {
+		parent.Bits = append(parent.Bits, cb.Bits(rang))
+	}
+	return append([]Parent{parent}, cb.Parents...)
+}
+
+// streamBits returns the token bit widths of the bands of the token
+// bitstreams written with the codebook of the hash, this codebook or one of
+// its parents, or nil for another codebook.
+func (cb *Codebook) streamBits(hash [8]byte) []int {
+	if hash == cb.Hash() {
+		var widths []int
+		for rang := 0; rang < cb.Bands(); rang++ {
+			widths = append(widths, cb.Bits(rang))
+		}
+		return widths
+	}
+	for i := range cb.Parents {
+		if parent, err := cb.Parents[i].hash(); err == nil && parent == hash {
+			return cb.Parents[i].Bits
+		}
+	}
+	return nil
+}
+
+// Bits returns the bit width of the tokens of a band, the width of BandBits
+// unless the codewords of the band need more.
+func (cb *Codebook) Bits(rang int) int {
+	var width int
+	if cb.Size(rang) > 1 {
+		width = bits.Len(uint(cb.Size(rang) - 1))
+	}
+	if rang < len(cb.BandBits) && cb.BandBits[rang] > width {
+		width = cb.BandBits[rang]
+	}
+	return width
+}
+
+// Bitrate returns the bits per second of the packed tokens of the bands.
+func (cb *Codebook) Bitrate() float64 {
+	var frameBits int
+	for rang := 0; rang < cb.Bands(); rang++ {
+		frameBits += cb.Bits(rang)
+	}
+	return float64(frameBits) * cb.FrameRate()
+}
+
+// WriteGSC writes token frames as a packed token bitstream, range coded if rangeCoded is set.
+func (cb *Codebook) WriteGSC(w io.Writer, tokens []uint32, rangeCoded bool) error {
+	bands := cb.Bands()
+	if len(tokens)%bands != 0 {
+		return fmt.Errorf("%w: %d tokens are not whole frames of %d bands", ErrBadBitstream, len(tokens), bands)
+	}
+	var header = GSCHeader{Version: GSCVersion, Hash: cb.Hash(), Frames: len(tokens) / bands}
+	if rangeCoded {
+		header.Flags = GSCRangeCoded
+	}
+	for rang := 0; rang < bands; rang++ {
+		header.Bits = append(header.Bits, cb.Bits(rang))
+	}
+	for i, token := range tokens {
+		if rang := i % bands; int(token) >= cb.Size(rang) && token != 0 {
+			return fmt.Errorf("%w: band %d token %d", ErrTokenRange, rang, token)
+		}
+	}
+	return writeGSC(w, &header, tokens)
+}
+
+// WriteGSCEnhancement writes the enhancement layer of token frames, the
+// tokens of the first residual stages, as a packed token bitstream, range
+// coded if rangeCoded is set. Its header has the GSCEnhancement flag and the
+// bit widths of every band of every stage, the payload stores frame by frame
+// the tokens of every stage.
+func (cb *Codebook) WriteGSCEnhancement(w io.Writer, enhancement [][]uint32, rangeCoded bool) error {
+	bands := cb.Bands()
+	if len(enhancement) == 0 || len(enhancement) > len(cb.Residuals) {
+		return fmt.Errorf("codec: %d residual stages written, the codebook has %d", len(enhancement), len(cb.Residuals))
+	}
+	frames := len(enhancement[0]) / bands
+	var header = GSCHeader{Version: GSCVersion, Flags: GSCEnhancement, Hash: cb.Hash(), Frames: frames}
+	if rangeCoded {
+		header.Flags |= GSCRangeCoded
+	}
+	var tokens = make([]uint32, 0, frames*bands*len(enhancement))
+	for stage, layer := range enhancement {
+		if len(layer) != frames*bands {
+			return fmt.Errorf("%w: %d tokens of residual stage %d are not %d frames of %d bands", ErrBadBitstream, len(layer), stage+2, frames, bands)
+		}
+		for rang := 0; rang < bands; rang++ {
+			header.Bits = append(header.Bits, cb.ResidualBits(stage+1, rang))
+		}
+	}
+	for jj := 0; jj < frames; jj++ {
+		for stage, layer := range enhancement {
+			for rang, token := range layer[jj*bands : jj*bands+bands] {
+				if int(token) >= cb.ResidualSize(stage+1, rang) && token != 0 {
+					return fmt.Errorf("%w: residual stage %d band %d token %d", ErrTokenRange, stage+2, rang, token)
+				}
+				tokens = append(tokens, token)
+			}
+		}
+	}
+	return writeGSC(w, &header, tokens)
+}
+
+// writeGSC writes the header and the tokens, every token in the bit width of
+// its position in the frame.
+func writeGSC(w io.Writer, header *GSCHeader, tokens []uint32) error {
+	bands := len(header.Bits)
+	bw := bufio.NewWriter(w)
+	bw.WriteString(gscMagic)
+	binary.Write(bw, binary.LittleEndian, [2]uint16{uint16(header.Version), uint16(header.Flags)})
+	bw.Write(header.Hash[:])
+	binary.Write(bw, binary.LittleEndian, uint32(header.Frames))
+	binary.Write(bw, binary.LittleEndian, uint16(bands))
+	for _, n := range header.Bits {
+		bw.WriteByte(byte(n))
+	}
+
+	if header.Flags&GSCRangeCoded != 0 {
+		var trees = make([]*bitTree, bands)
+		for rang := range trees {
+			trees[rang] = newBitTree(header.Bits[rang])
+		}
+		e := newRangeEncoder(bw)
+		for i, token := range tokens {
+			trees[i%bands].encode(e, token)
+		}
+		if err := e.flush(); err != nil {
+			return err
+		}
+	} else {
+		var acc uint64
+		var n int
+		for i, token := range tokens {
+			width := header.Bits[i%bands]
+			acc = acc<<uint(width) | uint64(token)
+			n += width
+			for n >= 8 {
+				n -= 8
+				bw.WriteByte(byte(acc >> uint(n)))
+			}
+		}
+		if n > 0 {
+			bw.WriteByte(byte(acc << uint(8-n)))
+		}
+	}
+	return bw.Flush()
+}
+
+// ReadGSCHeader parses the header of a packed token bitstream.
+func ReadGSCHeader(r io.Reader) (*GSCHeader, error) {
+	var fixed [4 + 4 + 8 + 4 + 2]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return nil, ErrBadBitstream
+	}
+	if !IsGSC(fixed[:]) {
+		return nil, ErrBadBitstream
+	}
+	var header = GSCHeader{
+		Version: int(binary.LittleEndian.Uint16(fixed[4:])),
+		Flags:   int(binary.LittleEndian.Uint16(fixed[6:])),
+		Frames:  int(binary.LittleEndian.Uint32(fixed[16:])),
+	}
+	copy(header.Hash[:], fixed[8:16])
+	if header.Version != GSCVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrBadBitstream, header.Version)
+	}
+	var widths = make([]byte, binary.LittleEndian.Uint16(fixed[20:]))
+	if _, err := io.ReadFull(r, widths); err != nil {
+		return nil, ErrBadBitstream
+	}
+	for _, n := range widths {
+		if n > 32 {
+			return nil, ErrBadBitstream
+		}
+		header.Bits = append(header.Bits, int(n))
+	}
+	return &header, nil
+}
+
+// ReadGSC reads the token frames of a packed token bitstream encoded with the
+// codebook, or with one of the Parents it was adapted from.
+func (cb *Codebook) ReadGSC(r io.Reader) ([]uint32, error) {
+	br := bufio.NewReader(r)
+	header, err := ReadGSCHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	widths := cb.streamBits(header.Hash)
+	if widths == nil {
+		return nil, ErrCodebookMismatch
+	}
+	if header.Flags&GSCEnhancement != 0 || len(header.Bits) != cb.Bands() || len(widths) != cb.Bands() {
+		return nil, ErrBadBitstream
+	}
+	for rang, width := range header.Bits {
+		if width != widths[rang] {
+			return nil, ErrBadBitstream
+		}
+	}
+	return readGSC(br, header)
+}
+
+// ReadGSCEnhancement reads the enhancement layer written by WriteGSCEnhancement.
+// Adapting a codebook trains its residual stages again, so the enhancement
+// layers written with the Parents are refused.
+func (cb *Codebook) ReadGSCEnhancement(r io.Reader) ([][]uint32, error) {
+	br := bufio.NewReader(r)
+	header, err := ReadGSCHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	if header.Hash != cb.Hash() {
+		return nil, ErrCodebookMismatch
+	}
+	bands := cb.Bands()
+	stages := len(header.Bits) / bands
+	if header.Flags&GSCEnhancement == 0 || stages == 0 || stages*bands != len(header.Bits) || stages > len(cb.Residuals) {
+		return nil, ErrBadBitstream
+	}
+	for i, width := range header.Bits {
+		if width != cb.ResidualBits(i/bands+1, i%bands) {
+			return nil, ErrBadBitstream
+		}
+	}
+	tokens, err := readGSC(br, header)
+	if err != nil {
+		return nil, err
+	}
+	var enhancement = make([][]uint32, stages)
+	for i, token := range tokens {
+		stage := i / bands % stages
+		enhancement[stage] = append(enhancement[stage], token)
+	}
+	return enhancement, nil
+}
+
+// readGSC reads the tokens following the header.
+func readGSC(br *bufio.Reader, header *GSCHeader) ([]uint32, error) {
+	bands := len(header.Bits)
+	var tokens []uint32
+
+	if header.Flags&GSCRangeCoded != 0 {
+		var trees = make([]*bitTree, bands)
+		for rang := range trees {
+			trees[rang] = newBitTree(header.Bits[rang])
+		}
+		d := newRangeDecoder(br)
+		for i := 0; i < header.Frames*bands && d.err == nil; i++ {
+			tokens = append(tokens, trees[i%bands].decode(d))
+		}
+		if d.err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrBadBitstream, d.err)
+		}
+		return tokens, nil
+	}
+
+	var acc uint64
+	var n int
+	for i := 0; i < header.Frames*bands; i++ {
+		width := header.Bits[i%bands]
+		for n < width {
+			b, err := br.ReadByte()
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrBadBitstream, err)
+			}
+			acc = acc<<8 | uint64(b)
+			n += 8
+		}
+		n -= width
+		tokens = append(tokens, uint32(acc>>uint(n)&(1<<uint(width)-1)))
+	}
+	return tokens, nil
+}
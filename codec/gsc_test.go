@@ -0,0 +1,275 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// randomTokens returns token frames of the codebook, skewed towards the low
+// codewords like real usage.
+func randomTokens(rng *rand.Rand, cb *Codebook, frames int) []uint32 {
+	var tokens = make([]uint32, 0, frames*cb.Bands())
+	for jj := 0; jj < frames; jj++ {
+		for rang := 0; rang < cb.Bands(); rang++ {
+			token := uint32(rng.ExpFloat64() * 1.5)
+			if int(token) >= cb.Size(rang) {
+				token = uint32(cb.Size(rang) - 1)
+			}
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+func TestGSCRoundtrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(7))
+	cb := testCodebook(t, rng, []int{200, 17, 2}, Float32)
+	for _, frames := range []int{0, 1, 3, 1000} {
+		tokens := randomTokens(rng, cb, frames)
+		var sizes []int
+		for _, rangeCoded := range []bool{false, true} {
+			var buf bytes.Buffer
+			if err := cb.WriteGSC(&buf, tokens, rangeCoded); err != nil {
+				t.Fatal(err)
+			}
+			sizes = append(sizes, buf.Len())
+			got, err := cb.ReadGSC(&buf)
+			if err != nil {
+				t.Fatalf("%d frames, range coded %v: %v", frames, rangeCoded, err)
+			}
+			if len(got) != len(tokens) || (len(tokens) > 0 && !reflect.DeepEqual(got, tokens)) {
+				t.Errorf("%d frames, range coded %v: tokens differ", frames, rangeCoded)
+			}
+		}
+		if frames == 1000 && sizes[1] >= sizes[0] {
+			t.Errorf("range coded %d bytes, packed %d, want smaller", sizes[1], sizes[0])
+		}
+	}
+}
+
+func TestGSCPackedSize(t *testing.T) {
+	cb := testCodebook(t, rand.New(rand.NewSource(8)), []int{200, 17, 2}, Float32)
+	var buf bytes.Buffer
+	if err := cb.WriteGSC(&buf, randomTokens(rand.New(rand.NewSource(9)), cb, 8), false); err != nil {
+		t.Fatal(err)
+	}
+	// 8 frames of 8+5+1 bits after the header
+	if want := 22 + 3 + 14; buf.Len() != want {
+		t.Errorf("packed %d bytes, want %d", buf.Len(), want)
+	}
+}
+
+func TestGSCEnhancementRoundtrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(10))
+	cb := testCodebook(t, rng, []int{8, 8, 8}, Float32)
+	var residuals = make([][][][]float64, 2)
+	for stage := range residuals {
+		residuals[stage] = randomCodewords(rng, cb.Layout, []int{5, 3, 2}, Float32)
+	}
+	if err := cb.SetResiduals(residuals); err != nil {
+		t.Fatal(err)
+	}
+	var enhancement = make([][]uint32, 2)
+	for stage := range enhancement {
+		for i := 0; i < 50*cb.Bands(); i++ {
+			enhancement[stage] = append(enhancement[stage], uint32(rng.Intn(cb.ResidualSize(stage+1, i%cb.Bands()))))
+		}
+	}
+	for _, rangeCoded := range []bool{false, true} {
+		var buf bytes.Buffer
+		if err := cb.WriteGSCEnhancement(&buf, enhancement, rangeCoded); err != nil {
+			t.Fatal(err)
+		}
+		data := buf.Bytes()
+		got, err := cb.ReadGSCEnhancement(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("range coded %v: %v", rangeCoded, err)
+		}
+		if !reflect.DeepEqual(got, enhancement) {
+			t.Errorf("range coded %v: enhancement differs", rangeCoded)
+		}
+		if _, err := cb.ReadGSC(bytes.NewReader(data)); !errors.Is(err, ErrBadBitstream) {
+			t.Errorf("enhancement layer read as base tokens: %v", err)
+		}
+	}
+}
+
+func TestGSCCodebookMismatch(t *testing.T) {
+	rng := rand.New(rand.NewSource(11))
+	cb := testCodebook(t, rng, []int{8, 8, 8}, Float32)
+	other := testCodebook(t, rng, []int{8, 8, 8}, Float32)
+	var buf bytes.Buffer
+	if err := cb.WriteGSC(&buf, randomTokens(rng, cb, 10), false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.ReadGSC(&buf); !errors.Is(err, ErrCodebookMismatch) {
+		t.Errorf("got %v, want ErrCodebookMismatch", err)
+	}
+}
+
+func TestGSCTruncated(t *testing.T) {
+	rng := rand.New(rand.NewSource(12))
+	cb := testCodebook(t, rng, []int{200, 17, 2}, Float32)
+	for _, rangeCoded := range []bool{false, true} {
+		var buf bytes.Buffer
+		if err := cb.WriteGSC(&buf, randomTokens(rng, cb, 100), rangeCoded); err != nil {
+			t.Fatal(err)
+		}
+		data := buf.Bytes()
+		for _, n := range []int{0, 10, 24, len(data) / 2} {
+			if _, err := cb.ReadGSC(bytes.NewReader(data[:n])); !errors.Is(err, ErrBadBitstream) {
+				t.Errorf("range coded %v truncated to %d of %d bytes: got %v, want ErrBadBitstream", rangeCoded, n, len(data), err)
+			}
+		}
+	}
+}
+
+func TestRangeCoderRoundtrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(13))
+	for _, width := range []int{0, 1, 5, 15, 24} {
+		var symbols []uint32
+		for i := 0; i < 5000; i++ {
+			symbols = append(symbols, uint32(rng.ExpFloat64()*3)&(1<<width-1))
+		}
+		var buf bytes.Buffer
+		e := newRangeEncoder(&buf)
+		tree := newBitTree(width)
+		for _, symbol := range symbols {
+			tree.encode(e, symbol)
+		}
+		if err := e.flush(); err != nil {
+			t.Fatal(err)
+		}
+		d := newRangeDecoder(bytes.NewReader(buf.Bytes()))
+		tree = newBitTree(width)
+		for i, symbol := range symbols {
+			if got := tree.decode(d); got != symbol {
+				t.Fatalf("width %d symbol %d: got %d, want %d", width, i, got, symbol)
+			}
+		}
+		if d.err != nil {
+			t.Errorf("width %d: %v", width, d.err)
+		}
+	}
+}
+
+func TestHashCanonical(t *testing.T) {
+	rng := rand.New(rand.NewSource(14))
+	cb := testCodebook(t, rng, []int{8, 5, 3}, Float32)
+	hash := cb.Hash()
+
+	// the format, its version and the metadata do not change the hash
+	got, err := ParseBinaryCodebook(writeBinary(t, cb, Float32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got.Version, got.Seed, got.Corpus = 1, 42, "corpus"
+	if got.Hash() != hash {
+		t.Error("hash changed by the binary format and the metadata")
+	}
+
+	// the codewords do
+	got, err = ParseBinaryCodebook(writeBinary(t, cb, Float32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got.Centroids[1][2][0]++
+	if got.Hash() == hash {
+		t.Error("hash unchanged by the codewords")
+	}
+
+	// and so do the exemplars
+	var exemplars = make([][][]float64, 8)
+	exemplars[1] = randomCodewords(rng, cb.Layout, []int{1}, Float32)[0]
+	if err := cb.SetExemplars([][][][]float64{exemplars}); err != nil {
+		t.Fatal(err)
+	}
+	if cb.Hash() == hash {
+		t.Error("hash unchanged by the exemplars")
+	}
+
+	// and the residual stages
+	hash = cb.Hash()
+	if err := cb.SetResiduals([][][][]float64{randomCodewords(rng, cb.Layout, []int{2, 2, 2}, Float32)}); err != nil {
+		t.Fatal(err)
+	}
+	if cb.Hash() == hash {
+		t.Error("hash unchanged by the residuals")
+	}
+}
+
+// adaptCodebook returns a codebook adapted from cb like kmeans1 --adapt does:
+// an exemplar replaced and codewords appended to the first band.
+func adaptCodebook(t *testing.T, rng *rand.Rand, cb *Codebook, appended int) *Codebook {
+	var centroids = make([][][]float64, len(cb.Centroids))
+	for rang, band := range cb.Centroids {
+		centroids[rang] = append([][]float64(nil), band...)
+	}
+	centroids[0][1] = randomCodewords(rng, cb.Layout, []int{1}, Float32)[0][0]
+	centroids[0] = append(centroids[0], randomCodewords(rng, cb.Layout, []int{appended}, Float32)[0]...)
+	adapted, err := NewCodebookLayout(cb.Layout, centroids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	adapted.Parents = cb.Lineage()
+	return adapted
+}
+
+func TestGSCAdaptedCodebook(t *testing.T) {
+	rng := rand.New(rand.NewSource(15))
+	parent := testCodebook(t, rng, []int{4, 3, 2}, Float32)
+	adapted := adaptCodebook(t, rng, parent, 3)
+	grandchild := adaptCodebook(t, rng, adapted, 2)
+	if parent.Bits(0) == adapted.Bits(0) || adapted.Bits(0) == grandchild.Bits(0) {
+		t.Fatal("the appended codewords do not widen the band")
+	}
+
+	// the lineage survives both codebook formats
+	var buf bytes.Buffer
+	if err := grandchild.WriteJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	fromJSON, err := ParseCodebook(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromBinary, err := ParseBinaryCodebook(writeBinary(t, grandchild, Float32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cb := range []*Codebook{fromJSON, fromBinary} {
+		if !reflect.DeepEqual(cb.Parents, grandchild.Parents) {
+			t.Errorf("parents %v, want %v", cb.Parents, grandchild.Parents)
+		}
+	}
+
+	for _, rangeCoded := range []bool{false, true} {
+		tokens := randomTokens(rng, parent, 100)
+		var buf bytes.Buffer
+		if err := parent.WriteGSC(&buf, tokens, rangeCoded); err != nil {
+			t.Fatal(err)
+		}
+		data := buf.Bytes()
+		for _, cb := range []*Codebook{adapted, grandchild, fromBinary} {
+			got, err := cb.ReadGSC(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("range coded %v: %v", rangeCoded, err)
+			}
+			if !reflect.DeepEqual(got, tokens) {
+				t.Errorf("range coded %v: tokens differ", rangeCoded)
+			}
+		}
+	}
+
+	// the parent does not read the streams of the adapted codebook
+	buf.Reset()
+	if err := adapted.WriteGSC(&buf, randomTokens(rng, adapted, 10), false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parent.ReadGSC(&buf); !errors.Is(err, ErrCodebookMismatch) {
+		t.Errorf("got %v, want ErrCodebookMismatch", err)
+	}
+}
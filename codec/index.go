@@ -0,0 +1,108 @@
+package codec
+
+import (
+	"math"
+	"sort"
+)
+
+// Index is an exact nearest neighbour index over codeword keys.
+//
+// Codewords are sorted by their euclidean norm. By the triangle inequality a
+// codeword whose norm differs from the query norm by d is at squared distance
+// of at least d*d, so the search walks outwards from the query norm and stops
+// once that bound exceeds the best distance found. Distances are computed with
+// early exit, in the same order as a linear scan, and ties resolve to the
+// lowest codeword index, so the result always equals the linear scan.
+type Index struct {
+	keys  [][]float64
+	order []int32   // codeword indices sorted by norm
+	norms []float64 // norms in sorted order
+}
+
+// NewIndex indexes the keys, empty keys are never returned.
+func NewIndex(keys [][]float64) *Index {
+	ix := &Index{keys: keys}
+	for idx, key := range keys {
+		if len(key) != 0 {
+			ix.order = append(ix.order, int32(idx))
+		}
+	}
+	var norms = make([]float64, len(keys))
+	for _, idx := range ix.order {
+		norms[idx] = Norm(keys[idx])
+	}
+	sort.SliceStable(ix.order, func(i, j int) bool {
+		return norms[ix.order[i]] < norms[ix.order[j]]
+	})
+	ix.norms = make([]float64, len(ix.order))
+	for i, idx := range ix.order {
+		ix.norms[i] = norms[idx]
+	}
+	return ix
+}
+
+// Norm returns the euclidean norm of the key.
+func Norm(key []float64) float64 {
+	var sum float64
+	for _, v := range key {
+		sum += v * v
+	}
+	return math.Sqrt(sum)
+}
+
+// PartialDistance returns the squared euclidean distance of a and b. Once the
+// running sum exceeds limit it stops early and returns the partial sum.
+func PartialDistance(a, b []float64, limit float64) float64 {
+	var dist float64
+	for k := range a {
+		diff := a[k] - b[k]
+		dist += diff * diff
+		if dist > limit {
+			return dist
+		}
+	}
+	return dist
+}
+
+// LowerBound returns a lower bound of the squared distance of keys with the norms.
+// It is slightly loosened so rounding errors never prune an exact match.
+func LowerBound(norm1, norm2 float64) float64 {
+	d := math.Abs(norm1 - norm2)
+	return d * d * (1 - 1e-9)
+}
+
+// Nearest returns the index of the nearest codeword and its squared distance,
+// or -1 for an empty index.
+func (ix *Index) Nearest(key []float64) (int, float64) {
+	if len(ix.order) == 0 {
+		return -1, math.MaxFloat64
+	}
+	norm := Norm(key)
+	hi := sort.SearchFloat64s(ix.norms, norm)
+	lo := hi - 1
+	best, bestDist := -1, math.MaxFloat64
+	visit := func(i int) {
+		idx := int(ix.order[i])
+		dist := PartialDistance(key, ix.keys[idx], bestDist)
+		if dist < bestDist || (dist == bestDist && idx < best) {
+			best, bestDist = idx, dist
+		}
+	}
+	for lo >= 0 || hi < len(ix.order) {
+		if hi < len(ix.order) && LowerBound(ix.norms[hi], norm) > bestDist {
+			hi = len(ix.order)
+		}
+		if lo >= 0 && LowerBound(ix.norms[lo], norm) > bestDist {
+			lo = -1
+		}
+		if hi < len(ix.order) {
+			visit(hi)
+			hi++
+		}
+		if lo >= 0 {
+			visit(lo)
+			lo--
+		}
+	}
+	return best, bestDist
+}
@@ -0,0 +1,103 @@
+package codec
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// tiedKeys returns keys of small integer coordinates, so that many keys have
+// the same norm or are duplicates and many queries are equally near to
+// several keys. Every tenth key is empty like the missing codewords.
+func tiedKeys(rng *rand.Rand, n, dims int) [][]float64 {
+	var keys = make([][]float64, n)
+	for idx := range keys {
+		if idx%10 == 9 {
+			continue
+		}
+		if idx > 0 && rng.Intn(4) == 0 {
+			// a permutation of an earlier key, of the same norm
+			earlier := keys[rng.Intn(idx)]
+			if earlier != nil {
+				keys[idx] = append([]float64(nil), earlier...)
+				rng.Shuffle(dims, func(i, j int) { keys[idx][i], keys[idx][j] = keys[idx][j], keys[idx][i] })
+				continue
+			}
+		}
+		keys[idx] = make([]float64, dims)
+		for d := range keys[idx] {
+			keys[idx][d] = float64(rng.Intn(4))
+		}
+	}
+	return keys
+}
+
+func TestIndexMatchesLinear(t *testing.T) {
+	rng := rand.New(rand.NewSource(16))
+	for _, dims := range []int{1, 2, 6} {
+		for _, n := range []int{1, 2, 10, 300} {
+			keys := tiedKeys(rng, n, dims)
+			ix := NewIndex(keys)
+			for q := 0; q < 500; q++ {
+				var query = make([]float64, dims)
+				for d := range query {
+					query[d] = float64(rng.Intn(5)) - 0.5*float64(rng.Intn(2))
+				}
+				want := nearest(keys, query)
+				if got, _ := ix.Nearest(query); got != want {
+					t.Fatalf("%d keys of %d dims, query %v: index %d, linear %d", n, dims, query, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestIndexRandomKeys(t *testing.T) {
+	rng := rand.New(rand.NewSource(17))
+	keys := randomKeys(rng, 2000, 24)
+	ix := NewIndex(keys)
+	for q := 0; q < 200; q++ {
+		query := randomKeys(rng, 1, 24)[0]
+		want := nearest(keys, query)
+		if got, _ := ix.Nearest(query); got != want {
+			t.Fatalf("query %d: index %d, linear %d", q, got, want)
+		}
+	}
+}
+
+// randomKeys returns keys of magnitudes spread over decades like the band keys.
+func randomKeys(rng *rand.Rand, n, dims int) [][]float64 {
+	var keys = make([][]float64, n)
+	for idx := range keys {
+		keys[idx] = make([]float64, dims)
+		scale := math.Exp(2 * rng.NormFloat64())
+		for d := range keys[idx] {
+			keys[idx][d] = scale * rng.Float64()
+		}
+	}
+	return keys
+}
+
+// benchmarkBand is a synthetic band of the size of the master codebooks, of
+// the dimensions of the first native band.
+func benchmarkBand() (keys, queries [][]float64) {
+	rng := rand.New(rand.NewSource(18))
+	return randomKeys(rng, 32767, 2*38), randomKeys(rng, 256, 2*38)
+}
+
+func BenchmarkNearestIndexed(b *testing.B) {
+	keys, queries := benchmarkBand()
+	ix := NewIndex(keys)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ix.Nearest(queries[i%len(queries)])
+	}
+}
+
+func BenchmarkNearestLinear(b *testing.B) {
+	keys, queries := benchmarkBand()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		nearest(keys, queries[i%len(queries)])
+	}
+}
@@ -0,0 +1,251 @@
+package codec
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Raw PCM sample formats
+const (
+	S16LE = "s16le"
+	F32LE = "f32le"
+)
+
+// ErrBadWav is returned for WAV streams which can not be decoded
+var ErrBadWav = errors.New("codec: unsupported wav stream")
+
+// SampleReader reads mono samples from a WAV or raw PCM stream without
+// loading it whole. Only the first channel of multichannel audio is kept.
+//
+// Samples are scaled the same way as by the WAV loader of phase.LoadWavSampleRate,
+// so that streamed and file input encode to the same tokens.
+type SampleReader struct {
+	r *bufio.Reader
+
+	// SampleRate of the stream
+	SampleRate uint32
+
+	bits      int
+	float     bool
+	channels  int
+	remaining int64 // data bytes left, negative for streams of unknown length
+	frame     []byte
+}
+
+// NewRawReader reads headerless PCM of the format (S16LE or F32LE).
+func NewRawReader(r io.Reader, format string, sampleRate uint32) (*SampleReader, error) {
+	s := &SampleReader{r: bufio.NewReader(r), SampleRate: sampleRate, channels: 1, remaining: -1}
+	switch format {
+	case S16LE:
+		s.bits = 16
+	case F32LE:
+		s.bits = 32
+		s.float = true
+	default:
+		return nil, fmt.Errorf("codec: unsupported raw format %q", format)
+	}
+	s.frame = make([]byte, s.bits/8)
+	return s, nil
+}
+
+// NewWavReader parses the WAV header and positions the reader at the samples.
+// Streams produced by recorders which do not know their length in advance are
+// accepted and read until EOF.
+func NewWavReader(r io.Reader) (*SampleReader, error) {
+	s := &SampleReader{r: bufio.NewReader(r)}
+	var riff [12]byte
+	if _, err := io.ReadFull(s.r, riff[:]); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadWav, err)
+	}
+	if string(riff[0:4]) != "RIFF" || string(riff[8:12]) != "WAVE" {
+		return nil, ErrBadWav
+	}
+	for {
+		var chunk [8]byte
+		if _, err := io.ReadFull(s.r, chunk[:]); err != nil {
+			return nil, fmt.Errorf("%w: missing data chunk", ErrBadWav)
+		}
+		size := binary.LittleEndian.Uint32(chunk[4:])
+		switch string(chunk[0:4]) {
+		case "fmt ":
+			if size < 16 {
+				return nil, ErrBadWav
+			}
+			var body = make([]byte, size+size%2)
+			if _, err := io.ReadFull(s.r, body); err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrBadWav, err)
+			}
+			formatType := binary.LittleEndian.Uint16(body[0:])
+			s.channels = int(binary.LittleEndian.Uint16(body[2:]))
+			s.SampleRate = binary.LittleEndian.Uint32(body[4:])
+			s.bits = int(binary.LittleEndian.Uint16(body[14:]))
+			if formatType == 0xFFFE && size >= 26 {
+				// WAVEFORMATEXTENSIBLE, the sub format starts with the format type
+				formatType = binary.LittleEndian.Uint16(body[24:])
+			}
+			switch {
+			case formatType == 1 && (s.bits == 8 || s.bits == 16 || s.bits == 24):
+			case formatType == 3 && s.bits == 32:
+				s.float = true
+			default:
+				return nil, fmt.Errorf("%w: format %d with %d bits", ErrBadWav, formatType, s.bits)
+			}
+		case "data":
+			if s.bits == 0 || s.channels == 0 {
+				return nil, fmt.Errorf("%w: missing fmt chunk", ErrBadWav)
+			}
+			s.remaining = int64(size)
+			if size == 0 || size == 0xFFFFFFFF {
+				s.remaining = -1
+			}
+			s.frame = make([]byte, s.channels*s.bits/8)
+			return s, nil
+		default:
+			if _, err := s.r.Discard(int(size + size%2)); err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrBadWav, err)
+			}
+		}
+	}
+}
+
+// Read reads up to len(buf) samples. It returns io.EOF at the end of the stream.
+func (s *SampleReader) Read(buf []float64) (n int, err error) {
+	for n < len(buf) {
+		if s.remaining >= 0 && s.remaining < int64(len(s.frame)) {
+			err = io.EOF
+			break
+		}
+		if n > 0 && s.r.Buffered() < len(s.frame) {
+			// do not block with samples at hand
+			break
+		}
+		if _, err = io.ReadFull(s.r, s.frame); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
+			break
+		}
+		if s.remaining >= 0 {
+			s.remaining -= int64(len(s.frame))
+		}
+		buf[n] = s.sample(s.frame)
+		n++
+	}
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// sample decodes the first channel of a sample frame.
+func (s *SampleReader) sample(p []byte) float64 {
+	switch {
+	case s.float:
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(p)))
+	case s.bits == 8:
+		return float64(p[0])/(1<<8-1)*2 - 1
+	case s.bits == 16:
+		return float64(int16(binary.LittleEndian.Uint16(p))) / (1<<16 - 1)
+	default:
+		return float64((int32(p[0])<<8)+(int32(p[1])<<16)+(int32(p[2])<<24)) / (1 << 8) / (1<<24 - 1)
+	}
+}
+
+// SampleWriter writes mono samples as a WAV or raw PCM stream.
+type SampleWriter struct {
+	w     io.Writer
+	bw    *bufio.Writer
+	float bool
+	wav   bool
+	data  int64 // data bytes written
+	buf   [4]byte
+}
+
+// NewRawWriter writes headerless PCM of the format (S16LE or F32LE).
+func NewRawWriter(w io.Writer, format string) (*SampleWriter, error) {
+	s := &SampleWriter{w: w, bw: bufio.NewWriter(w)}
+	switch format {
+	case S16LE:
+	case F32LE:
+		s.float = true
+	default:
+		return nil, fmt.Errorf("codec: unsupported raw format %q", format)
+	}
+	return s, nil
+}
+
+// NewWavWriter writes a 16 bit mono WAV stream. As the length is not known in
+// advance, the header declares the maximal length, Close fixes it up when the
+// writer is seekable.
+func NewWavWriter(w io.Writer, sampleRate int) (*SampleWriter, error) {
+	s := &SampleWriter{w: w, bw: bufio.NewWriter(w), wav: true}
+	var header [44]byte
+	copy(header[0:], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], 0xFFFFFFFF)
+	copy(header[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(header[16:], 16)
+	binary.LittleEndian.PutUint16(header[20:], 1)
+	binary.LittleEndian.PutUint16(header[22:], 1)
+	binary.LittleEndian.PutUint32(header[24:], uint32(sampleRate))
+	binary.LittleEndian.PutUint32(header[28:], uint32(2*sampleRate))
+	binary.LittleEndian.PutUint16(header[32:], 2)
+	binary.LittleEndian.PutUint16(header[34:], 16)
+	copy(header[36:], "data")
+	binary.LittleEndian.PutUint32(header[40:], 0xFFFFFFFF)
+	if _, err := s.bw.Write(header[:]); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Write writes samples, clipping them to [-1, 1].
+func (s *SampleWriter) Write(samples []float64) error {
+	for _, x := range samples {
+		if x > 1 {
+			x = 1
+		} else if x < -1 {
+			x = -1
+		}
+		if s.float {
+			binary.LittleEndian.PutUint32(s.buf[:], math.Float32bits(float32(x)))
+			s.bw.Write(s.buf[:4])
+			s.data += 4
+		} else {
+			binary.LittleEndian.PutUint16(s.buf[:], uint16(int16(x*(1<<15-1))))
+			s.bw.Write(s.buf[:2])
+			s.data += 2
+		}
+	}
+	return nil
+}
+
+// Flush writes the buffered samples to the underlying writer.
+func (s *SampleWriter) Flush() error {
+	return s.bw.Flush()
+}
+
+// Close flushes the samples and fixes up the WAV header if possible.
+func (s *SampleWriter) Close() error {
+	if err := s.bw.Flush(); err != nil {
+		return err
+	}
+	ws, ok := s.w.(io.WriteSeeker)
+	if !s.wav || !ok || s.data > math.MaxUint32-36 {
+		return nil
+	}
+	if _, err := ws.Seek(4, io.SeekStart); err != nil {
+		// pipes can not be fixed up
+		return nil
+	}
+	binary.LittleEndian.PutUint32(s.buf[:], uint32(36+s.data))
+	ws.Write(s.buf[:4])
+	ws.Seek(40, io.SeekStart)
+	binary.LittleEndian.PutUint32(s.buf[:], uint32(s.data))
+	ws.Write(s.buf[:4])
+	_, err := ws.Seek(0, io.SeekEnd)
+	return err
+}
@@ -0,0 +1,145 @@
+package codec
+
+import (
+	"io"
+)
+
+// Adaptive binary range coder in the style of LZMA. Symbols are coded bit
+// by bit along a binary tree of adaptive probabilities, so a tree per band
+// learns the codeword usage of the band as the stream goes.
+
+const (
+	rcTop       = 1 << 24
+	rcProbBits  = 11
+	rcProbInit  = 1 << rcProbBits / 2
+	rcMoveShift = 5
+)
+
+type rangeEncoder struct {
+	w         io.ByteWriter
+	low       uint64
+	rng       uint32
+	cache     byte
+	cacheSize int64
+	err       error
+}
+
+func newRangeEncoder(w io.ByteWriter) *rangeEncoder {
+	return &rangeEncoder{w: w, rng: 0xFFFFFFFF, cacheSize: 1}
+}
+
+func (e *rangeEncoder) shiftLow() {
+	if uint32(e.low) < 0xFF000000 || e.low>>32 != 0 {
+		carry := byte(e.low >> 32)
+		temp := e.cache
+		for {
+			if err := e.w.WriteByte(temp + carry); err != nil && e.err == nil {
+				e.err = err
+			}
+			temp = 0xFF
+			e.cacheSize--
+			if e.cacheSize == 0 {
+				break
+			}
+		}
+		e.cache = byte(e.low >> 24)
+	}
+	e.cacheSize++
+	e.low = (e.low & 0x00FFFFFF) << 8
+}
+
+func (e *rangeEncoder) encodeBit(prob *uint16, bit uint32) {
+	bound := (e.rng >> rcProbBits) * uint32(*prob)
+	if bit == 0 {
+		e.rng = bound
+		*prob += (1<<rcProbBits - *prob) >> rcMoveShift
+	} else {
+		e.low += uint64(bound)
+		e.rng -= bound
+		*prob -= *prob >> rcMoveShift
+	}
+	for e.rng < rcTop {
+		e.rng <<= 8
+		e.shiftLow()
+	}
+}
+
+// flush writes the pending bytes, the encoder is done afterwards.
+func (e *rangeEncoder) flush() error {
+	for i := 0; i < 5; i++ {
+		e.shiftLow()
+	}
+	return e.err
+}
+
+type rangeDecoder struct {
+	r    io.ByteReader
+	rng  uint32
+	code uint32
+	err  error
+}
+
+func newRangeDecoder(r io.ByteReader) *rangeDecoder {
+	d := &rangeDecoder{r: r, rng: 0xFFFFFFFF}
+	for i := 0; i < 5; i++ {
+		d.code = d.code<<8 | uint32(d.readByte())
+	}
+	return d
+}
+
+func (d *rangeDecoder) readByte() byte {
+	b, err := d.r.ReadByte()
+	if err != nil && d.err == nil {
+		d.err = err
+	}
+	return b
+}
+
+func (d *rangeDecoder) decodeBit(prob *uint16) (bit uint32) {
+	bound := (d.rng >> rcProbBits) * uint32(*prob)
+	if d.code < bound {
+		d.rng = bound
+		*prob += (1<<rcProbBits - *prob) >> rcMoveShift
+	} else {
+		d.code -= bound
+		d.rng -= bound
+		*prob -= *prob >> rcMoveShift
+		bit = 1
+	}
+	for d.rng < rcTop {
+		d.rng <<= 8
+		d.code = d.code<<8 | uint32(d.readByte())
+	}
+	return
+}
+
+// bitTree holds the adaptive probabilities of symbols of a fixed bit width.
+type bitTree struct {
+	bits  int
+	probs []uint16
+}
+
+func newBitTree(bits int) *bitTree {
+	t := &bitTree{bits: bits, probs: make([]uint16, 1<<bits)}
+	for i := range t.probs {
+		t.probs[i] = rcProbInit
+	}
+	return t
+}
+
+func (t *bitTree) encode(e *rangeEncoder, symbol uint32) {
+	m := uint32(1)
+	for i := t.bits - 1; i >= 0; i-- {
+		bit := (symbol >> uint(i)) & 1
+		e.encodeBit(&t.probs[m], bit)
+		m = m<<1 | bit
+	}
+}
+
+func (t *bitTree) decode(d *rangeDecoder) uint32 {
+	m := uint32(1)
+	for i := 0; i < t.bits; i++ {
+		m = m<<1 | d.decodeBit(&t.probs[m])
+	}
+	return m - uint32(len(t.probs))
+}
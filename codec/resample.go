@@ -0,0 +1,170 @@
+package codec
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	// resampleZeros is the number of filter zero crossings on each side of a sample
+	resampleZeros = 16
+	// resampleRolloff is the filter cutoff relative to the lower Nyquist frequency
+	resampleRolloff = 0.95
+	// resampleBeta is the Kaiser window shape parameter
+	resampleBeta = 8.6
+	// resampleTable is the largest number of filter phases which are precomputed
+	resampleTable = 4096
+)
+
+// Resampler converts mono audio between sample rates by a band-limited
+// polyphase filter, a Kaiser windowed sinc with the cutoff below the lower
+// of the two Nyquist frequencies. It works incrementally with bounded memory.
+type Resampler struct {
+	up, down int     // the rate ratio, to/from in lowest terms
+	half     int     // filter taps on each side of the output position, in input samples
+	cutoff   float64 // filter cutoff relative to the input Nyquist frequency
+
+	phases [][]float64 // precomputed filter taps of every phase, if not too many
+
+	buf  []float64 // input samples from index base on
+	base int
+	n    int // index of the next output sample
+}
+
+// NewResampler creates a resampler from one sample rate to another.
+func NewResampler(from, to int) (*Resampler, error) {
+	if from <= 0 || to <= 0 {
+		return nil, fmt.Errorf("%w: %d to %d", ErrUnsupportedSampleRate, from, to)
+	}
+	g := gcd(from, to)
+	r := &Resampler{up: to / g, down: from / g}
+	r.cutoff = resampleRolloff * math.Min(1, float64(r.up)/float64(r.down))
+	r.half = int(math.Ceil(resampleZeros / r.cutoff))
+	if r.up <= resampleTable && r.up != r.down {
+		r.phases = make([][]float64, r.up)
+		for p := range r.phases {
+			r.phases[p] = r.taps(p, nil)
+		}
+	}
+	return r, nil
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// taps computes the filter taps of a phase, the output position being
+// phase/up input samples after the integer input position.
+func (r *Resampler) taps(phase int, dst []float64) []float64 {
+	dst = dst[:0]
+	frac := float64(phase) / float64(r.up)
+	for k := -r.half + 1; k <= r.half; k++ {
+		x := float64(k) - frac
+		dst = append(dst, r.cutoff*sinc(r.cutoff*x)*kaiser(x/float64(r.half)))
+	}
+	return dst
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	return math.Sin(math.Pi*x) / (math.Pi * x)
+}
+
+// kaiser is the Kaiser window on -1 to 1.
+func kaiser(x float64) float64 {
+	if x <= -1 || x >= 1 {
+		return 0
+	}
+	return besselI0(resampleBeta*math.Sqrt(1-x*x)) / besselI0(resampleBeta)
+}
+
+// besselI0 is the zeroth order modified Bessel function of the first kind.
+func besselI0(x float64) float64 {
+	sum, term := 1.0, 1.0
+	for k := 1; term > sum*1e-12; k++ {
+		term *= (x / (2 * float64(k))) * (x / (2 * float64(k)))
+		sum += term
+	}
+	return sum
+}
+
+// Write feeds input samples and returns the output samples which got final.
+func (r *Resampler) Write(samples []float64) []float64 {
+	if r.up == r.down {
+		return append([]float64(nil), samples...)
+	}
+	r.buf = append(r.buf, samples...)
+	return r.output(r.base + len(r.buf) - r.half)
+}
+
+// Flush returns the remaining output samples, the input being over.
+func (r *Resampler) Flush() []float64 {
+	if r.up == r.down {
+		return nil
+	}
+	// the output lasts as long as the input, the filter sees zeros past its end
+	end := int64(r.base + len(r.buf))
+	r.buf = append(r.buf, make([]float64, r.half)...)
+	var out []float64
+	for int64(r.n)*int64(r.down) < end*int64(r.up) {
+		out = append(out, r.sample(r.n))
+		r.n++
+	}
+	r.buf, r.base, r.n = nil, 0, 0
+	return out
+}
+
+// output produces the samples whose integer input position is before limit.
+func (r *Resampler) output(limit int) []float64 {
+	var out []float64
+	for {
+		pos := int64(r.n) * int64(r.down)
+		if int(pos/int64(r.up)) >= limit {
+			break
+		}
+		out = append(out, r.sample(r.n))
+		r.n++
+	}
+	// drop the input no later output sample reaches
+	next := int(int64(r.n)*int64(r.down)/int64(r.up)) - r.half + 1
+	if drop := next - r.base; drop > 0 && drop <= len(r.buf) {
+		r.buf = append(r.buf[:0], r.buf[drop:]...)
+		r.base = next
+	}
+	return out
+}
+
+// sample computes the output sample n.
+func (r *Resampler) sample(n int) float64 {
+	pos := int64(n) * int64(r.down)
+	i := int(pos / int64(r.up))
+	phase := int(pos % int64(r.up))
+	var h []float64
+	if r.phases != nil {
+		h = r.phases[phase]
+	} else {
+		h = r.taps(phase, make([]float64, 0, 2*r.half))
+	}
+	var sum float64
+	for k, c := range h {
+		j := i - r.half + 1 + k - r.base
+		if j >= 0 && j < len(r.buf) {
+			sum += c * r.buf[j]
+		}
+	}
+	return sum
+}
+
+// Resample converts mono audio from one sample rate to another.
+func Resample(audio []float64, from, to int) ([]float64, error) {
+	r, err := NewResampler(from, to)
+	if err != nil {
+		return nil, err
+	}
+	return append(r.Write(audio), r.Flush()...), nil
+}
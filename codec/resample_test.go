@@ -0,0 +1,110 @@
+package codec
+
+import (
+	"math"
+	"testing"
+)
+
+// sine returns a second of a unit sine of the frequency at the sample rate.
+func sine(freq float64, sampleRate int) []float64 {
+	var audio = make([]float64, sampleRate)
+	for i := range audio {
+		audio[i] = math.Sin(2 * math.Pi * freq * float64(i) / float64(sampleRate))
+	}
+	return audio
+}
+
+// rms returns the root mean square of the middle half of the audio, away
+// from the filter edges.
+func rms(audio []float64) float64 {
+	var sum float64
+	middle := audio[len(audio)/4 : 3*len(audio)/4]
+	for _, v := range middle {
+		sum += v * v
+	}
+	return math.Sqrt(sum / float64(len(middle)))
+}
+
+func TestResampleGain(t *testing.T) {
+	for _, c := range []struct {
+		from, to int
+		freq     float64
+	}{
+		{16000, 48000, 1000},
+		{44100, 48000, 1000},
+		{48000, 44100, 5000},
+		{48000, 16000, 3000},
+		{22050, 44100, 7000},
+	} {
+		out, err := Resample(sine(c.freq, c.from), c.from, c.to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(out) != c.to {
+			t.Errorf("%d to %d Hz: %d samples, want %d", c.from, c.to, len(out), c.to)
+		}
+		// a unit sine has an RMS of 1/sqrt(2)
+		gain := 20 * math.Log10(rms(out)*math.Sqrt2)
+		if math.Abs(gain) > 0.05 {
+			t.Errorf("%d to %d Hz: %g Hz passes with a gain of %.3f dB", c.from, c.to, c.freq, gain)
+		}
+		// the output is the sine at the new rate
+		want := sine(c.freq, c.to)
+		var errSum float64
+		for i := c.to / 4; i < 3*c.to/4; i++ {
+			errSum += (out[i] - want[i]) * (out[i] - want[i])
+		}
+		if snr := 10 * math.Log10(float64(c.to/2)/2/errSum); snr < 60 {
+			t.Errorf("%d to %d Hz: %g Hz reproduced at an SNR of %.1f dB", c.from, c.to, c.freq, snr)
+		}
+	}
+}
+
+func TestResampleAliasing(t *testing.T) {
+	for _, c := range []struct {
+		from, to int
+		freq     float64
+	}{
+		// beyond the output Nyquist frequency, removed instead of folded down
+		{48000, 16000, 12000},
+		{48000, 16000, 20000},
+		{44100, 16000, 10000},
+		{48000, 22050, 16000},
+	} {
+		out, err := Resample(sine(c.freq, c.from), c.from, c.to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if level := 20 * math.Log10(rms(out)*math.Sqrt2); level > -60 {
+			t.Errorf("%d to %d Hz: %g Hz aliases at %.1f dB", c.from, c.to, c.freq, level)
+		}
+	}
+}
+
+func TestResamplerIncremental(t *testing.T) {
+	audio := sine(440, 44100)
+	want, err := Resample(audio, 44100, 48000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewResampler(44100, 48000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []float64
+	for i, n := 0, 1; i < len(audio); i, n = i+n, n*3%1009+1 {
+		if i+n > len(audio) {
+			n = len(audio) - i
+		}
+		got = append(got, r.Write(audio[i:i+n])...)
+	}
+	got = append(got, r.Flush()...)
+	if len(got) != len(want) {
+		t.Fatalf("%d samples, want %d", len(got), len(want))
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("sample %d: %g, want %g", i, got[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package codec
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+// Stages returns the number of quantisation stages of the codebook, 1 for
+// codebooks without residual stages.
+func (cb *Codebook) Stages() int {
+	return 1 + len(cb.Residuals)
+}
+
+// SetResiduals sets the residual stage codebooks, see Residuals. A stage may
+// lack the trailing bands, or hold empty bands, their residual is not coded.
+func (cb *Codebook) SetResiduals(residuals [][][][]float64) error {
+	var indexes = make([][]*Index, len(residuals))
+	for stage, bands := range residuals {
+		if len(bands) > len(cb.Centroids) {
+			return fmt.Errorf("codec: residual stage %d has %d bands, codebook has %d", stage+2, len(bands), len(cb.Centroids))
+		}
+		indexes[stage] = make([]*Index, len(bands))
+		for rang, band := range bands {
+			want := 3 * (cb.Ranges[rang+1] - cb.Ranges[rang])
+			for idx, codeword := range band {
+				if len(codeword) != want {
+					return fmt.Errorf("codec: residual stage %d band %d codeword %d has %d values, expected %d", stage+2, rang, idx, len(codeword), want)
+				}
+			}
+			indexes[stage][rang] = NewIndex(band)
+		}
+	}
+	if len(residuals) == 0 {
+		residuals, indexes = nil, nil
+	}
+	cb.Residuals, cb.residualIndexes = residuals, indexes
+	cb.forgetHash()
+	return nil
+}
+
+// ResidualSize returns the number of codewords of a band in residual stage,
+// stage 1 being the first residual stage.
+func (cb *Codebook) ResidualSize(stage, rang int) int {
+	if stage < 1 || stage > len(cb.Residuals) || rang >= len(cb.Residuals[stage-1]) {
+		return 0
+	}
+	return len(cb.Residuals[stage-1][rang])
+}
+
+// ResidualBits returns the bit width of the tokens of a band in residual stage.
+func (cb *Codebook) ResidualBits(stage, rang int) int {
+	if cb.ResidualSize(stage, rang) <= 1 {
+		return 0
+	}
+	return bits.Len(uint(cb.ResidualSize(stage, rang) - 1))
+}
+
+// encodeResiduals stores into the tokens of every band of the residual
+// stages in out the residual codeword nearest to what the stages before leave
+// of a frame. The residual is taken of the primary exemplar of the base
+// tokens, in linear magnitudes.
+func (cb *Codebook) encodeResiduals(out [][]uint32, tokens []uint32, frame [][3]float64) {
+	for rang, token := range tokens {
+		if rang >= len(cb.Centroids) || int(token) >= len(cb.Centroids[rang]) || len(cb.Centroids[rang][token]) == 0 {
+			continue
+		}
+		centroid := cb.Centroids[rang][token]
+		residual := make([]float64, len(centroid))
+		for i := 0; 3*i+2 < len(centroid); i++ {
+			for l := 0; l < 3; l++ {
+				residual[3*i+l] = math.Exp2(frame[cb.Ranges[rang]+i][l]) - math.Exp2(centroid[3*i+l])
+			}
+		}
+		for stage := range out {
+			if rang >= len(cb.residualIndexes[stage]) {
+				continue
+			}
+			idx, _ := cb.residualIndexes[stage][rang].Nearest(residual)
+			if idx < 0 {
+				continue
+			}
+			out[stage][rang] = uint32(idx)
+			for i, v := range cb.Residuals[stage][rang][idx] {
+				residual[i] -= v
+			}
+		}
+	}
+}
+
+// addResiduals adds the residual codewords of the tokens of a frame of the
+// given residual stages to the decoded frame, in linear magnitudes floored
+// at the spectrogram floor.
+func (cb *Codebook) addResiduals(frame [][3]float64, rang int, tokens []uint32) error {
+	var sum []float64
+	for stage, token := range tokens {
+		if stage >= len(cb.Residuals) || rang >= len(cb.Residuals[stage]) || len(cb.Residuals[stage][rang]) == 0 {
+			continue
+		}
+		if int(token) >= len(cb.Residuals[stage][rang]) {
+			return fmt.Errorf("%w: residual stage %d band %d token %d", ErrTokenRange, stage+2, rang, token)
+		}
+		codeword := cb.Residuals[stage][rang][token]
+		if sum == nil {
+			sum = make([]float64, len(codeword))
+		}
+		for i, v := range codeword {
+			sum[i] += v
+		}
+	}
+	for i := 0; 3*i+2 < len(sum); i++ {
+		for l := 0; l < 3; l++ {
+			frame[i][l] = math.Log2(math.Max(math.Exp2(frame[i][l])+sum[3*i+l], 1e-10))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package codec
+
+import (
+	"math"
+
+	"github.com/r9y9/gossp/stft"
+)
+
+// StreamEncoder encodes audio incrementally with bounded memory. It produces
+// the same token frames as Encoder.Encode on the whole audio.
+type StreamEncoder struct {
+	enc      *Encoder
+	stft     *stft.STFT
+	resample *Resampler
+
+	buf   []float64 // samples from the start of the next frame
+	total int       // native rate samples written so far
+}
+
+// Stream starts a streaming encode of audio at the sample rate.
+func (e *Encoder) Stream(sampleRate uint32) (*StreamEncoder, error) {
+	resample, err := NewResampler(int(sampleRate), e.cb.SampleRate)
+	if err != nil {
+		return nil, err
+	}
+	return &StreamEncoder{
+		enc:      e,
+		stft:     stft.New(e.cb.Window, e.cb.Resolut),
+		resample: resample,
+	}, nil
+}
+
+// Write feeds samples and returns the token frames which got complete.
+func (s *StreamEncoder) Write(samples []float64) ([]uint32, error) {
+	s.append(s.resample.Write(samples))
+	return s.frames(), nil
+}
+
+// append buffers native rate samples.
+func (s *StreamEncoder) append(samples []float64) {
+	s.total += len(samples)
+	s.buf = append(s.buf, samples...)
+}
+
+// Close pads the stream like the batch encoder does and returns the remaining token frames.
+func (s *StreamEncoder) Close() ([]uint32, error) {
+	s.append(s.resample.Flush())
+	window := s.enc.cb.Window
+	// see the padding of phase.ToPhase
+	padLen := 0
+	if s.total >= 15*window {
+		if remainder := (s.total - 15*window) % window; remainder != 0 {
+			padLen = window - remainder - 1
+		}
+	} else {
+		padLen = 15*window - s.total - 1
+	}
+	if padLen > 0 {
+		s.buf = append(s.buf, make([]float64, padLen)...)
+	}
+	return s.frames(), nil
+}
+
+// frames analyses every complete frame in the buffer.
+func (s *StreamEncoder) frames() []uint32 {
+	cb := s.enc.cb
+	if len(s.buf) < cb.Resolut {
+		return nil
+	}
+	spectrum := s.stft.STFT(s.buf)
+	bands := cb.Bands()
+	var indices = make([]uint32, bands*len(spectrum))
+	var frame = make([][3]float64, cb.NumFreqs)
+	for i := range spectrum {
+		for j := range frame {
+			v0 := spectrum[i][j+1]
+			v1 := spectrum[i][cb.Resolut-j-1]
+			frame[j] = [3]float64{imag(v0), real(v1), imag(v1)}
+			for l := range frame[j] {
+				if frame[j][l] < 1e-10 {
+					frame[j][l] = 1e-10
+				}
+				frame[j][l] = math.Log2(frame[j][l])
+			}
+		}
+		s.enc.encodeFrame(indices[bands*i:bands*i+bands], frame)
+	}
+	s.buf = append(s.buf[:0], s.buf[len(spectrum)*cb.Window:]...)
+	return indices
+}
+
+// StreamDecoder decodes token frames incrementally by windowed overlap-add,
+// so that audio is available before the utterance ends.
+type StreamDecoder struct {
+	dec      *Decoder
+	pending  []uint32     // tokens of the incomplete frame
+	overlap  []float64    // overlap-add accumulator of one spectrogram frame
+	previous [][3]float64 // the frame decoded last, picking the exemplars
+}
+
+// Stream starts a streaming decode.
+func (d *Decoder) Stream() *StreamDecoder {
+	return &StreamDecoder{
+		dec:     d,
+		overlap: make([]float64, d.cb.Resolut),
+	}
+}
+
+// Write feeds tokens and returns the audio samples which got final.
+func (s *StreamDecoder) Write(tokens []uint32) ([]float64, error) {
+	bands := s.dec.cb.Bands()
+	s.pending = append(s.pending, tokens...)
+	var out []float64
+	for len(s.pending) >= bands {
+		samples, err := s.frame(s.pending[:bands])
+		if err != nil {
+			return out, err
+		}
+		out = append(out, samples...)
+		s.pending = s.pending[bands:]
+	}
+	s.pending = append([]uint32(nil), s.pending...)
+	return out, nil
+}
+
+// Close decodes an incomplete last frame and returns the remaining samples.
+func (s *StreamDecoder) Close() ([]float64, error) {
+	var out []float64
+	if len(s.pending) > 0 {
+		samples, err := s.frame(s.pending)
+		if err != nil {
+			return nil, err
+		}
+		out = samples
+		s.pending = nil
+	}
+	out = append(out, s.overlap[:len(s.overlap)-s.dec.cb.Window]...)
+	s.overlap = make([]float64, len(s.overlap))
+	s.previous = nil
+	return out, nil
+}
+
+// frame overlap-adds one token frame and returns the hop of final samples.
+func (s *StreamDecoder) frame(tokens []uint32) ([]float64, error) {
+	buf, err := s.dec.frames(tokens, nil, s.previous)
+	if err != nil {
+		return nil, err
+	}
+	// FromPhase modifies the frame
+	s.previous = append(s.previous[:0], buf...)
+	speech, err := s.dec.cb.Phase().FromPhase(buf)
+	if err != nil {
+		return nil, err
+	}
+	for i := range speech {
+		if i < len(s.overlap) {
+			s.overlap[i] += speech[i]
+		}
+	}
+	window := s.dec.cb.Window
+	out := append([]float64(nil), s.overlap[:window]...)
+	copy(s.overlap, s.overlap[window:])
+	for i := len(s.overlap) - window; i < len(s.overlap); i++ {
+		s.overlap[i] = 0
+	}
+	return out, nil
+}
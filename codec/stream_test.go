@@ -0,0 +1,174 @@
+package codec
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// nativeCodebook returns a random codebook of the native 48 kHz layout, the
+// codewords spread over the log2 magnitudes of speech.
+func nativeCodebook(t testing.TB, rng *rand.Rand, size int) *Codebook {
+	layout, err := LayoutFor(48000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sizes = make([]int, layout.Bands())
+	for rang := range sizes {
+		sizes[rang] = size
+	}
+	centroids := randomCodewords(rng, layout, sizes, Float32)
+	for _, band := range centroids {
+		for _, codeword := range band {
+			for i := range codeword {
+				codeword[i] = math.Round(codeword[i]/2*1000) / 1000
+			}
+		}
+	}
+	cb, err := NewCodebookLayout(layout, centroids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cb
+}
+
+// speechLike returns noise and a few harmonics of varying loudness.
+func speechLike(rng *rand.Rand, samples, sampleRate int) []float64 {
+	var audio = make([]float64, samples)
+	for i := range audio {
+		time := float64(i) / float64(sampleRate)
+		loudness := 0.5 + 0.5*math.Sin(2*math.Pi*3*time)
+		for h := 1; h <= 5; h++ {
+			audio[i] += loudness * 0.1 / float64(h) * math.Sin(2*math.Pi*180*float64(h)*time)
+		}
+		audio[i] += 0.01 * rng.NormFloat64()
+	}
+	return audio
+}
+
+// chunks calls write with consecutive pieces of irregular sizes of the samples.
+func chunks(samples int, write func(from, to int)) {
+	for i, n := 0, 7; i < samples; i, n = i+n, n*5%4001+1 {
+		if i+n > samples {
+			n = samples - i
+		}
+		write(i, i+n)
+	}
+}
+
+func TestStreamEncoderMatchesBatch(t *testing.T) {
+	rng := rand.New(rand.NewSource(19))
+	enc := NewEncoder(nativeCodebook(t, rng, 64))
+	for _, c := range []struct{ sampleRate, samples int }{
+		{48000, 48000},
+		{48000, 1000},      // shorter than the padding of the batch encoder
+		{48000, 15 * 1280}, // exactly the padding
+		{16000, 20000},
+		{44100, 30000},
+	} {
+		audio := speechLike(rng, c.samples, c.sampleRate)
+		want, _, err := enc.EncodeLayers(audio, uint32(c.sampleRate), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream, err := enc.Stream(uint32(c.sampleRate))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []uint32
+		chunks(len(audio), func(from, to int) {
+			tokens, err := stream.Write(audio[from:to])
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, tokens...)
+		})
+		tokens, err := stream.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, tokens...)
+		if distinct(want) < 2 {
+			t.Fatalf("%d samples at %d Hz: the audio encodes to a single codeword", c.samples, c.sampleRate)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%d samples at %d Hz: streamed %d tokens differ from the %d batch tokens", c.samples, c.sampleRate, len(got), len(want))
+		}
+	}
+}
+
+// distinct returns the number of distinct tokens.
+func distinct(tokens []uint32) int {
+	var seen = map[uint32]bool{}
+	for _, token := range tokens {
+		seen[token] = true
+	}
+	return len(seen)
+}
+
+func TestStreamDecoderMatchesBatch(t *testing.T) {
+	rng := rand.New(rand.NewSource(20))
+	cb := nativeCodebook(t, rng, 16)
+	// the alternatives of the codewords are picked by the frame before
+	multi := nativeCodebook(t, rng, 16)
+	var exemplars = make([][][][]float64, multi.Bands())
+	for rang := range exemplars {
+		exemplars[rang] = make([][][]float64, 16)
+		for idx := range exemplars[rang] {
+			exemplars[rang][idx] = nativeCodebook(t, rng, 2).Centroids[rang]
+		}
+	}
+	if err := multi.SetExemplars(exemplars); err != nil {
+		t.Fatal(err)
+	}
+	for _, dec := range []*Decoder{NewDecoder(cb), NewDecoder(multi)} {
+		testStreamDecoder(t, rng, dec)
+	}
+}
+
+func testStreamDecoder(t *testing.T, rng *rand.Rand, dec *Decoder) {
+	cb := dec.cb
+	for _, frames := range []int{1, 2, 5, 40} {
+		var tokens []uint32
+		for i := 0; i < frames*cb.Bands(); i++ {
+			tokens = append(tokens, uint32(rng.Intn(16)))
+		}
+		// a trailing incomplete frame decodes with its missing bands silent
+		tokens = append(tokens, 3, 1)
+
+		buf, err := dec.Frames(tokens)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := dec.Synthesize(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream := dec.Stream()
+		var got []float64
+		for i, n := 0, 1; i < len(tokens); i, n = i+n, n*3%17+1 {
+			if i+n > len(tokens) {
+				n = len(tokens) - i
+			}
+			samples, err := stream.Write(tokens[i : i+n])
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, samples...)
+		}
+		samples, err := stream.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, samples...)
+		if len(got) != len(want) {
+			t.Fatalf("%d frames: streamed %d samples, batch %d", frames, len(got), len(want))
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				t.Fatalf("%d frames: sample %d streamed %g, batch %g", frames, i, got[i], want[i])
+			}
+		}
+	}
+}
@@ -7,7 +7,8 @@ require (
 	github.com/neurlang/clusters v0.0.0-20250510123422-80f85025f915
 	github.com/neurlang/gomel v0.0.6
 	github.com/neurlang/kmeans v0.0.1
-
+	github.com/r9y9/gossp v0.0.1
+	github.com/x448/float16 v0.8.4
 )
 
 require (
@@ -19,7 +20,5 @@ require (
 	github.com/mjibson/go-dsp v0.0.0-20180508042940-11479a337f12 // indirect
 	github.com/neurlang/quaternary v0.1.1 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
-	github.com/r9y9/gossp v0.0.1 // indirect
-	github.com/x448/float16 v0.8.4 // indirect
 	golang.org/x/sys v0.5.0 // indirect
 )